@@ -0,0 +1,291 @@
+// Package access implements access control and usage accounting for proxy
+// listeners that are shared with other devices, for example over Wi-Fi. A
+// Controller admits connections only from allowed source addresses, limits the
+// number of simultaneous connections from each client, checks usernames and
+// passwords for proxies that support authentication, and counts the
+// connections and bytes of each client.
+//
+// A client is identified by its IP address.
+package access
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+// Policy says who may use a shared listener.
+type Policy struct {
+	// Allow lists the source addresses from which connections are
+	// accepted. Loopback addresses are always accepted, so that the device
+	// itself can use the listener. If Allow is empty, every source address
+	// is accepted.
+	Allow []netip.Prefix
+	// Users maps usernames to passwords. If it is not empty, clients must
+	// authenticate as one of the users.
+	Users map[string]string
+	// MaxConnsPerClient is the maximum number of simultaneous connections
+	// from one client, or 0 for no limit.
+	MaxConnsPerClient int
+}
+
+// ParsePrefixes parses a list of CIDR prefixes or IP addresses, separated by
+// commas or whitespace.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		if addr, err := netip.ParseAddr(field); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientStats is the usage of one client.
+type ClientStats struct {
+	// Addr is the IP address of the client.
+	Addr string `json:"addr"`
+	// User is the username with which the client last authenticated.
+	User string `json:"user,omitempty"`
+	// Active is the number of open connections.
+	Active int `json:"active"`
+	// Connections is the number of connections accepted.
+	Connections int64 `json:"connections"`
+	// Refused is the number of connections refused because of the limit
+	// on simultaneous connections, or failed authentication.
+	Refused int64 `json:"refused"`
+	// BytesUp is the number of bytes received from the client, and
+	// BytesDown the number sent to it.
+	BytesUp   int64 `json:"bytes_up"`
+	BytesDown int64 `json:"bytes_down"`
+	// LastSeen is when the client last connected.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// client is the state of one client. Its stats, other than the byte counts,
+// are protected by the Controller's lock.
+type client struct {
+	stats     ClientStats
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+}
+
+// Controller enforces a Policy on connections and keeps usage accounts. Its
+// methods may be called concurrently.
+type Controller struct {
+	policy  Policy
+	lock    sync.Mutex
+	clients map[netip.Addr]*client
+}
+
+// NewController returns a Controller that enforces policy. The Controller
+// keeps its own copy of policy.
+func NewController(policy Policy) *Controller {
+	users := make(map[string]string, len(policy.Users))
+	for username, password := range policy.Users {
+		users[username] = password
+	}
+	policy.Users = users
+	policy.Allow = append([]netip.Prefix(nil), policy.Allow...)
+	return &Controller{
+		policy:  policy,
+		clients: make(map[netip.Addr]*client),
+	}
+}
+
+// clientAddr returns the IP address of addr, a *net.TCPAddr or *net.UDPAddr.
+func clientAddr(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return netip.Addr{}, false
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	return a.Unmap(), ok
+}
+
+// Allowed reports whether the policy accepts connections from addr.
+func (c *Controller) Allowed(addr net.Addr) bool {
+	ip, ok := clientAddr(addr)
+	if !ok {
+		return false
+	}
+	return c.allowed(ip)
+}
+
+func (c *Controller) allowed(ip netip.Addr) bool {
+	if len(c.policy.Allow) == 0 || ip.IsLoopback() {
+		return true
+	}
+	for _, prefix := range c.policy.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks whether a new connection from addr is allowed, and if so,
+// counts it as active.
+func (c *Controller) admit(addr net.Addr) (*client, error) {
+	ip, ok := clientAddr(addr)
+	if !ok || !c.allowed(ip) {
+		return nil, fmt.Errorf("connection from %v is not allowed", addr)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cl := c.clients[ip]
+	if cl == nil {
+		cl = &client{stats: ClientStats{Addr: ip.String()}}
+		c.clients[ip] = cl
+	}
+	cl.stats.LastSeen = time.Now()
+	if c.policy.MaxConnsPerClient > 0 && cl.stats.Active >= c.policy.MaxConnsPerClient {
+		cl.stats.Refused++
+		return nil, fmt.Errorf("connection from %v exceeds the limit of %d", addr, c.policy.MaxConnsPerClient)
+	}
+	cl.stats.Active++
+	cl.stats.Connections++
+	return cl, nil
+}
+
+// AuthRequired reports whether clients must authenticate.
+func (c *Controller) AuthRequired() bool {
+	return len(c.policy.Users) > 0
+}
+
+// Authenticate reports whether username and password are valid, and records
+// username as the user of the client of conn, which should be a connection
+// returned by a listener from Listener.
+func (c *Controller) Authenticate(conn net.Conn, username, password string) bool {
+	expected, ok := c.policy.Users[username]
+	// Compare even for an unknown user, to take the same time.
+	valid := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && ok
+	if conn, ok := conn.(*countingConn); ok {
+		c.lock.Lock()
+		if valid {
+			conn.client.stats.User = username
+		} else {
+			conn.client.stats.Refused++
+		}
+		c.lock.Unlock()
+	}
+	return valid
+}
+
+// Stats returns the usage of every client that has connected, sorted by
+// address.
+func (c *Controller) Stats() []ClientStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := make([]ClientStats, 0, len(c.clients))
+	for _, cl := range c.clients {
+		s := cl.stats
+		s.BytesUp = cl.bytesUp.Load()
+		s.BytesDown = cl.bytesDown.Load()
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, _ := netip.ParseAddr(stats[i].Addr)
+		b, _ := netip.ParseAddr(stats[j].Addr)
+		return a.Less(b)
+	})
+	return stats
+}
+
+// Listener returns a net.Listener that accepts from ln only the connections
+// that the policy admits, and counts their usage. Connections that are not
+// admitted are closed at once.
+func (c *Controller) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln, c: c}
+}
+
+type listener struct {
+	net.Listener
+	c *Controller
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cl, err := l.c.admit(conn.RemoteAddr())
+		if err != nil {
+			logging.Proxy.Warnf("shared proxy: %v", err)
+			conn.Close()
+			continue
+		}
+		return &countingConn{Conn: conn, c: l.c, client: cl}, nil
+	}
+}
+
+// countingConn counts the bytes read from and written to a client's
+// connection, and counts the connection as no longer active once closed.
+type countingConn struct {
+	net.Conn
+	c         *Controller
+	client    *client
+	closeOnce sync.Once
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.client.bytesUp.Add(int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	conn.client.bytesDown.Add(int64(n))
+	return n, err
+}
+
+// CloseRead closes the reading side of the connection, if the underlying
+// connection supports it, like *net.TCPConn.
+func (conn *countingConn) CloseRead() error {
+	if cr, ok := conn.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// CloseWrite closes the writing side of the connection, if the underlying
+// connection supports it, like *net.TCPConn.
+func (conn *countingConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+func (conn *countingConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.c.lock.Lock()
+		conn.client.stats.Active--
+		conn.c.lock.Unlock()
+	})
+	return conn.Conn.Close()
+}
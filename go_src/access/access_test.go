@@ -0,0 +1,158 @@
+package access
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes("192.168.1.0/24, 10.0.0.1\tfd00::/8,::ffff:192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.168.1.0/24", "10.0.0.1/32", "fd00::/8", "192.0.2.1/32"}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("got %v", prefixes)
+	}
+	for i, p := range prefixes {
+		if p.String() != expected[i] {
+			t.Errorf("%d: got %v, expected %v", i, p, expected[i])
+		}
+	}
+	if prefixes, err := ParsePrefixes(""); err != nil || len(prefixes) != 0 {
+		t.Errorf("empty: got %v %v", prefixes, err)
+	}
+	if _, err := ParsePrefixes("192.168.1.0/33"); err == nil {
+		t.Errorf("bad prefix accepted")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	c := NewController(Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}})
+	for _, test := range []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5000}, true},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.168.1.20"), Port: 5000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.2.20"), Port: 5000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 5000}, true},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	} {
+		if allowed := c.Allowed(test.addr); allowed != test.allowed {
+			t.Errorf("%v: got %v", test.addr, allowed)
+		}
+	}
+	if !NewController(Policy{}).Allowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Errorf("empty allowlist does not allow everything")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	c := NewController(Policy{Users: users})
+	// The Controller keeps its own copy.
+	users["mallory"] = "x"
+	if !c.AuthRequired() {
+		t.Errorf("AuthRequired() = false")
+	}
+	for _, test := range []struct {
+		username, password string
+		valid              bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"mallory", "x", false},
+		{"", "", false},
+	} {
+		if valid := c.Authenticate(nil, test.username, test.password); valid != test.valid {
+			t.Errorf("%s:%s: got %v", test.username, test.password, valid)
+		}
+	}
+	if NewController(Policy{}).AuthRequired() {
+		t.Errorf("AuthRequired() = true without users")
+	}
+}
+
+// TestListener checks the connection limit and accounting of a Listener.
+func TestListener(t *testing.T) {
+	c := NewController(Policy{
+		Users:             map[string]string{"alice": "secret"},
+		MaxConnsPerClient: 1,
+	})
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := c.Listener(tcpLn)
+	defer ln.Close()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Authenticate(conn, "alice", "secret") {
+		t.Fatal("authentication failed")
+	}
+	io.WriteString(first, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hi")
+
+	// A second connection exceeds the limit, and is closed.
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	if _, err := second.Read(buf); err == nil {
+		t.Errorf("connection over the limit was not closed")
+	}
+
+	stats := c.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+	s := stats[0]
+	if s.Addr != "127.0.0.1" || s.User != "alice" || s.Active != 1 || s.Connections != 1 || s.Refused != 1 || s.BytesUp != 5 || s.BytesDown != 2 {
+		t.Errorf("got %+v", s)
+	}
+
+	// Once the first connection is closed, another is accepted.
+	conn.Close()
+	conn.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection under the limit was not accepted")
+	}
+	if s := c.Stats()[0]; s.Active != 0 || s.Connections != 2 {
+		t.Errorf("got %+v", s)
+	}
+}
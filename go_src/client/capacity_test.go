@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+func TestDNSNameCapacity(t *testing.T) {
+	for domainLen := 0; domainLen < 255; domainLen++ {
+		domain, err := dns.NewName(chunks(bytes.Repeat([]byte{'x'}, domainLen), 63))
+		if err != nil {
+			continue
+		}
+		capacity := dnsNameCapacity(domain)
+		if capacity <= 0 {
+			continue
+		}
+		prefix := []byte(base32Encoding.EncodeToString(bytes.Repeat([]byte{'y'}, capacity)))
+		labels := append(chunks(prefix, 63), domain...)
+		_, err = dns.NewName(labels)
+		if err != nil {
+			t.Errorf("length %v  capacity %v  %v", domainLen, capacity, err)
+		}
+	}
+}
+
+func TestShapedNameCapacity(t *testing.T) {
+	for domainLen := 0; domainLen < 255; domainLen++ {
+		domain, err := dns.NewName(chunks(bytes.Repeat([]byte{'x'}, domainLen), 63))
+		if err != nil {
+			continue
+		}
+		for minLabelLen := 1; minLabelLen <= 63; minLabelLen++ {
+			capacity := shapedNameCapacity(domain, minLabelLen)
+			if capacity <= 0 {
+				continue
+			}
+			if capacity > dnsNameCapacity(domain) {
+				t.Errorf("length %v  min label %v  capacity %v greater than %v",
+					domainLen, minLabelLen, capacity, dnsNameCapacity(domain))
+			}
+			// The worst case is the most labels.
+			prefix := []byte(base32Encoding.EncodeToString(bytes.Repeat([]byte{'y'}, capacity)))
+			labels := append(chunks(prefix, minLabelLen), domain...)
+			_, err = dns.NewName(labels)
+			if err != nil {
+				t.Errorf("length %v  min label %v  capacity %v  %v",
+					domainLen, minLabelLen, capacity, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Package client implements the client end of a DNS tunnel, for use by
+// dnstt-client and by the mobile and desktop bindings.
+//
+// A SessionManager maintains a session with one of a list of tunnel servers
+// (Endpoints), over one of a list of DNS transports (Transports). Each session
+// is a stack of layers: a DNSPacketConn, which encodes packets into DNS
+// queries and sends them over the transport; a KCP conn; a Noise channel,
+// optionally compressed; a priority scheduler; and an smux session, whose
+// streams are returned by OpenStream.
+//
+// The UDPTransport, DoTTransport, DoHTransport, and DoQTransport functions
+// make transports for plain UDP DNS, DNS over TLS, DNS over HTTPS, and DNS
+// over QUIC. Through TransportOptions, every socket they open can be passed to
+// a callback, which is how a VPN app on Android keeps the tunnel's own traffic
+// out of the VPN.
+package client
+
+import (
+	"fmt"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// smux streams will be closed after this much time without receiving data.
+const idleTimeout = 2 * time.Minute
+
+// DefaultUTLSDistribution is the default weighted distribution of TLS
+// fingerprints, in the form accepted by SampleUTLSDistribution.
+const DefaultUTLSDistribution = "4*random,3*Firefox_120,1*Firefox_105,3*Chrome_120,1*Chrome_102,1*iOS_14,1*iOS_13"
+
+// dnsNameCapacity returns the number of bytes remaining for encoded data after
+// including domain in a DNS name.
+func dnsNameCapacity(domain dns.Name) int {
+	// Names must be 255 octets or shorter in total length.
+	// https://tools.ietf.org/html/rfc1035#section-2.3.4
+	capacity := 255
+	// Subtract the length of the null terminator.
+	capacity -= 1
+	for _, label := range domain {
+		// Subtract the length of the label and the length octet.
+		capacity -= len(label) + 1
+	}
+	// Each label may be up to 63 bytes long and requires 64 bytes to
+	// encode.
+	capacity = capacity * 63 / 64
+	// Base32 expands every 5 bytes to 8.
+	capacity = capacity * 5 / 8
+	return capacity
+}
+
+// shapedNameCapacity is like dnsNameCapacity, but allows for the encoded data
+// being broken into labels of any length between minLabelLen and 63, with a
+// final label that may be shorter.
+func shapedNameCapacity(domain dns.Name, minLabelLen int) int {
+	capacity := 255
+	// Subtract the length of the null terminator.
+	capacity -= 1
+	for _, label := range domain {
+		// Subtract the length of the label and the length octet.
+		capacity -= len(label) + 1
+	}
+	// Subtract the length octet of a short final label.
+	capacity -= 1
+	// In the worst case, each label is minLabelLen bytes long and requires
+	// minLabelLen+1 bytes to encode.
+	capacity = capacity * minLabelLen / (minLabelLen + 1)
+	// Base32 expands every 5 bytes to 8.
+	capacity = capacity * 5 / 8
+	return capacity
+}
+
+// SampleUTLSDistribution parses a weighted uTLS Client Hello ID distribution
+// string of the form "3*Firefox,2*Chrome,1*iOS", matches each label to a
+// utls.ClientHelloID from utlsClientHelloIDMap, and randomly samples one
+// utls.ClientHelloID from the distribution. The label "none" stands for no
+// uTLS, and is sampled as nil.
+func SampleUTLSDistribution(spec string) (*utls.ClientHelloID, error) {
+	weights, labels, err := parseWeightedList(spec)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]*utls.ClientHelloID, 0, len(labels))
+	for _, label := range labels {
+		var id *utls.ClientHelloID
+		if label == "none" {
+			id = nil
+		} else {
+			id = utlsLookup(label)
+			if id == nil {
+				return nil, fmt.Errorf("unknown TLS fingerprint %q", label)
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids[sampleWeighted(weights)], nil
+}
+
+// UTLSLabels returns the labels that SampleUTLSDistribution knows, beginning
+// with "none".
+func UTLSLabels() []string {
+	labels := make([]string, 0, len(utlsClientHelloIDMap)+1)
+	labels = append(labels, "none")
+	for _, entry := range utlsClientHelloIDMap {
+		labels = append(labels, entry.Label)
+	}
+	return labels
+}
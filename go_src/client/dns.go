@@ -0,0 +1,838 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// How many bytes of random padding to insert into queries.
+	numPadding = 3
+	// In an otherwise empty polling query, insert even more random padding,
+	// to reduce the chance of a cache hit. Cannot be greater than 31,
+	// because the prefix codes indicating padding start at 224.
+	numPaddingForPoll = 8
+
+	// sendLoop has a poll timer that automatically sends an empty polling
+	// query when a certain amount of time has elapsed without a send. The
+	// poll timer is initially set to initPollDelay. It increases by a
+	// factor of pollDelayMultiplier every time the poll timer expires, up
+	// to a maximum of maxPollDelay. The poll timer is reset to
+	// initPollDelay whenever an a send occurs that is not the result of the
+	// poll timer expiring.
+	initPollDelay       = 500 * time.Millisecond
+	maxPollDelay        = 10 * time.Second
+	pollDelayMultiplier = 2.0
+
+	// A limit on the number of empty poll requests we may send in a burst
+	// as a result of receiving data.
+	pollLimit = 16
+
+	// With randomized query shapes, the encoded data is broken into labels
+	// whose lengths are chosen uniformly between minShapedLabelLen and 63.
+	minShapedLabelLen = 20
+	// With randomized query shapes, when EDNS(0) padding is used, queries
+	// are padded to a multiple of this many bytes, following the
+	// recommendation of RFC 8467 section 4.1.
+	ednsPaddingBlockSize = 128
+)
+
+const (
+	// https://tools.ietf.org/html/rfc1035#section-3.2.2
+	rrTypeA = 1
+	// https://tools.ietf.org/html/rfc3596#section-2.1
+	rrTypeAAAA = 28
+
+	// https://tools.ietf.org/html/rfc7873#section-4
+	ednsOptionCookie = 10
+	// https://tools.ietf.org/html/rfc7830#section-3
+	ednsOptionPadding = 12
+)
+
+// ednsPayloadSizes are the requester's UDP payload sizes that are advertised
+// with randomized query shapes. They are values in common use by DNS software.
+// None may be less than the server's maximum UDP payload size (its -mtu
+// option), or the server will reject the query.
+var ednsPayloadSizes = []uint16{1232, 1400, 1452, 4096}
+
+// decoyTypes are the QTYPEs of decoy queries.
+var decoyTypes = []uint16{rrTypeA, rrTypeAAAA}
+
+// base32Encoding is a base32 encoding without padding.
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// QueryOptions are optional settings of a DNSPacketConn that affect the timing
+// and shape of queries.
+type QueryOptions struct {
+	// CoverInterval, if not zero, enables cover traffic mode. In cover
+	// traffic mode, queries are sent at a rate of one per CoverInterval,
+	// whether or not there is data to send, and every query is padded to
+	// the full capacity of its name.
+	CoverInterval time.Duration
+	// CoverRandom, in cover traffic mode, makes the time between queries
+	// vary uniformly between 0.5 and 1.5 times CoverInterval, rather than
+	// being fixed.
+	CoverRandom bool
+	// RandomShape randomizes the shape of every query: the lengths of
+	// labels, the letter case of the name, the EDNS(0) UDP payload size
+	// and options, and the AD bit. Without it, every query has the same
+	// structure, apart from its length.
+	RandomShape bool
+	// DecoyRate is the probability that a query is followed by a decoy
+	// query of a type other than TXT, under the same domain. In cover
+	// traffic mode, it is instead the probability that a decoy takes the
+	// place of a time slot's polling query, so that the rate of queries
+	// does not change. The server does not answer decoy queries except with
+	// a name error; they only vary the mix of QTYPEs seen by an observer.
+	DecoyRate float64
+}
+
+// Stats are counters of the traffic of one or more DNSPacketConns.
+type Stats struct {
+	// QueriesSent and ResponsesReceived count DNS messages, including
+	// polls and decoys.
+	QueriesSent       uint64
+	ResponsesReceived uint64
+	// BytesSent and BytesReceived count the bytes of the packets carried
+	// by the queries and responses, not counting DNS overhead.
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// counters accumulates Stats. Its fields may be updated concurrently.
+type counters struct {
+	queriesSent       atomic.Uint64
+	responsesReceived atomic.Uint64
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+	// maxResponseSize is the size of the largest response received, and
+	// truncated the number of responses with the TC bit set, which a
+	// resolver sends when the real response does not fit.
+	maxResponseSize atomic.Uint64
+	truncated       atomic.Uint64
+	// maxPacketSize is the size of the largest packet received.
+	maxPacketSize atomic.Uint64
+}
+
+// addResponse counts a response of n bytes, which was truncated if tc is
+// true.
+func (c *counters) addResponse(n int, tc bool) {
+	c.responsesReceived.Add(1)
+	if tc {
+		c.truncated.Add(1)
+	}
+	storeMax(&c.maxResponseSize, n)
+}
+
+// addPacket counts a received packet of n bytes.
+func (c *counters) addPacket(n int) {
+	c.bytesReceived.Add(uint64(n))
+	storeMax(&c.maxPacketSize, n)
+}
+
+// storeMax stores n in v, if it is greater than the value there.
+func storeMax(v *atomic.Uint64, n int) {
+	for {
+		max := v.Load()
+		if uint64(n) <= max || v.CompareAndSwap(max, uint64(n)) {
+			break
+		}
+	}
+}
+
+// stats returns the current values of the counters.
+func (c *counters) stats() Stats {
+	return Stats{
+		QueriesSent:       c.queriesSent.Load(),
+		ResponsesReceived: c.responsesReceived.Load(),
+		BytesSent:         c.bytesSent.Load(),
+		BytesReceived:     c.bytesReceived.Load(),
+	}
+}
+
+// nameCapacity returns the number of bytes that may be encoded in a name under
+// domain, taking into account the label lengths that opts may produce.
+func (opts *QueryOptions) nameCapacity(domain dns.Name) int {
+	if opts.RandomShape {
+		return shapedNameCapacity(domain, minShapedLabelLen)
+	}
+	return dnsNameCapacity(domain)
+}
+
+// DNSPacketConn provides a packet-sending and -receiving interface over various
+// forms of DNS. It handles the details of how packets and padding are encoded
+// as a DNS name in the Question section of an upstream query, and as a TXT RR
+// in downstream responses.
+//
+// DNSPacketConn does not handle the mechanics of actually sending and receiving
+// encoded DNS messages. That is rather the responsibility of some other
+// net.PacketConn such as net.UDPConn, HTTPPacketConn, or TLSPacketConn, one of
+// which must be provided to NewDNSPacketConn. The transport may be replaced
+// at any time with SetTransport, for instance to move from UDP to DoH when UDP
+// is blocked, or to a new socket after a change of network. The ClientID and
+// the address under which packets are queued stay the same, so a KCP
+// conversation on top of the DNSPacketConn continues undisturbed.
+//
+// We don't have a need to match up a query and a response by ID. Queries and
+// responses are vehicles for carrying data and for our purposes don't need to
+// be correlated. When sending a query, we generate a random ID, and when
+// receiving a response, we ignore the ID.
+type DNSPacketConn struct {
+	clientID turbotunnel.ClientID
+	// domains are the tunnel domains. Each query is sent under one of them,
+	// chosen at random, in order to spread queries across domains.
+	domains []dns.Name
+	// rng chooses among domains and makes other random choices for
+	// queries. It is used only by sendLoop.
+	rng *mathrand.Rand
+	// opts controls the timing and shape of queries.
+	opts QueryOptions
+	// addr is the address passed to NewDNSPacketConn. It keys the outgoing
+	// queue, and is the source address of every incoming packet, no matter
+	// which transport the packet arrived on. It does not change when the
+	// transport does, because a KCP conn ignores packets from any address
+	// other than its remote address.
+	addr net.Addr
+	// transport carries DNS messages, which are sent to transportAddr.
+	// transportLock controls access to both. transport is closed when it is
+	// replaced, and along with the DNSPacketConn.
+	transport     net.PacketConn
+	transportAddr net.Addr
+	transportLock sync.Mutex
+	// sent and received count the queries sent and the responses received
+	// since the transport was last set. They are reset by SetTransport.
+	sent, received atomic.Uint64
+	// counters accumulate Stats over the life of the DNSPacketConn, and
+	// may be shared with other DNSPacketConns.
+	counters *counters
+	// closed is closed by Close, to stop sendLoop.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Sending on pollChan permits sendLoop to send an empty polling query.
+	// sendLoop also does its own polling according to a time schedule.
+	pollChan chan struct{}
+	// QueuePacketConn is the direct receiver of ReadFrom and WriteTo calls.
+	// recvLoop and sendLoop take the messages out of the receive and send
+	// queues and actually put them on the network.
+	*turbotunnel.QueuePacketConn
+}
+
+// NewDNSPacketConn creates a new DNSPacketConn. transport, through its WriteTo
+// and ReadFrom methods, handles the actual sending and receiving the DNS
+// messages encoded by DNSPacketConn. addr is the address to be passed to
+// transport.WriteTo whenever a message needs to be sent. domains are the
+// tunnel domains, all of which must be delegated to the same server. opts
+// controls the timing and shape of queries. Closing the DNSPacketConn also
+// closes transport.
+func NewDNSPacketConn(transport net.PacketConn, addr net.Addr, domains []dns.Name, opts QueryOptions) *DNSPacketConn {
+	return newDNSPacketConn(transport, addr, domains, opts, new(counters))
+}
+
+// newDNSPacketConn is like NewDNSPacketConn, but adds to counters.
+func newDNSPacketConn(transport net.PacketConn, addr net.Addr, domains []dns.Name, opts QueryOptions, counters *counters) *DNSPacketConn {
+	// Generate a new random ClientID.
+	clientID := turbotunnel.NewClientID()
+	c := &DNSPacketConn{
+		clientID:        clientID,
+		domains:         domains,
+		rng:             mathrand.New(&cryptoSource{}),
+		opts:            opts,
+		counters:        counters,
+		addr:            addr,
+		transport:       transport,
+		transportAddr:   addr,
+		closed:          make(chan struct{}),
+		pollChan:        make(chan struct{}, pollLimit),
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(clientID, 0),
+	}
+	go c.runRecvLoop(transport)
+	go func() {
+		var err error
+		if opts.CoverInterval != 0 {
+			err = c.coverSendLoop()
+		} else {
+			err = c.sendLoop()
+		}
+		if err != nil {
+			logging.Transport.Warnf("sendLoop: %v", err)
+		}
+	}()
+	return c
+}
+
+// SetTransport replaces the transport beneath c with transport, to whose
+// WriteTo method addr will be passed from now on. The old transport is closed.
+// Responses still in flight on the old transport are lost; the KCP layer
+// recovers them by retransmission. If c is already closed, SetTransport closes
+// transport and returns net.ErrClosed.
+func (c *DNSPacketConn) SetTransport(transport net.PacketConn, addr net.Addr) error {
+	c.transportLock.Lock()
+	select {
+	case <-c.closed:
+		c.transportLock.Unlock()
+		transport.Close()
+		return net.ErrClosed
+	default:
+	}
+	old := c.transport
+	c.transport = transport
+	c.transportAddr = addr
+	c.sent.Store(0)
+	c.received.Store(0)
+	c.transportLock.Unlock()
+
+	old.Close()
+	go c.runRecvLoop(transport)
+	// Poll right away, so that the server has a way to send whatever it
+	// was holding for us.
+	select {
+	case c.pollChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Counts returns the number of queries sent and the number of responses
+// received since the transport was last set.
+func (c *DNSPacketConn) Counts() (sent, received uint64) {
+	return c.sent.Load(), c.received.Load()
+}
+
+// currentTransport returns the transport and the address to send to.
+func (c *DNSPacketConn) currentTransport() (net.PacketConn, net.Addr) {
+	c.transportLock.Lock()
+	defer c.transportLock.Unlock()
+	return c.transport, c.transportAddr
+}
+
+// Close closes the DNSPacketConn and its transport.
+func (c *DNSPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.transportLock.Lock()
+		close(c.closed)
+		c.transport.Close()
+		c.transportLock.Unlock()
+	})
+	return c.QueuePacketConn.Close()
+}
+
+// dnsResponsePayload extracts the downstream payload of a DNS response, encoded
+// into the RDATA of a TXT RR. It returns nil if the message doesn't pass format
+// checks, or if the name in its Answer entry is not a subdomain of one of
+// domains.
+func dnsResponsePayload(resp *dns.Message, domains []dns.Name) []byte {
+	if resp.Flags&0x8000 != 0x8000 {
+		// QR != 1, this is not a response.
+		return nil
+	}
+	if resp.Flags&0x000f != dns.RcodeNoError {
+		return nil
+	}
+
+	if len(resp.Answer) != 1 {
+		return nil
+	}
+	answer := resp.Answer[0]
+
+	ok := false
+	for _, domain := range domains {
+		if _, ok = answer.Name.TrimSuffix(domain); ok {
+			break
+		}
+	}
+	if !ok {
+		// Not the name we are expecting.
+		return nil
+	}
+
+	if answer.Type != dns.RRTypeTXT {
+		// We only support TYPE == TXT.
+		return nil
+	}
+	payload, err := dns.DecodeRDataTXT(answer.Data)
+	if err != nil {
+		return nil
+	}
+
+	return payload
+}
+
+// nextPacket reads the next length-prefixed packet from r. It returns a nil
+// error only when a complete packet was read. It returns io.EOF only when there
+// were 0 bytes remaining to read from r. It returns io.ErrUnexpectedEOF when
+// EOF occurs in the middle of an encoded packet.
+func nextPacket(r *bytes.Reader) ([]byte, error) {
+	for {
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			// We may return a real io.EOF only here.
+			return nil, err
+		}
+		p := make([]byte, n)
+		_, err = io.ReadFull(r, p)
+		// Here we must change io.EOF to io.ErrUnexpectedEOF.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return p, err
+	}
+}
+
+// runRecvLoop runs recvLoop on transport, and logs its error, unless transport
+// has been replaced or closed in the meantime, in which case the error is
+// expected.
+func (c *DNSPacketConn) runRecvLoop(transport net.PacketConn) {
+	err := c.recvLoop(transport)
+	if err == nil {
+		return
+	}
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	if current, _ := c.currentTransport(); current == transport {
+		logging.Transport.Warnf("recvLoop: %v", err)
+	}
+}
+
+// recvLoop repeatedly calls transport.ReadFrom to receive a DNS message,
+// extracts its payload and breaks it into packets, and stores the packets in a
+// queue to be returned from a future call to c.ReadFrom.
+//
+// Whenever we receive a DNS response containing at least one data packet, we
+// send on c.pollChan to permit sendLoop to send an immediate polling queries.
+// KCP itself will also send an ACK packet for incoming data, which is
+// effectively a second poll. Therefore, each time we receive data, we send up
+// to 2 polling queries (or 1 + f polling queries, if KCP only ACKs an f
+// fraction of incoming data). We say "up to" because sendLoop will discard an
+// empty polling query if it has an organic non-empty packet to send (this goes
+// also for KCP's organic ACK packets).
+//
+// The intuition behind polling immediately after receiving is that if server
+// has just had something to send, it may have more to send, and in order for
+// the server to send anything, we must give it a query to respond to. The
+// intuition behind polling *2 times* (or 1 + f times) is similar to TCP slow
+// start: we want to maintain some number of queries "in flight", and the faster
+// the server is sending, the higher that number should be. If we polled only
+// once for each received packet, we would tend to have only one query in flight
+// at a time, ping-pong style. The first polling query replaces the in-flight
+// query that has just finished its duty in returning data to us; the second
+// grows the effective in-flight window proportional to the rate at which
+// data-carrying responses are being received. Compare to Eq. (2) of
+// https://tools.ietf.org/html/rfc5681#section-3.1. The differences are that we
+// count messages, not bytes, and we don't maintain an explicit window. If a
+// response comes back without data, or if a query or response is dropped by the
+// network, then we don't poll again, which decreases the effective in-flight
+// window.
+func (c *DNSPacketConn) recvLoop(transport net.PacketConn) error {
+	for {
+		var buf [4096]byte
+		n, _, err := transport.ReadFrom(buf[:])
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				logging.Transport.Warnf("ReadFrom temporary error: %v", err)
+				continue
+			}
+			return err
+		}
+
+		// Got a response. Try to parse it as a DNS message.
+		resp, err := dns.MessageFromWireFormat(buf[:n])
+		if err != nil {
+			logging.Transport.Warnf("MessageFromWireFormat: %v", err)
+			continue
+		}
+		c.received.Add(1)
+		c.counters.addResponse(n, resp.Flags&0x0200 != 0)
+
+		payload := dnsResponsePayload(&resp, c.domains)
+
+		// Pull out the packets contained in the payload.
+		r := bytes.NewReader(payload)
+		any := false
+		for {
+			p, err := nextPacket(r)
+			if err != nil {
+				break
+			}
+			any = true
+			c.counters.addPacket(len(p))
+			c.QueuePacketConn.QueueIncoming(p, c.addr)
+		}
+
+		// If the payload contained one or more packets, permit sendLoop
+		// to poll immediately. ACKs on received data will effectively
+		// serve as another stream of polls whose rate is proportional
+		// to the rate of incoming packets.
+		if any {
+			select {
+			case c.pollChan <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// chunks breaks p into non-empty subslices of at most n bytes, greedily so that
+// only final subslice has length < n.
+func chunks(p []byte, n int) [][]byte {
+	var result [][]byte
+	for len(p) > 0 {
+		sz := len(p)
+		if sz > n {
+			sz = n
+		}
+		result = append(result, p[:sz])
+		p = p[sz:]
+	}
+	return result
+}
+
+// send sends p as a single packet encoded into a DNS query, using
+// transport.WriteTo(query, addr). The length of p must be less than 224 bytes.
+//
+// Here is an example of how a packet is encoded into a DNS name, using
+//
+//	p = "supercalifragilisticexpialidocious"
+//	c.clientID = "CLIENTID"
+//	domain = "t.example.com"
+//
+// as the input.
+//
+//  0. Start with the raw packet contents.
+//
+//	supercalifragilisticexpialidocious
+//
+//  1. Length-prefix the packet and add random padding. A length prefix L < 0xe0
+//     means a data packet of L bytes. A length prefix L ≥ 0xe0 means padding
+//     of L − 0xe0 bytes (not counting the length of the length prefix itself).
+//
+//	\xe3\xd9\xa3\x15\x22supercalifragilisticexpialidocious
+//
+//  2. Prefix the ClientID.
+//
+//	CLIENTID\xe3\xd9\xa3\x15\x22supercalifragilisticexpialidocious
+//
+//  3. Base32-encode, without padding and in lower case.
+//
+//	ingesrkokreujy6zumkse43vobsxey3bnruwm4tbm5uwy2ltoruwgzlyobuwc3djmrxwg2lpovzq
+//
+//  4. Break into labels of at most 63 octets.
+//
+//	ingesrkokreujy6zumkse43vobsxey3bnruwm4tbm5uwy2ltoruwgzlyobuwc3d.jmrxwg2lpovzq
+//
+//  5. Append the domain, chosen at random if there is more than one.
+//
+//	ingesrkokreujy6zumkse43vobsxey3bnruwm4tbm5uwy2ltoruwgzlyobuwc3d.jmrxwg2lpovzq.t.example.com
+//
+// In cover traffic mode, between steps 2 and 3, as many more padding blocks
+// (of up to 31 bytes each) are appended as are needed to fill the capacity of
+// the name, so that every query has the same length.
+func (c *DNSPacketConn) send(transport net.PacketConn, p []byte, addr net.Addr) error {
+	domain := c.domains[c.rng.Intn(len(c.domains))]
+	var decoded []byte
+	{
+		if len(p) >= 224 {
+			return fmt.Errorf("too long")
+		}
+		var buf bytes.Buffer
+		// ClientID
+		buf.Write(c.clientID[:])
+		n := numPadding
+		if len(p) == 0 {
+			n = numPaddingForPoll
+		}
+		// Padding / cache inhibition
+		buf.WriteByte(byte(224 + n))
+		io.CopyN(&buf, rand.Reader, int64(n))
+		// Packet contents
+		if len(p) > 0 {
+			buf.WriteByte(byte(len(p)))
+			buf.Write(p)
+		}
+		// Fill the name with padding in cover traffic mode.
+		if c.opts.CoverInterval != 0 {
+			capacity := c.opts.nameCapacity(domain)
+			for buf.Len() < capacity {
+				n := capacity - buf.Len() - 1
+				if n > 31 {
+					n = 31
+				}
+				buf.WriteByte(byte(224 + n))
+				io.CopyN(&buf, rand.Reader, int64(n))
+			}
+		}
+		decoded = buf.Bytes()
+	}
+
+	name, err := c.encodeName(decoded, domain)
+	if err != nil {
+		return err
+	}
+	err = c.sendQuery(transport, name, dns.RRTypeTXT, addr)
+	if err != nil {
+		return err
+	}
+	c.counters.bytesSent.Add(uint64(len(p)))
+
+	// Outside cover traffic mode, sometimes follow with a decoy query.
+	if c.opts.CoverInterval == 0 && c.decoyChance() {
+		return c.sendDecoy(transport, domain, len(decoded), addr)
+	}
+	return nil
+}
+
+// decoyChance returns true with probability c.opts.DecoyRate.
+func (c *DNSPacketConn) decoyChance() bool {
+	return c.opts.DecoyRate > 0 && c.rng.Float64() < c.opts.DecoyRate
+}
+
+// sendDecoy sends a decoy query under domain, whose name is n random bytes, so
+// that it is as long as a real query that encodes n bytes.
+func (c *DNSPacketConn) sendDecoy(transport net.PacketConn, domain dns.Name, n int, addr net.Addr) error {
+	decoy := make([]byte, n)
+	rand.Read(decoy)
+	name, err := c.encodeName(decoy, domain)
+	if err != nil {
+		return err
+	}
+	return c.sendQuery(transport, name, decoyTypes[c.rng.Intn(len(decoyTypes))], addr)
+}
+
+// encodeName base32-encodes decoded and breaks it into labels under domain.
+// With randomized query shapes, the labels have random lengths, and the letters
+// of the name (including domain) have random case.
+func (c *DNSPacketConn) encodeName(decoded []byte, domain dns.Name) (dns.Name, error) {
+	encoded := make([]byte, base32Encoding.EncodedLen(len(decoded)))
+	base32Encoding.Encode(encoded, decoded)
+	encoded = bytes.ToLower(encoded)
+	if !c.opts.RandomShape {
+		labels := chunks(encoded, 63)
+		labels = append(labels, domain...)
+		return dns.NewName(labels)
+	}
+
+	var labels [][]byte
+	for len(encoded) > 0 {
+		sz := minShapedLabelLen + c.rng.Intn(63-minShapedLabelLen+1)
+		if sz > len(encoded) {
+			sz = len(encoded)
+		}
+		labels = append(labels, encoded[:sz])
+		encoded = encoded[sz:]
+	}
+	for _, label := range domain {
+		// Copy, so as not to modify domain.
+		labels = append(labels, append([]byte{}, label...))
+	}
+	for _, label := range labels {
+		for i, b := range label {
+			if 'a' <= b && b <= 'z' && c.rng.Intn(2) == 0 {
+				label[i] = b - 'a' + 'A'
+			}
+		}
+	}
+	return dns.NewName(labels)
+}
+
+// sendQuery sends a query for name with the given QTYPE, using
+// transport.WriteTo(query, addr). With randomized query shapes, the EDNS(0)
+// UDP payload size, EDNS(0) options, and AD bit are chosen at random.
+func (c *DNSPacketConn) sendQuery(transport net.PacketConn, name dns.Name, qtype uint16, addr net.Addr) error {
+	var id uint16
+	binary.Read(rand.Reader, binary.BigEndian, &id)
+	query := &dns.Message{
+		ID:    id,
+		Flags: 0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{
+			{
+				Name:  name,
+				Type:  qtype,
+				Class: dns.ClassIN,
+			},
+		},
+		// EDNS(0)
+		Additional: []dns.RR{
+			{
+				Name:  dns.Name{},
+				Type:  dns.RRTypeOPT,
+				Class: 4096, // requester's UDP payload size
+				TTL:   0,    // extended RCODE and flags
+				Data:  []byte{},
+			},
+		},
+	}
+	if c.opts.RandomShape {
+		opt := &query.Additional[0]
+		opt.Class = ednsPayloadSizes[c.rng.Intn(len(ednsPayloadSizes))]
+		if c.rng.Intn(2) == 0 {
+			query.Flags |= 0x0020 // AD = 1
+		}
+		if c.rng.Intn(2) == 0 {
+			// A client cookie with no server cookie.
+			cookie := make([]byte, 8)
+			rand.Read(cookie)
+			opt.Data = appendEDNSOption(opt.Data, ednsOptionCookie, cookie)
+		}
+		if c.rng.Intn(2) == 0 {
+			// Padding goes last, so that it can account for the
+			// length of everything else.
+			buf, err := query.WireFormat()
+			if err != nil {
+				return err
+			}
+			n := len(buf) + 4 // length of the message with an empty padding option
+			n = (ednsPaddingBlockSize - n%ednsPaddingBlockSize) % ednsPaddingBlockSize
+			opt.Data = appendEDNSOption(opt.Data, ednsOptionPadding, make([]byte, n))
+		}
+	}
+	buf, err := query.WireFormat()
+	if err != nil {
+		return err
+	}
+
+	_, err = transport.WriteTo(buf, addr)
+	if err != nil {
+		return err
+	}
+	c.sent.Add(1)
+	c.counters.queriesSent.Add(1)
+	return nil
+}
+
+// appendEDNSOption appends an EDNS(0) option with the given code and data to
+// the RDATA of an OPT RR.
+// https://tools.ietf.org/html/rfc6891#section-6.1.2
+func appendEDNSOption(rdata []byte, code uint16, data []byte) []byte {
+	rdata = binary.BigEndian.AppendUint16(rdata, code)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(data)))
+	return append(rdata, data...)
+}
+
+// coverDelay returns the time to wait before the next query in cover traffic
+// mode.
+func (c *DNSPacketConn) coverDelay() time.Duration {
+	d := c.opts.CoverInterval
+	if c.opts.CoverRandom {
+		d = d/2 + time.Duration(c.rng.Int63n(int64(d)+1))
+	}
+	return d
+}
+
+// coverSendLoop is the counterpart of sendLoop in cover traffic mode. It sends
+// exactly one query in each time slot: a data packet if one is waiting, or
+// otherwise an empty polling query, or sometimes a decoy in its place. It does
+// not poll in response to received data, and it does not send faster when
+// there is a backlog, so the rate of queries does not depend on the traffic in
+// the tunnel.
+func (c *DNSPacketConn) coverSendLoop() error {
+	timer := time.NewTimer(c.coverDelay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return nil
+		}
+		timer.Reset(c.coverDelay())
+
+		var p []byte
+		select {
+		case p = <-c.QueuePacketConn.OutgoingQueue(c.addr):
+		default:
+		}
+		transport, addr := c.currentTransport()
+		var err error
+		if len(p) == 0 && c.decoyChance() {
+			// A decoy is as long as any other query in cover
+			// traffic mode, one that fills its name.
+			domain := c.domains[c.rng.Intn(len(c.domains))]
+			err = c.sendDecoy(transport, domain, c.opts.nameCapacity(domain), addr)
+		} else {
+			err = c.send(transport, p, addr)
+		}
+		if err != nil {
+			logging.Transport.Warnf("send: %v", err)
+			continue
+		}
+	}
+}
+
+// sendLoop takes packets that have been written using c.WriteTo, and sends them
+// on the network using send. It also does polling with empty packets when
+// requested by pollChan or after a timeout.
+func (c *DNSPacketConn) sendLoop() error {
+	pollDelay := initPollDelay
+	pollTimer := time.NewTimer(pollDelay)
+	for {
+		var p []byte
+		outgoing := c.QueuePacketConn.OutgoingQueue(c.addr)
+		pollTimerExpired := false
+		// Prioritize sending an actual data packet from outgoing. Only
+		// consider a poll when outgoing is empty.
+		select {
+		case p = <-outgoing:
+		default:
+			select {
+			case p = <-outgoing:
+			case <-c.pollChan:
+			case <-pollTimer.C:
+				pollTimerExpired = true
+			case <-c.closed:
+				return nil
+			}
+		}
+
+		if len(p) > 0 {
+			// A data-carrying packet displaces one pending poll
+			// opportunity, if any.
+			select {
+			case <-c.pollChan:
+			default:
+			}
+		}
+
+		if pollTimerExpired {
+			// We're polling because it's been a while since we last
+			// polled. Increase the poll delay.
+			pollDelay = time.Duration(float64(pollDelay) * pollDelayMultiplier)
+			if pollDelay > maxPollDelay {
+				pollDelay = maxPollDelay
+			}
+		} else {
+			// We're sending an actual data packet, or we're polling
+			// in response to a received packet. Reset the poll
+			// delay to initial.
+			if !pollTimer.Stop() {
+				<-pollTimer.C
+			}
+			pollDelay = initPollDelay
+		}
+		pollTimer.Reset(pollDelay)
+
+		// Unlike in the server, in the client we assume that because
+		// the data capacity of queries is so limited, it's not worth
+		// trying to send more than one packet per query.
+		transport, addr := c.currentTransport()
+		err := c.send(transport, p, addr)
+		if err != nil {
+			logging.Transport.Warnf("send: %v", err)
+			continue
+		}
+	}
+}
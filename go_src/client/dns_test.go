@@ -0,0 +1,340 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+func allPackets(buf []byte) ([][]byte, error) {
+	var packets [][]byte
+	r := bytes.NewReader(buf)
+	for {
+		p, err := nextPacket(r)
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, p)
+	}
+}
+
+func packetsEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNextPacket(t *testing.T) {
+	for _, test := range []struct {
+		input   string
+		packets [][]byte
+		err     error
+	}{
+		{"", [][]byte{}, io.EOF},
+		{"\x00", [][]byte{}, io.ErrUnexpectedEOF},
+		{"\x00\x00", [][]byte{{}}, io.EOF},
+		{"\x00\x00\x00", [][]byte{{}}, io.ErrUnexpectedEOF},
+		{"\x00\x01", [][]byte{}, io.ErrUnexpectedEOF},
+		{"\x00\x05hello\x00\x05world", [][]byte{[]byte("hello"), []byte("world")}, io.EOF},
+	} {
+		packets, err := allPackets([]byte(test.input))
+		if !packetsEqual(packets, test.packets) || err != test.err {
+			t.Errorf("%x\nreturned %x %v\nexpected %x %v",
+				test.input, packets, err, test.packets, test.err)
+		}
+	}
+}
+
+// recordingPacketConn is a net.PacketConn that records what is written to it.
+type recordingPacketConn struct {
+	net.PacketConn
+	written [][]byte
+}
+
+func (c *recordingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func TestCoverPadding(t *testing.T) {
+	domains, err := dns.ParseNames("t.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtu := EndpointMTU(domains, QueryOptions{})
+	transport := &recordingPacketConn{}
+	c := &DNSPacketConn{
+		domains:  domains,
+		rng:      mathrand.New(&cryptoSource{}),
+		opts:     QueryOptions{CoverInterval: time.Second},
+		counters: new(counters),
+	}
+	for _, n := range []int{0, 1, 100, mtu} {
+		err := c.send(transport, make([]byte, n), nil)
+		if err != nil {
+			t.Fatalf("sending %d bytes: %v", n, err)
+		}
+	}
+
+	// Every query name must have the same length.
+	var nameLen int
+	for i, buf := range transport.written {
+		msg, err := dns.MessageFromWireFormat(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := len(msg.Question[0].Name.String())
+		if i == 0 {
+			nameLen = l
+		} else if l != nameLen {
+			t.Errorf("query %d has name length %d, expected %d", i, l, nameLen)
+		}
+	}
+}
+
+// In cover traffic mode, decoys take the place of polling queries, so that
+// there is still exactly one query, of the same length, in each time slot.
+func TestCoverDecoys(t *testing.T) {
+	domains, err := dns.ParseNames("t.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	transport, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const interval = 50 * time.Millisecond
+	c := NewDNSPacketConn(transport, resolver.LocalAddr(), domains, QueryOptions{
+		CoverInterval: interval,
+		DecoyRate:     0.5,
+	})
+	defer c.Close()
+
+	var last time.Time
+	var nameLen, decoys int
+	for i := 0; i < 40; i++ {
+		var buf [4096]byte
+		resolver.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := resolver.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		if i > 0 && now.Sub(last) < interval/2 {
+			t.Errorf("query %d came %v after the one before, in a slot of %v", i, now.Sub(last), interval)
+		}
+		last = now
+		msg, err := dns.MessageFromWireFormat(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Question[0].Type != dns.RRTypeTXT {
+			decoys++
+		}
+		l := len(msg.Question[0].Name.String())
+		if i == 0 {
+			nameLen = l
+		} else if l != nameLen {
+			t.Errorf("query %d has name length %d, expected %d", i, l, nameLen)
+		}
+	}
+	if decoys == 0 || decoys == 40 {
+		t.Errorf("%d of 40 queries were decoys", decoys)
+	}
+}
+
+func TestRandomShape(t *testing.T) {
+	domains, err := dns.ParseNames("t.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := QueryOptions{RandomShape: true}
+	mtu := EndpointMTU(domains, opts)
+	if mtu >= EndpointMTU(domains, QueryOptions{}) {
+		t.Errorf("MTU %d with random shape is not less than without", mtu)
+	}
+	transport := &recordingPacketConn{}
+	c := &DNSPacketConn{
+		domains:  domains,
+		rng:      mathrand.New(&cryptoSource{}),
+		opts:     opts,
+		counters: new(counters),
+	}
+	for i := 0; i < 200; i++ {
+		p := make([]byte, i%(mtu+1))
+		mathrand.Read(p)
+		err := c.send(transport, p, nil)
+		if err != nil {
+			t.Fatalf("sending %d bytes: %v", len(p), err)
+		}
+	}
+
+	for _, buf := range transport.written {
+		msg, err := dns.MessageFromWireFormat(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Additional) != 1 || msg.Additional[0].Type != dns.RRTypeOPT {
+			t.Fatalf("no OPT RR in %+v", msg)
+		}
+		opt := msg.Additional[0]
+		if opt.Class < 1232 {
+			t.Errorf("UDP payload size %d is less than 1232", opt.Class)
+		}
+		// Check for RFC 7830 padding.
+		for data := opt.Data; len(data) > 0; {
+			code := uint16(data[0])<<8 | uint16(data[1])
+			length := int(data[2])<<8 | int(data[3])
+			if code == ednsOptionPadding && len(buf)%ednsPaddingBlockSize != 0 {
+				t.Errorf("padded query length %d is not a multiple of %d", len(buf), ednsPaddingBlockSize)
+			}
+			data = data[4+length:]
+		}
+		// The name must still be decodable the way the server does it.
+		prefix, ok := msg.Question[0].Name.TrimSuffix(domains[0])
+		if !ok {
+			t.Fatalf("%s is not in domain %s", msg.Question[0].Name, domains[0])
+		}
+		encoded := bytes.ToUpper(bytes.Join(prefix, nil))
+		_, err = base32Encoding.DecodeString(string(encoded))
+		if err != nil {
+			t.Errorf("%s: %v", msg.Question[0].Name, err)
+		}
+	}
+}
+
+// readQuery reads a query from conn, and returns the query and the ClientID
+// encoded in its name.
+func readQuery(t *testing.T, conn net.PacketConn, domain dns.Name) (*dns.Message, net.Addr, []byte) {
+	var buf [4096]byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dns.MessageFromWireFormat(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, ok := msg.Question[0].Name.TrimSuffix(domain)
+	if !ok {
+		t.Fatalf("%s is not in domain %s", msg.Question[0].Name, domain)
+	}
+	decoded, err := base32Encoding.DecodeString(string(bytes.ToUpper(bytes.Join(prefix, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &msg, addr, decoded[:8]
+}
+
+// A transport that is swapped in must carry queries with the same ClientID,
+// and packets received on it must appear to come from the original address.
+func TestSetTransport(t *testing.T) {
+	domains, err := dns.ParseNames("t.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers [2]net.PacketConn
+	for i := range servers {
+		servers[i], err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer servers[i].Close()
+	}
+
+	transport1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewDNSPacketConn(transport1, servers[0].LocalAddr(), domains, QueryOptions{})
+	defer c.Close()
+	_, err = c.WriteTo([]byte("first"), servers[0].LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, clientID1 := readQuery(t, servers[0], domains[0])
+
+	transport2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetTransport(transport2, servers[1].LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport1.WriteTo([]byte{}, servers[0].LocalAddr()); err == nil {
+		t.Errorf("old transport was not closed")
+	}
+
+	// The new transport sends to the new address, under the same
+	// ClientID.
+	query, addr, clientID2 := readQuery(t, servers[1], domains[0])
+	if !bytes.Equal(clientID1, clientID2) {
+		t.Errorf("ClientID changed from %x to %x", clientID1, clientID2)
+	}
+
+	// A response on the new transport is received as if from the original
+	// address.
+	resp := &dns.Message{
+		ID:       query.ID,
+		Flags:    0x8000,
+		Question: query.Question,
+		Answer: []dns.RR{{
+			Name:  query.Question[0].Name,
+			Type:  dns.RRTypeTXT,
+			Class: dns.ClassIN,
+			TTL:   60,
+			Data:  dns.EncodeRDataTXT([]byte("\x00\x05hello")),
+		}},
+	}
+	buf, err := resp.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = servers[1].WriteTo(buf, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var p [100]byte
+	n, from, err := c.ReadFrom(p[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p[:n]) != "hello" {
+		t.Errorf("received %+q", p[:n])
+	}
+	if from != servers[0].LocalAddr() {
+		t.Errorf("received from %v, expected %v", from, servers[0].LocalAddr())
+	}
+
+	// SetTransport after Close closes the new transport.
+	c.Close()
+	transport3, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTransport(transport3, servers[1].LocalAddr()); err == nil {
+		t.Errorf("SetTransport after Close did not return an error")
+	}
+	if _, err := transport3.WriteTo([]byte{}, servers[1].LocalAddr()); err == nil {
+		t.Errorf("transport given after Close was not closed")
+	}
+}
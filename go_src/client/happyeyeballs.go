@@ -0,0 +1,350 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+const (
+	// How long to wait for an attempt at one address of a resolver before
+	// also starting one at the next, as recommended by RFC 8305.
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// How long to wait, in all, for any address of a UDP resolver to answer
+	// the probe query, before settling on the first address anyway.
+	udpProbeTimeout = 3 * time.Second
+)
+
+// wellKnownNAT64Prefix is the well-known prefix of RFC 6052, through which a
+// network with only IPv6 and NAT64 reaches IPv4 addresses, unless it has a
+// prefix of its own.
+var wellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// ipv4OnlyAddrs are the addresses of ipv4only.arpa, which has no IPv6
+// addresses of its own, so that its IPv6 addresses from a DNS64 server tell
+// the network's NAT64 prefix (RFC 7050).
+var ipv4OnlyAddrs = []netip.Addr{
+	netip.MustParseAddr("192.0.0.170"),
+	netip.MustParseAddr("192.0.0.171"),
+}
+
+// nat64PrefixLengths are the lengths of NAT64 prefixes allowed by RFC 6052
+// section 2.2.
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// nat64Positions returns the indexes of the bytes of an IPv6 address that
+// hold an IPv4 address behind a NAT64 prefix of the given length. Byte 8,
+// bits 64 to 71, is always 0 and is skipped (RFC 6052 section 2.2).
+func nat64Positions(bits int) []int {
+	var positions []int
+	for i := bits / 8; len(positions) < 4; i++ {
+		if i != 8 {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
+
+// nat64Addr returns the address by which the IPv4 address addr is reached
+// through NAT64 with prefix.
+func nat64Addr(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	a := addr.As4()
+	for i, pos := range nat64Positions(prefix.Bits()) {
+		b[pos] = a[i]
+	}
+	return netip.AddrFrom16(b)
+}
+
+// nat64PrefixOf returns the NAT64 prefix of addr, an IPv6 address of
+// ipv4only.arpa, by finding where one of ipv4OnlyAddrs is embedded in it.
+func nat64PrefixOf(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Prefix{}, false
+	}
+	b := addr.As16()
+	for _, bits := range nat64PrefixLengths {
+		var a [4]byte
+		for i, pos := range nat64Positions(bits) {
+			a[i] = b[pos]
+		}
+		for _, known := range ipv4OnlyAddrs {
+			if netip.AddrFrom4(a) == known {
+				return netip.PrefixFrom(addr, bits).Masked(), true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// discoverNAT64Prefix returns the NAT64 prefix of the network, found as in RFC
+// 7050 from the IPv6 addresses of ipv4only.arpa, or wellKnownNAT64Prefix if
+// they do not tell it.
+func discoverNAT64Prefix(ctx context.Context) netip.Prefix {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err == nil {
+		for _, addr := range addrs {
+			if prefix, ok := nat64PrefixOf(addr); ok {
+				return prefix
+			}
+		}
+	}
+	return wellKnownNAT64Prefix
+}
+
+// interleaveFamilies reorders addrs to alternate between IPv6 and IPv4,
+// starting with IPv6, and otherwise keeping their order, as in RFC 8305
+// section 4.
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	result := make([]netip.Addr, 0, len(addrs))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			result = append(result, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			result = append(result, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return result
+}
+
+// resolverAddrs returns the addresses at which to try the resolver at hostport,
+// in order. A host name may have several, of both families. An IPv4 address
+// literal has just one: itself, or, if there is no route to it from a socket
+// made with lc, as on a network with only IPv6, its address through the
+// network's NAT64 prefix.
+func resolverAddrs(ctx context.Context, lc *net.ListenConfig, hostport string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() && !routable(ctx, lc, netip.AddrPortFrom(addr, uint16(port))) {
+			addr = nat64Addr(discoverNAT64Prefix(ctx), addr)
+		}
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = interleaveFamilies(addrs)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses for " + host)
+	}
+	result := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		result[i] = netip.AddrPortFrom(addr, uint16(port))
+	}
+	return result, nil
+}
+
+// routable reports whether there is a route to addr, by connecting a UDP socket
+// made with lc to it. Nothing is sent.
+func routable(ctx context.Context, lc *net.ListenConfig, addr netip.AddrPort) bool {
+	dialer := &net.Dialer{}
+	if lc != nil {
+		dialer.Control = lc.Control
+	}
+	conn, err := dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// happyEyeballs calls dial with each index from 0 to n−1, and returns the
+// result of the first call to succeed, with its index. It starts the first
+// call at once, and each next one when the one before has failed, or has not
+// succeeded within happyEyeballsDelay, so that an address that is slow or
+// unreachable does not hold up the others. The ctx passed to dial is canceled
+// once a call succeeds, and the results of any calls that succeed after that
+// are closed. If every call fails, it returns the first error.
+func happyEyeballs[T io.Closer](ctx context.Context, n int, dial func(ctx context.Context, i int) (T, error)) (T, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn T
+		i    int
+		err  error
+	}
+	results := make(chan result, n)
+	started, failed := 0, 0
+	startNext := func() {
+		i := started
+		started++
+		go func() {
+			conn, err := dial(ctx, i)
+			results <- result{conn, i, err}
+		}()
+	}
+	// closeLate closes the results of the calls still running.
+	closeLate := func() {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.err == nil {
+					r.conn.Close()
+				}
+			}
+		}(started - failed)
+	}
+
+	var zero T
+	var firstErr error
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	startNext()
+	for {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				failed++ // Not failed, but no longer pending.
+				closeLate()
+				return r.conn, r.i, nil
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if failed == n {
+				return zero, -1, firstErr
+			}
+			if started < n {
+				startNext()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if started < n {
+				startNext()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-ctx.Done():
+			closeLate()
+			return zero, -1, ctx.Err()
+		}
+	}
+}
+
+// probeUDP opens a socket with lc from which to send to addr, and returns it
+// once addr has answered a DNS query sent from it. The query, for the NS
+// records of the root, is one that any resolver can answer.
+func probeUDP(ctx context.Context, lc *net.ListenConfig, addr *net.UDPAddr) (net.PacketConn, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query, err := (&dns.Message{
+		ID:       binary.BigEndian.Uint16(id[:]),
+		Flags:    0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{{Name: dns.Name{}, Type: dns.RRTypeNS, Class: dns.ClassIN}},
+	}).WireFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := listenUDP(ctx, lc, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { pconn.SetReadDeadline(time.Now()) })
+	err = probeUDPConn(pconn, addr, query)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	return pconn, nil
+}
+
+// probeUDPConn sends query to addr from pconn and waits for the response.
+func probeUDPConn(pconn net.PacketConn, addr *net.UDPAddr, query []byte) error {
+	_, err := pconn.WriteTo(query, addr)
+	if err != nil {
+		return err
+	}
+	var buf [4096]byte
+	for {
+		n, from, err := pconn.ReadFrom(buf[:])
+		if err != nil {
+			return err
+		}
+		udpFrom, ok := from.(*net.UDPAddr)
+		if !ok || !sameAddrPort(udpFrom.AddrPort(), addr.AddrPort()) {
+			continue
+		}
+		resp, err := dns.MessageFromWireFormat(buf[:n])
+		if err != nil || resp.ID != binary.BigEndian.Uint16(query) || resp.Flags&0x8000 == 0 {
+			continue
+		}
+		return nil
+	}
+}
+
+// sameAddrPort reports whether a and b are the same, taking an IPv4-mapped IPv6
+// address to be the same as the IPv4 address.
+func sameAddrPort(a, b netip.AddrPort) bool {
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
+
+// dialUDP returns a socket, made with lc, from which to send to the UDP DNS
+// resolver at hostport, and the address to send to. When the resolver has
+// several addresses, it sends a probe query to each in turn, as
+// happyEyeballs describes, and takes the first to answer. If none answers, it
+// takes the first address all the same; the tunnel's own queries may yet get
+// through.
+func dialUDP(lc *net.ListenConfig, hostport string) (*net.UDPAddr, net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addrs, err := resolverAddrs(ctx, lc, hostport)
+	if err != nil {
+		return nil, nil, err
+	}
+	udpAddr := func(i int) *net.UDPAddr {
+		return net.UDPAddrFromAddrPort(addrs[i])
+	}
+	if len(addrs) > 1 {
+		probeCtx, probeCancel := context.WithTimeout(ctx, udpProbeTimeout)
+		pconn, i, err := happyEyeballs(probeCtx, len(addrs), func(ctx context.Context, i int) (net.PacketConn, error) {
+			return probeUDP(ctx, lc, udpAddr(i))
+		})
+		probeCancel()
+		if err == nil {
+			return udpAddr(i), pconn, nil
+		}
+	}
+	pconn, err := listenUDP(ctx, lc, udpAddr(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	return udpAddr(0), pconn, nil
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var addrs []netip.Addr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "::ffff:192.0.2.3", "2001:db8::1", "2001:db8::2"} {
+		addrs = append(addrs, netip.MustParseAddr(s))
+	}
+	var got []string
+	for _, addr := range interleaveFamilies(addrs) {
+		got = append(got, addr.String())
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestNAT64Addr(t *testing.T) {
+	// Examples from RFC 6052 section 2.4, and the well-known prefix.
+	for _, test := range []struct {
+		prefix, addr string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	} {
+		prefix := netip.MustParsePrefix(test.prefix)
+		got := nat64Addr(prefix, netip.MustParseAddr("192.0.2.33"))
+		if expected := netip.MustParseAddr(test.addr); got != expected {
+			t.Errorf("%v: got %v, expected %v", prefix, got, expected)
+		}
+		// The same prefix is found in the address of ipv4only.arpa.
+		found, ok := nat64PrefixOf(nat64Addr(prefix, netip.MustParseAddr("192.0.0.170")))
+		if !ok || found != prefix {
+			t.Errorf("%v: found %v %v", prefix, found, ok)
+		}
+	}
+	for _, addr := range []string{"2001:db8::1", "192.0.0.170", "::ffff:192.0.0.170"} {
+		if prefix, ok := nat64PrefixOf(netip.MustParseAddr(addr)); ok {
+			t.Errorf("%s: found %v", addr, prefix)
+		}
+	}
+}
+
+// An IPv6 literal is its own only address; an IPv4 literal that can be routed
+// to is too.
+func TestResolverAddrs(t *testing.T) {
+	for _, test := range []struct {
+		hostport string
+		expected string
+	}{
+		{"[2001:db8::1]:53", "[2001:db8::1]:53"},
+		{"127.0.0.1:853", "127.0.0.1:853"},
+	} {
+		addrs, err := resolverAddrs(context.Background(), nil, test.hostport)
+		if err != nil || len(addrs) != 1 || addrs[0].String() != test.expected {
+			t.Errorf("%+q: got %v %v", test.hostport, addrs, err)
+		}
+	}
+}
+
+type testCloser struct {
+	closed atomic.Bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// A call that fails starts the next at once, without waiting out the delay.
+func TestHappyEyeballsFailure(t *testing.T) {
+	start := time.Now()
+	c, i, err := happyEyeballs(context.Background(), 3, func(ctx context.Context, i int) (*testCloser, error) {
+		if i < 2 {
+			return nil, errors.New("unreachable")
+		}
+		return new(testCloser), nil
+	})
+	if err != nil || i != 2 || c == nil {
+		t.Fatalf("got %v %v %v", c, i, err)
+	}
+	if elapsed := time.Since(start); elapsed >= happyEyeballsDelay {
+		t.Errorf("took %v", elapsed)
+	}
+
+	_, _, err = happyEyeballs(context.Background(), 2, func(ctx context.Context, i int) (*testCloser, error) {
+		return nil, errors.New([]string{"first", "second"}[i])
+	})
+	if err == nil || err.Error() != "first" {
+		t.Errorf("got %v", err)
+	}
+}
+
+// A slow call does not hold up the next; when the next wins, the slow call's
+// context is canceled, and its result, if it succeeds after all, is closed.
+func TestHappyEyeballsSlow(t *testing.T) {
+	late := new(testCloser)
+	canceled := make(chan struct{})
+	c, i, err := happyEyeballs(context.Background(), 2, func(ctx context.Context, i int) (*testCloser, error) {
+		if i == 0 {
+			<-ctx.Done()
+			close(canceled)
+			return late, nil
+		}
+		return new(testCloser), nil
+	})
+	if err != nil || i != 1 || c == nil || c == late {
+		t.Fatalf("got %v %v %v", c, i, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow call not canceled")
+	}
+	for deadline := time.Now().Add(time.Second); !late.closed.Load(); {
+		if time.Now().After(deadline) {
+			t.Fatal("late result not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// probeUDP returns a socket once the resolver answers, and fails when it does
+// not answer in time.
+func TestProbeUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		var buf [512]byte
+		for {
+			n, addr, err := server.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			query, err := dns.MessageFromWireFormat(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp, _ := (&dns.Message{ID: query.ID, Flags: 0x8180, Question: query.Question}).WireFormat()
+			server.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pconn, err := probeUDP(ctx, nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pconn.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = probeUDP(ctx, nil, silent.LocalAddr().(*net.UDPAddr))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+}
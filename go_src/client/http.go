@@ -1,16 +1,16 @@
-package main
+package client
 
 import (
 	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
+	"www.bamsoftware.com/git/dnstt.git/logging"
 	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
 )
 
@@ -112,7 +112,7 @@ func (c *HTTPPacketConn) send(p []byte) error {
 			var err error
 			retryAfter, err = parseRetryAfter(value, now)
 			if err != nil {
-				log.Printf("cannot parse Retry-After value %+q", value)
+				logging.Transport.Warnf("cannot parse Retry-After value %+q", value)
 			}
 		}
 		if retryAfter.IsZero() {
@@ -120,15 +120,15 @@ func (c *HTTPPacketConn) send(p []byte) error {
 			retryAfter = now.Add(defaultRetryAfter)
 		}
 		if retryAfter.Before(now) {
-			log.Printf("got %+q, but Retry-After is %v in the past",
+			logging.Transport.Infof("got %+q, but Retry-After is %v in the past",
 				resp.Status, now.Sub(retryAfter))
 		} else {
 			c.notBeforeLock.Lock()
 			if retryAfter.Before(c.notBefore) {
-				log.Printf("got %+q, but Retry-After is %v earlier than already received Retry-After",
+				logging.Transport.Infof("got %+q, but Retry-After is %v earlier than already received Retry-After",
 					resp.Status, c.notBefore.Sub(retryAfter))
 			} else {
-				log.Printf("got %+q; ceasing sending for %v",
+				logging.Transport.Warnf("got %+q; ceasing sending for %v",
 					resp.Status, retryAfter.Sub(now))
 				c.notBefore = retryAfter
 			}
@@ -155,7 +155,7 @@ func (c *HTTPPacketConn) sendLoop() {
 
 		err := c.send(p)
 		if err != nil {
-			log.Printf("sendLoop: %v", err)
+			logging.Transport.Warnf("sendLoop: %v", err)
 		}
 	}
 }
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// How long to wait for a direct connection to be established.
+const directDialTimeout = 10 * time.Second
+
+// streamDialer is a proxy.Dialer that returns an already open connection,
+// which lets proxy.SOCKS5 do its handshake over a tunnel stream.
+type streamDialer struct {
+	conn net.Conn
+}
+
+func (d streamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// DialSOCKS asks the server's upstream, which must be a SOCKS5 proxy, to
+// connect stream, a newly opened tunnel stream, to addr. It is how listeners
+// that know the destination of a connection carry the destination through the
+// tunnel. stream is closed if the SOCKS5 request fails.
+func DialSOCKS(stream net.Conn, network, addr string) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", "upstream", nil, streamDialer{stream})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("SOCKS5 connect to %s: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// DialDirect connects to addr outside the tunnel, for connections that split
+// tunneling rules send direct. control, if not nil, is called on the socket
+// before it connects, as net.Dialer.Control is, for instance to protect it
+// from VPN routing.
+func DialDirect(network, addr string, control func(network, address string, c syscall.RawConn) error) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: directDialTimeout, Control: control}
+	return dialer.Dial(network, addr)
+}
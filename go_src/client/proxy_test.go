@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/socksproxy"
+)
+
+// DialSOCKS asks for the destination over the stream, and closes the stream
+// when the request is refused.
+func TestDialSOCKS(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"example.com:443", true},
+		{"blocked.example:443", false},
+	} {
+		stream, upstream := net.Pipe()
+		var requested string
+		go socksproxy.Handle(upstream, func(network, addr string) (net.Conn, error) {
+			requested = addr
+			if !test.ok {
+				return nil, errors.New("refused")
+			}
+			target, remote := net.Pipe()
+			go func() {
+				defer remote.Close()
+				io.Copy(remote, remote)
+			}()
+			return target, nil
+		})
+
+		conn, err := DialSOCKS(stream, "tcp", test.addr)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: no error", test.addr)
+			} else if _, err := stream.Write([]byte{0}); err == nil {
+				t.Errorf("%s: stream not closed", test.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.addr, err)
+		}
+		if requested != test.addr {
+			t.Errorf("requested %+q, expected %+q", requested, test.addr)
+		}
+		go conn.Write([]byte("hello"))
+		var buf [5]byte
+		if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "hello" {
+			t.Errorf("read %+q %v", buf[:], err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// The ALPN protocol identifier of DNS over QUIC.
+	doqALPN = "doq"
+	// How long to wait for the response on each DoQ stream.
+	doqExchangeTimeout = 30 * time.Second
+	// How often to send a keepalive on an otherwise idle QUIC connection.
+	doqKeepAlivePeriod = 20 * time.Second
+)
+
+// QUICPacketConn is a QUIC-based transport for DNS messages, used for DNS over
+// QUIC (DoQ). Each DNS message is sent on a QUIC stream of its own, prefixed
+// with a two-octet length field, and the response is read from the same
+// stream. As DoQ requires, the message ID of every query is set to 0.
+//
+// QUICPacketConn deals only with already formatted DNS messages. It does not
+// handle encoding information into the messages. That is rather the
+// responsibility of DNSPacketConn.
+//
+// https://tools.ietf.org/html/rfc9250
+type QUICPacketConn struct {
+	// closed is closed by Close, to stop sendLoop.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// QueuePacketConn is the direct receiver of ReadFrom and WriteTo calls.
+	// sendLoop takes messages out of the send queue and sends them on new
+	// streams, and the goroutine for each stream puts the response in the
+	// receive queue.
+	*turbotunnel.QueuePacketConn
+}
+
+// quicConn is a quic.Conn that can be closed as an io.Closer.
+type quicConn struct {
+	*quic.Conn
+}
+
+func (c quicConn) Close() error {
+	return c.CloseWithError(0, "")
+}
+
+// NewQUICPacketConn creates a new QUICPacketConn configured to use the QUIC
+// server at addr as a DNS over QUIC resolver. It maintains a QUIC connection
+// to the resolver, reconnecting as necessary. It closes the QUICPacketConn if
+// any reconnection attempt fails. tlsConfig may be nil; its NextProtos is set
+// to the DoQ protocol identifier. The UDP socket of each QUIC connection is
+// opened using lc. When addr has several addresses, the handshakes with them
+// are raced, IPv6 first, and the first to finish is kept.
+func NewQUICPacketConn(addr string, tlsConfig *tls.Config, lc *net.ListenConfig) (*QUICPacketConn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{doqALPN}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+	quicConfig := &quic.Config{
+		KeepAlivePeriod: doqKeepAlivePeriod,
+	}
+	dial := func() (*quic.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		addrs, err := resolverAddrs(ctx, lc, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Race the handshakes at the resolver's addresses.
+		conn, _, err := happyEyeballs(ctx, len(addrs), func(ctx context.Context, i int) (quicConn, error) {
+			udpAddr := net.UDPAddrFromAddrPort(addrs[i])
+			pconn, err := listenUDP(ctx, lc, udpAddr)
+			if err != nil {
+				return quicConn{}, err
+			}
+			conn, err := quic.Dial(ctx, pconn, udpAddr, tlsConfig, quicConfig)
+			if err != nil {
+				pconn.Close()
+				return quicConn{}, err
+			}
+			// quic.Dial does not close a socket it did not open.
+			context.AfterFunc(conn.Context(), func() { pconn.Close() })
+			return quicConn{conn}, nil
+		})
+		return conn.Conn, err
+	}
+	// As with TLSPacketConn, do the first dial here, so that immediate
+	// errors are reported to the caller.
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &QUICPacketConn{
+		closed:          make(chan struct{}),
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0),
+	}
+	go func() {
+		defer c.Close()
+		for {
+			err := c.sendLoop(conn)
+			conn.CloseWithError(0, "")
+			if err != nil {
+				logging.Transport.Warnf("sendLoop: %v", err)
+			}
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+
+			// Whenever the QUIC connection dies, redial a new one.
+			conn, err = dial()
+			if err != nil {
+				logging.Transport.Warnf("dial quic: %v", err)
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// sendLoop reads messages from the outgoing queue and sends each of them on a
+// new stream of conn. It returns when conn is closed or c is closed.
+func (c *QUICPacketConn) sendLoop(conn *quic.Conn) error {
+	outgoing := c.QueuePacketConn.OutgoingQueue(turbotunnel.DummyAddr{})
+	for {
+		var p []byte
+		select {
+		case p = <-outgoing:
+		case <-conn.Context().Done():
+			return context.Cause(conn.Context())
+		case <-c.closed:
+			return nil
+		}
+		// OpenStreamSync blocks while the server's limit on concurrent
+		// streams is reached.
+		stream, err := conn.OpenStreamSync(conn.Context())
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := c.exchange(stream, p)
+			if err != nil {
+				logging.Transport.Warnf("DoQ stream %d: %v", stream.StreamID(), err)
+			}
+		}()
+	}
+}
+
+// exchange sends the query p on stream, and puts the response in the incoming
+// queue.
+func (c *QUICPacketConn) exchange(stream *quic.Stream, p []byte) error {
+	defer stream.CancelRead(0)
+	stream.SetDeadline(time.Now().Add(doqExchangeTimeout))
+
+	if len(p) < 2 || len(p) > 0xffff {
+		stream.Close()
+		return errors.New("bad query length")
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(p)))
+	copy(buf[2:], p)
+	// Message ID 0.
+	buf[2] = 0
+	buf[3] = 0
+	_, err := stream.Write(buf)
+	if err != nil {
+		return err
+	}
+	// Closing the stream sends a FIN, which tells the server that there
+	// are no more queries on it.
+	err = stream.Close()
+	if err != nil {
+		return err
+	}
+
+	var length uint16
+	err = binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	resp := make([]byte, int(length))
+	_, err = io.ReadFull(stream, resp)
+	if err != nil {
+		return err
+	}
+	c.QueuePacketConn.QueueIncoming(resp, turbotunnel.DummyAddr{})
+	return nil
+}
+
+// Close closes the QUICPacketConn and its QUIC connection.
+func (c *QUICPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.QueuePacketConn.Close()
+}
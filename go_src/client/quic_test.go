@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// selfSignedConfig returns a server TLS configuration with a self-signed
+// certificate.
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{doqALPN},
+	}
+}
+
+// A DoQ server that answers each query with the query itself must see message
+// ID 0, and the response must come back through the QUICPacketConn.
+func TestQUICPacketConn(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ids := make(chan uint16, 10)
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		for {
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				// Read until the FIN.
+				buf, err := io.ReadAll(stream)
+				if err != nil || len(buf) < 4 {
+					return
+				}
+				ids <- binary.BigEndian.Uint16(buf[2:4])
+				stream.Write(buf)
+			}()
+		}
+	}()
+
+	c, err := NewQUICPacketConn(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		query := []byte{0x12, 0x34, 0x01, 0x00, byte(i)}
+		_, err = c.WriteTo(query, turbotunnel.DummyAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case id := <-ids:
+			if id != 0 {
+				t.Errorf("query has ID %#04x", id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for query")
+		}
+		var buf [100]byte
+		n, _, err := c.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(query) || buf[4] != byte(i) {
+			t.Errorf("response %x to query %x", buf[:n], query)
+		}
+	}
+}
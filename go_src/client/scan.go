@@ -0,0 +1,298 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults for ScanOptions.
+	defaultScanWorkers = 16
+	defaultScanTimeout = 15 * time.Second
+	// The effective MTU of dnstt-server with its default -mtu of 1232.
+	defaultScanMTU = 932
+
+	// In ScanEcho mode, the probe is at least this many times MTU bytes
+	// long, so that the server has enough of its echo waiting to send
+	// packets of the full MTU.
+	scanEchoMTUs = 4
+)
+
+// DefaultScanProbe is the data that Scan sends through the tunnel when
+// ScanOptions does not say otherwise: a SOCKS5 greeting, which a SOCKS5
+// upstream answers with two bytes.
+var DefaultScanProbe = []byte{0x05, 0x01, 0x00}
+
+// ScanOptions control Scan.
+type ScanOptions struct {
+	// Workers is how many resolvers are tested at once. If zero, it is 16.
+	Workers int
+	// Timeout is how long the test of one resolver may take, in total. If
+	// zero, it is 15 seconds.
+	Timeout time.Duration
+	// Mode is how far the test of a resolver goes, one of ScanData,
+	// ScanHandshake, and ScanEcho. If empty, it is ScanData.
+	Mode string
+	// Probe is sent on a stream once the handshake is done, for the data
+	// round trip. In ScanData mode, any reply from the server's upstream,
+	// of any length, completes it. If nil, it is DefaultScanProbe.
+	Probe []byte
+	// MTU, in ScanEcho mode, is the size of the packets that a resolver
+	// must carry from the server: the effective MTU that dnstt-server
+	// logs when it starts. The probe is lengthened with random bytes, if
+	// it is short, so that its echo comes back in packets of that size,
+	// and a resolver fails the size check if none as large as MTU came
+	// through it. If zero, it is 932, the effective MTU of a server with
+	// the default -mtu of 1232. In other modes, the server's replies are
+	// too short to fill packets, and only truncation fails the check.
+	MTU int
+	// Query controls the timing and shape of queries.
+	Query QueryOptions
+	// Progress, if not nil, is called with the result of each resolver as
+	// soon as it is known, including those not tested because ctx was
+	// done. Calls are not concurrent.
+	Progress func(ScanResult)
+}
+
+// Modes of Scan, which say how far the test of each resolver goes.
+const (
+	// ScanData tests the handshake, then a round trip of the probe, to
+	// which any reply will do. It suits a server whose upstream is a
+	// SOCKS5 proxy, with the default probe.
+	ScanData = "data"
+	// ScanHandshake tests only the handshake.
+	ScanHandshake = "handshake"
+	// ScanEcho tests the handshake, then a round trip of the probe, which
+	// must come back unchanged. It suits a server whose upstream is an
+	// echo server, and needs nothing else beyond the tunnel.
+	ScanEcho = "echo"
+)
+
+// Stages of a resolver test, at which a ScanResult may fail.
+const (
+	StageDial      = "dial"
+	StageHandshake = "handshake"
+	StageData      = "data"
+	StageSize      = "size"
+)
+
+// ScanResult is the result of testing one resolver.
+type ScanResult struct {
+	// Resolver is the resolver, as it was given to Scan.
+	Resolver string `json:"resolver"`
+	// OK is whether the resolver passed every check.
+	OK bool `json:"ok"`
+	// Stage is the check that failed, one of StageDial, StageHandshake,
+	// StageData, and StageSize, and Error says how. Both are empty if OK.
+	Stage string `json:"stage,omitempty"`
+	Error string `json:"error,omitempty"`
+	// HandshakeMs is how long the Noise handshake took, and RoundTripMs
+	// how long the data round trip took, in milliseconds. Each is 0 if
+	// its check was not reached.
+	HandshakeMs int64 `json:"handshake_ms"`
+	RoundTripMs int64 `json:"round_trip_ms"`
+	// ResponseSize is the size in bytes of the largest DNS response that
+	// came through the resolver, and PacketSize that of the largest
+	// packet from the server that those responses carried. Truncated is
+	// the number of responses that the resolver truncated, which fails
+	// the size check.
+	ResponseSize int `json:"response_size"`
+	PacketSize   int `json:"packet_size"`
+	Truncated    int `json:"truncated"`
+}
+
+// Scan tests the tunnel server at ep through each of resolvers, which are in
+// the forms accepted by ParseTransport, using a pool of opts.Workers at once.
+// Testing a resolver means doing a Noise handshake with the server through
+// it, then a round trip of opts.Probe to the server's upstream and back, and
+// checking that no response was truncated on the way; opts.Mode may make it
+// skip the round trip, or require an echo in packets of opts.MTU bytes. Scan
+// returns the results ranked by success, then by round trip time, then by
+// handshake time. When ctx is done, tests in progress stop, and the results
+// of the resolvers not yet tested say so. It returns an error, without testing any, if a resolver or opts.Mode
+// cannot be parsed.
+func Scan(ctx context.Context, ep Endpoint, resolvers []string, transportOpts TransportOptions, opts ScanOptions) ([]ScanResult, error) {
+	switch opts.Mode {
+	case "":
+		opts.Mode = ScanData
+	case ScanData, ScanHandshake, ScanEcho:
+	default:
+		return nil, fmt.Errorf("unknown scan mode %+q", opts.Mode)
+	}
+	transports := make([]Transport, len(resolvers))
+	for i, spec := range resolvers {
+		var err error
+		transports[i], err = ParseTransport(spec, transportOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultScanWorkers
+	}
+
+	results := make([]ScanResult, len(resolvers))
+	var progressLock sync.Mutex
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(resolvers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := probe(ctx, &ep, transports[i], &opts)
+				result.Resolver = resolvers[i]
+				results[i] = result
+				if opts.Progress != nil {
+					progressLock.Lock()
+					opts.Progress(result)
+					progressLock.Unlock()
+				}
+			}
+		}()
+	}
+	next := 0
+loop:
+	for ; next < len(resolvers); next++ {
+		select {
+		case indexes <- next:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	for i := next; i < len(resolvers); i++ {
+		results[i] = ScanResult{Resolver: resolvers[i], Stage: StageDial, Error: "not tested: " + ctx.Err().Error()}
+		if opts.Progress != nil {
+			opts.Progress(results[i])
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := &results[i], &results[j]
+		if a.OK != b.OK {
+			return a.OK
+		}
+		if a.RoundTripMs != b.RoundTripMs {
+			return a.RoundTripMs < b.RoundTripMs
+		}
+		return a.HandshakeMs < b.HandshakeMs
+	})
+	return results, nil
+}
+
+// probe tests the tunnel server at ep through transport, as Scan describes.
+func probe(ctx context.Context, ep *Endpoint, transport Transport, opts *ScanOptions) ScanResult {
+	var result ScanResult
+	fail := func(stage string, err error) ScanResult {
+		result.Stage = stage
+		result.Error = err.Error()
+		return result
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var counters counters
+	dialed := false
+	dialTransport := func() (net.Addr, net.PacketConn, error) {
+		addr, pconn, err := transport.Dial()
+		dialed = err == nil
+		return addr, pconn, err
+	}
+	start := time.Now()
+	// ctx limits the handshake; the handshake's own timeout is only a
+	// backstop.
+	s, err := newTunnelSession(ctx, ep, dialTransport, Options{Query: opts.Query, HandshakeTimeout: 2 * timeout}, &counters)
+	if err != nil {
+		if !dialed {
+			return fail(StageDial, err)
+		}
+		return fail(StageHandshake, err)
+	}
+	defer s.Close()
+	result.HandshakeMs = time.Since(start).Milliseconds()
+	// Cut the round trip short when ctx is done.
+	stop := context.AfterFunc(ctx, func() { s.sess.Close() })
+	defer stop()
+
+	mtu := opts.MTU
+	if mtu <= 0 {
+		mtu = defaultScanMTU
+	}
+	if opts.Mode != ScanHandshake {
+		p := opts.Probe
+		if p == nil {
+			p = DefaultScanProbe
+		}
+		if opts.Mode == ScanEcho && len(p) < scanEchoMTUs*mtu {
+			pad := make([]byte, scanEchoMTUs*mtu-len(p))
+			rand.Read(pad)
+			p = append(append([]byte{}, p...), pad...)
+		}
+		start = time.Now()
+		err = roundTrip(s, p, opts.Mode == ScanEcho)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fail(StageData, err)
+		}
+		result.RoundTripMs = time.Since(start).Milliseconds()
+	}
+
+	result.ResponseSize = int(counters.maxResponseSize.Load())
+	result.PacketSize = int(counters.maxPacketSize.Load())
+	result.Truncated = int(counters.truncated.Load())
+	if result.Truncated > 0 {
+		return fail(StageSize, fmt.Errorf("%d truncated responses", result.Truncated))
+	}
+	if opts.Mode == ScanEcho && result.PacketSize < mtu {
+		return fail(StageSize, fmt.Errorf("largest packet was %d bytes, not %d", result.PacketSize, mtu))
+	}
+	result.OK = true
+	return result
+}
+
+// roundTrip writes p on a new stream of s, and waits for at least one byte in
+// reply, or, if echo, for p itself.
+func roundTrip(s *tunnelSession, p []byte, echo bool) error {
+	stream, err := s.sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = stream.Write(p)
+	if err != nil {
+		return err
+	}
+	if echo {
+		buf := make([]byte, len(p))
+		_, err = io.ReadFull(stream, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("stream closed before the whole echo")
+		} else if err == nil && !bytes.Equal(buf, p) {
+			err = errors.New("echo differs from probe")
+		}
+		return err
+	}
+	var buf [1]byte
+	_, err = stream.Read(buf[:])
+	if err == io.EOF {
+		err = errors.New("stream closed without a reply")
+	}
+	return err
+}
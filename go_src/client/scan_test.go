@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/tunneltest"
+)
+
+func TestExpandResolvers(t *testing.T) {
+	resolvers, err := ExpandResolvers([]string{
+		"# comment",
+		"",
+		"192.0.2.1",
+		"  tls://dns.example:853  # trailing comment",
+		"192.0.2.8/30",
+		"quic://2001:db8::/127",
+		"https://dns.example/dns-query",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"192.0.2.1",
+		"tls://dns.example:853",
+		"192.0.2.8", "192.0.2.9", "192.0.2.10", "192.0.2.11",
+		"quic://2001:db8::", "quic://2001:db8::1",
+		"https://dns.example/dns-query",
+	}
+	if strings.Join(resolvers, ",") != strings.Join(expected, ",") {
+		t.Errorf("got %v", resolvers)
+	}
+
+	if _, err := ExpandResolvers([]string{"10.0.0.0/8"}); err == nil {
+		t.Error("expanded a /8")
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	for _, test := range []struct {
+		spec, name string
+	}{
+		{"192.0.2.1", "UDP 192.0.2.1:53"},
+		{"udp://192.0.2.1:5353", "UDP 192.0.2.1:5353"},
+		{"2001:db8::1", "UDP [2001:db8::1]:53"},
+		{"tls://dns.example", "DoT dns.example:853"},
+		{"https://dns.example/dns-query", "DoH https://dns.example/dns-query"},
+		{"QUIC://dns.example:8853", "DoQ dns.example:8853"},
+	} {
+		transport, err := ParseTransport(test.spec, TransportOptions{})
+		if err != nil || transport.Name != test.name {
+			t.Errorf("%+q: got %+q %v", test.spec, transport.Name, err)
+		}
+	}
+	for _, spec := range []string{"udp://", "ftp://dns.example"} {
+		if _, err := ParseTransport(spec, TransportOptions{}); err == nil {
+			t.Errorf("%+q: parsed", spec)
+		}
+	}
+}
+
+// Resolvers that do not respond fail the handshake, and when the scan is
+// canceled, those not yet tested say so.
+func TestScanFailures(t *testing.T) {
+	ep, err := ParseEndpoint("t.example.com=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolvers []string
+	for i := 0; i < 3; i++ {
+		resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resolver.Close()
+		resolvers = append(resolvers, resolver.LocalAddr().String())
+	}
+
+	var progress []string
+	results, err := Scan(context.Background(), ep, resolvers, TransportOptions{}, ScanOptions{
+		Workers:  2,
+		Timeout:  200 * time.Millisecond,
+		Progress: func(r ScanResult) { progress = append(progress, r.Resolver) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || len(progress) != 3 {
+		t.Fatalf("got %d results and %d progress", len(results), len(progress))
+	}
+	for _, r := range results {
+		if r.OK || r.Stage != StageHandshake {
+			t.Errorf("got %+v", r)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	progress = nil
+	results, err = Scan(ctx, ep, resolvers, TransportOptions{}, ScanOptions{
+		Workers:  1,
+		Timeout:  10 * time.Second,
+		Progress: func(r ScanResult) { progress = append(progress, r.Resolver) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 3 {
+		t.Errorf("got %d progress", len(progress))
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("canceled scan took %v", d)
+	}
+	for _, r := range results {
+		if r.OK || !strings.Contains(r.Error, "canceled") {
+			t.Errorf("got %+v", r)
+		}
+	}
+
+	if _, err := Scan(context.Background(), ep, []string{"ftp://dns.example"}, TransportOptions{}, ScanOptions{}); err == nil {
+		t.Error("scanned an invalid resolver")
+	}
+	if _, err := Scan(context.Background(), ep, resolvers, TransportOptions{}, ScanOptions{Mode: "ping"}); err == nil {
+		t.Error("scanned with an invalid mode")
+	}
+}
+
+// In ScanEcho mode, a resolver passes only if packets of the full MTU came
+// through it.
+func TestScanPacketSize(t *testing.T) {
+	server := startTestServer(t, "t.example.com", nil)
+	resolver := server.Addr().String()
+	for _, test := range []struct {
+		mtu   int
+		ok    bool
+		stage string
+	}{
+		{tunneltest.MTU, true, ""},
+		{tunneltest.MTU + 1, false, StageSize},
+	} {
+		results, err := Scan(context.Background(), server.Endpoint(0), []string{resolver}, TransportOptions{}, ScanOptions{
+			Mode:  ScanEcho,
+			Probe: []byte("hello"),
+			MTU:   test.mtu,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := results[0]
+		if r.OK != test.ok || r.Stage != test.stage || r.PacketSize != tunneltest.MTU {
+			t.Errorf("MTU %d: %+v", test.mtu, r)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/tunneltest"
+)
+
+// testServer is a tunneltest.Server, with the endpoints and transports of the
+// client package.
+type testServer struct {
+	*tunneltest.Server
+}
+
+// startTestServer starts a testServer for domains, a comma-separated list,
+// which is closed when the test ends. respond is as in tunneltest.Options.
+func startTestServer(t *testing.T, domains string, respond func(payload []byte) ([]byte, error)) testServer {
+	t.Helper()
+	s, err := tunneltest.NewServer(domains, tunneltest.Options{Respond: respond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return testServer{s}
+}
+
+// Endpoint returns an endpoint of the server, with the domain at index i.
+func (s testServer) Endpoint(i int) Endpoint {
+	return Endpoint{Domains: s.Domains()[i : i+1], Pubkey: s.Pubkey()}
+}
+
+// Transport returns a UDP transport to the server.
+func (s testServer) Transport() Transport {
+	return UDPTransport(s.Addr().String(), TransportOptions{})
+}
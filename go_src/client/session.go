@@ -0,0 +1,869 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/compression"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/priority"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// How long to wait for the Noise handshake to complete before giving
+	// up on an endpoint, unless Options says otherwise.
+	defaultHandshakeTimeout = 30 * time.Second
+
+	// How long to wait for the handshake when offering compression. A
+	// server that supports compression answers an offer as fast as any
+	// handshake; one that does not never answers it, and the handshake
+	// must be tried again without the offer.
+	offerTimeout = 5 * time.Second
+
+	// While a fallback endpoint is active, how often to try the primary
+	// endpoint again, in order to fail back to it.
+	probeInterval = 1 * time.Minute
+
+	// How often to check whether a session that has been replaced has any
+	// remaining streams, so that it may be closed.
+	retireCheckInterval = 5 * time.Second
+
+	// When there is more than one transport, how often to check whether
+	// the transport in use is getting responses. If at least
+	// minUnansweredQueries queries were sent in that time, and no
+	// response was received, the next transport is tried.
+	responseCheckInterval = 10 * time.Second
+	minUnansweredQueries  = 5
+
+	// How long Reconnect waits for a response through the new transport of
+	// the active session before giving up on the session.
+	reconnectCheckTimeout = 5 * time.Second
+	// How many times Reconnect tries to establish a new session, and how
+	// long it waits before the second try. The wait doubles after every
+	// try.
+	reconnectAttempts = 5
+	reconnectBackoff  = 1 * time.Second
+)
+
+// Endpoint is a tunnel server: the domains delegated to the server and the
+// server's public key.
+type Endpoint struct {
+	Domains []dns.Name
+	Pubkey  []byte
+}
+
+// String returns the endpoint's domains, separated by commas.
+func (ep *Endpoint) String() string {
+	names := make([]string, 0, len(ep.Domains))
+	for _, domain := range ep.Domains {
+		names = append(names, domain.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseEndpoint parses an endpoint specification of the form DOMAIN=PUBKEY,
+// where DOMAIN is a comma-separated list of domains and PUBKEY is a
+// hex-encoded public key.
+func ParseEndpoint(spec string) (Endpoint, error) {
+	i := strings.LastIndexByte(spec, '=')
+	if i == -1 {
+		return Endpoint{}, fmt.Errorf("missing \"=\" in %+q", spec)
+	}
+	domains, err := dns.ParseNames(spec[:i])
+	if err != nil {
+		return Endpoint{}, err
+	}
+	pubkey, err := noise.DecodeKey(spec[i+1:])
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("pubkey format error: %v", err)
+	}
+	return Endpoint{Domains: domains, Pubkey: pubkey}, nil
+}
+
+// EndpointMTU returns the KCP MTU that results from encoding packets under
+// the longest of domains, with query options opts.
+func EndpointMTU(domains []dns.Name, opts QueryOptions) int {
+	mtu := 0
+	for i, domain := range domains {
+		n := opts.nameCapacity(domain) - 8 - 1 - numPadding - 1 // clientid + padding length prefix + padding + data length prefix
+		if i == 0 || n < mtu {
+			mtu = n
+		}
+	}
+	return mtu
+}
+
+// Transport is a way of sending DNS messages to a resolver. Dial opens a new
+// instance of the transport, returning the address to pass to its WriteTo
+// method along with the transport itself. Name is for log messages, like
+// "UDP 192.0.2.1:53".
+type Transport struct {
+	Name string
+	Dial func() (net.Addr, net.PacketConn, error)
+}
+
+// State is the state of a SessionManager's connection to its endpoints.
+type State int
+
+const (
+	// Disconnected means that there is no session, and none is being
+	// established. The next stream, or Connect, establishes one.
+	Disconnected State = iota
+	// Connecting means that a transport is being opened for a new
+	// session.
+	Connecting
+	// Handshaking means that the Noise handshake of a new session is in
+	// progress.
+	Handshaking
+	// Connected means that there is an active session.
+	Connected
+	// Reconnecting is like Connecting, for a session to replace one that
+	// has been closed.
+	Reconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Handshaking:
+		return "handshaking"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Options are settings that apply to every session of a SessionManager.
+type Options struct {
+	// Compress is whether to offer compression to servers.
+	Compress bool
+	// Query controls the timing and shape of queries.
+	Query QueryOptions
+	// LazyIdle, if not zero, is how long the active session may go without
+	// any streams before it is closed. Once closed, the next stream
+	// establishes a new session.
+	LazyIdle time.Duration
+	// HandshakeTimeout is how long to wait for the Noise handshake with an
+	// endpoint to complete. If zero, it is 30 seconds.
+	HandshakeTimeout time.Duration
+	// StateFunc, if not nil, is called with each change of the
+	// SessionManager's state. It must return quickly, and must not call
+	// methods of the SessionManager other than State and Stats.
+	StateFunc func(State)
+}
+
+// tunnelSession is the stack of layers that make up one session with one
+// endpoint: a DNSPacketConn over its own transport, a KCP conn, a Noise
+// channel, a priority scheduler, and an smux session.
+type tunnelSession struct {
+	endpoint *Endpoint
+	pconn    *DNSPacketConn
+	conn     *kcp.UDPSession
+	prio     *priority.Conn
+	sess     *smux.Session
+	// compression is the algorithm agreed on in the handshake.
+	compression string
+}
+
+// newTunnelSession dials a new transport with dialTransport and establishes a
+// session with ep over it, counting its traffic in counters. opts.Query
+// controls the timing and shape of queries.
+// If opts.Compress is true, it offers compression in the Noise handshake, and
+// compresses the session if the server accepts. It returns an error if the
+// Noise handshake does not complete within opts.HandshakeTimeout, or before
+// ctx is done.
+func newTunnelSession(ctx context.Context, ep *Endpoint, dialTransport func() (net.Addr, net.PacketConn, error), opts Options, counters *counters) (*tunnelSession, error) {
+	remoteAddr, transport, err := dialTransport()
+	if err != nil {
+		return nil, err
+	}
+	pconn := newDNSPacketConn(transport, remoteAddr, ep.Domains, opts.Query, counters)
+
+	// Open a KCP conn on the PacketConn.
+	conn, err := kcp.NewConn2(remoteAddr, nil, 0, 0, pconn)
+	if err != nil {
+		pconn.Close()
+		return nil, fmt.Errorf("opening KCP conn: %v", err)
+	}
+	// Permit coalescing the payloads of consecutive sends.
+	conn.SetStreamMode(true)
+	// Disable the dynamic congestion window (limit only by the maximum of
+	// local and remote static windows).
+	conn.SetNoDelay(
+		0, // default nodelay
+		0, // default interval
+		0, // default resend
+		1, // nc=1 => congestion window off
+	)
+	conn.SetWindowSize(turbotunnel.QueueSize/2, turbotunnel.QueueSize/2)
+	if rc := conn.SetMtu(EndpointMTU(ep.Domains, opts.Query)); !rc {
+		panic(rc)
+	}
+
+	// Put a Noise channel on top of the KCP conn. A server that does not
+	// respond to the handshake causes a read timeout.
+	timeout := opts.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	var rw io.ReadWriteCloser
+	alg := compression.None
+	if opts.Compress {
+		var reply []byte
+		rw, reply, err = noise.NewClientWithPayload(conn, ep.Pubkey, compression.Offer())
+		if err == nil {
+			alg, err = compression.Accept(reply)
+		}
+	} else {
+		rw, err = noise.NewClient(conn, ep.Pubkey)
+	}
+	if !stop() {
+		// ctx is done, and may have cut the handshake short.
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		pconn.Close()
+		return nil, fmt.Errorf("session %08x Noise handshake: %v", conn.GetConv(), err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Put compression, if any, between Noise and smux.
+	rw, err = compression.NewConn(rw, alg)
+	if err != nil {
+		conn.Close()
+		pconn.Close()
+		return nil, err
+	}
+	if alg != compression.None {
+		logging.Noise.Infof("session %08x compression %s", conn.GetConv(), alg)
+	}
+
+	// Schedule smux frames by the priority of their streams before they
+	// enter the lower layers.
+	prio := priority.NewConn(rw)
+	prio.SetThrottleFunc(func(throttled bool) {
+		if throttled {
+			conn.SetWindowSize(priority.ThrottledSendWindow, 0)
+		} else {
+			conn.SetWindowSize(turbotunnel.QueueSize/2, 0)
+		}
+	})
+
+	// Start a smux session on the Noise channel.
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	smuxConfig.KeepAliveTimeout = idleTimeout
+	smuxConfig.MaxStreamBuffer = 1 * 1024 * 1024 // default is 65536
+	smuxConfig.MaxFrameSize = priority.MaxFrameSize
+	sess, err := smux.Client(prio, smuxConfig)
+	if err != nil {
+		prio.Close()
+		conn.Close()
+		pconn.Close()
+		return nil, fmt.Errorf("opening smux session: %v", err)
+	}
+
+	logging.KCP.Infof("begin session %08x with %s", conn.GetConv(), ep)
+	return &tunnelSession{
+		endpoint:    ep,
+		pconn:       pconn,
+		conn:        conn,
+		prio:        prio,
+		sess:        sess,
+		compression: alg,
+	}, nil
+}
+
+// Close tears down all the layers of the session.
+func (s *tunnelSession) Close() error {
+	logging.KCP.Infof("end session %08x", s.conn.GetConv())
+	err := s.sess.Close()
+	s.conn.Close()
+	s.pconn.Close()
+	return err
+}
+
+// SessionManager maintains a session with one of an ordered list of
+// endpoints. The first endpoint is the primary. When the active session fails
+// its handshake or is closed because the server has gone silent, new streams
+// move to the next endpoint in the list. While a fallback endpoint is active,
+// the manager periodically probes the primary, and fails back to it when it
+// becomes reachable again. Streams already open on a replaced session are
+// allowed to finish.
+//
+// Independently of endpoints, the manager may have an ordered list of
+// transports. When no endpoint can be reached over the transport in use, or
+// when the transport stops getting responses, the manager moves to the next
+// transport, returning to the first after the last. The active session is
+// moved onto the new transport without disturbing its streams.
+type SessionManager struct {
+	endpoints []Endpoint
+	opts      Options
+
+	// transports are the transports to use, in order of preference.
+	// transportIndex is the index of the one in use. dialLock controls
+	// access to transportIndex.
+	transports     []Transport
+	transportIndex int
+	dialLock       sync.Mutex
+
+	// noOffer records, for each endpoint, whether the endpoint has
+	// refused the compression offer. offerLock controls access to noOffer.
+	noOffer   []bool
+	offerLock sync.Mutex
+
+	// connectLock lets only one connect at a time establish a session.
+	// Establishing takes place without lock, so that other methods are not
+	// held up by handshakes.
+	connectLock sync.Mutex
+	// lock controls access to current and index.
+	lock sync.Mutex
+	// current is the active session, or nil if there is none.
+	current *tunnelSession
+	// index is the index into endpoints of current, or of the endpoint to
+	// try first when there is no active session.
+	index int
+	// opening is the number of calls to OpenStream in progress. The
+	// active session is not idle while it is not zero.
+	opening int
+
+	// state is the state last reported to opts.StateFunc. stateLock
+	// controls access to it.
+	state     State
+	stateLock sync.Mutex
+	// counters count the traffic of all sessions.
+	counters counters
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// ctx is canceled by Close, to cut short handshakes in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewSessionManager creates a SessionManager for endpoints and transports,
+// neither of which may be empty. opts applies to every session. It does not
+// establish a session until one is requested by OpenStream or Connect.
+func NewSessionManager(endpoints []Endpoint, transports []Transport, opts Options) *SessionManager {
+	m := &SessionManager{
+		endpoints:  endpoints,
+		transports: transports,
+		opts:       opts,
+		noOffer:    make([]bool, len(endpoints)),
+		closed:     make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if len(endpoints) > 1 {
+		go m.probeLoop()
+	}
+	if len(transports) > 1 {
+		go m.responseCheckLoop()
+	}
+	if opts.LazyIdle != 0 {
+		go m.idleLoop()
+	}
+	return m
+}
+
+// Connect establishes a session, if there is no active session or if the active
+// session has been closed. It tries each endpoint once, beginning with the one
+// after any session that has failed. If none succeeds, it moves to the next
+// transport and tries the endpoints again, until every transport has been
+// tried. It returns the error from the last attempt if nothing succeeds.
+func (m *SessionManager) Connect() error {
+	_, err := m.connect(true)
+	return err
+}
+
+// errClosed is the error of a SessionManager that has been closed.
+var errClosed = errors.New("session manager closed")
+
+// active returns the active session, if there is one and it is not closed, or
+// errClosed if the SessionManager is closed.
+func (m *SessionManager) active() (*tunnelSession, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-m.closed:
+		return nil, errClosed
+	default:
+	}
+	if m.current != nil && !m.current.sess.IsClosed() {
+		return m.current, nil
+	}
+	return nil, nil
+}
+
+// connect is like Connect, but returns the active session. If failover is
+// false, it begins with the endpoint of a session that has failed, rather than
+// the one after it.
+func (m *SessionManager) connect(failover bool) (*tunnelSession, error) {
+	if s, err := m.active(); s != nil || err != nil {
+		return s, err
+	}
+	// Another connect may have established a session while we waited.
+	m.connectLock.Lock()
+	defer m.connectLock.Unlock()
+	if s, err := m.active(); s != nil || err != nil {
+		return s, err
+	}
+
+	state := Connecting
+	m.lock.Lock()
+	if m.current != nil {
+		logging.KCP.Infof("session %08x with %s is closed", m.current.conn.GetConv(), m.current.endpoint)
+		m.current.Close()
+		m.current = nil
+		if failover {
+			// Move on to the next endpoint. With only one
+			// endpoint, this means trying the same one again.
+			m.index = (m.index + 1) % len(m.endpoints)
+		}
+		state = Reconnecting
+	}
+	start := m.index
+	m.lock.Unlock()
+
+	var err error
+	for t := 0; t < len(m.transports); t++ {
+		for i := 0; i < len(m.endpoints); i++ {
+			if m.ctx.Err() != nil {
+				return nil, errClosed
+			}
+			index := (start + i) % len(m.endpoints)
+			ep := &m.endpoints[index]
+			m.setState(state)
+			var s *tunnelSession
+			s, err = m.establish(index, func() { m.setState(Handshaking) })
+			if err != nil {
+				logging.Noise.Warnf("endpoint %s: %v", ep, err)
+				continue
+			}
+			if index != 0 {
+				logging.Transport.Infof("failing over to endpoint %d, %s", index, ep)
+			}
+			m.lock.Lock()
+			select {
+			case <-m.closed:
+				m.lock.Unlock()
+				s.Close()
+				return nil, errClosed
+			default:
+			}
+			// probeLoop may have put in a session of its own meanwhile.
+			old := m.current
+			m.index = index
+			m.current = s
+			m.lock.Unlock()
+			if old != nil {
+				go retire(old)
+			}
+			m.setState(Connected)
+			go m.watch(s)
+			return s, nil
+		}
+		if len(m.transports) > 1 {
+			m.nextTransport(fmt.Sprintf("no endpoint is reachable: %v", err))
+		}
+	}
+	m.setState(Disconnected)
+	return nil, err
+}
+
+// State returns the state of the SessionManager.
+func (m *SessionManager) State() State {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.state
+}
+
+// setState changes the state, and reports the change to opts.StateFunc.
+func (m *SessionManager) setState(state State) {
+	m.stateLock.Lock()
+	changed := state != m.state
+	m.state = state
+	m.stateLock.Unlock()
+	if changed && m.opts.StateFunc != nil {
+		m.opts.StateFunc(state)
+	}
+}
+
+// watch changes the state to Disconnected if s is closed, by the server going
+// silent for example, while it is the active session.
+func (m *SessionManager) watch(s *tunnelSession) {
+	select {
+	case <-s.sess.CloseChan():
+	case <-m.closed:
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.current == s {
+		m.setState(Disconnected)
+	}
+}
+
+// Stats returns counters of the traffic of all sessions, since the
+// SessionManager was created.
+func (m *SessionManager) Stats() Stats {
+	return m.counters.stats()
+}
+
+// establish establishes a new session with the endpoint at index. If
+// handshaking is not nil, it is called whenever a transport has been opened
+// and the handshake begins. When compression is enabled, it first offers
+// compression, and waits no longer than offerTimeout for the handshake. A
+// server that supports compression always answers the offer, accepting or
+// refusing it; a server that does not never answers, so if that handshake
+// fails, establish tries again without the offer. An endpoint that refuses the
+// offer is not offered compression again.
+func (m *SessionManager) establish(index int, handshaking func()) (*tunnelSession, error) {
+	ep := &m.endpoints[index]
+	m.offerLock.Lock()
+	offer := m.opts.Compress && !m.noOffer[index]
+	m.offerLock.Unlock()
+
+	dial := m.currentTransport().Dial
+	dialTransport := func() (net.Addr, net.PacketConn, error) {
+		addr, transport, err := dial()
+		if err == nil && handshaking != nil {
+			handshaking()
+		}
+		return addr, transport, err
+	}
+
+	opts := m.opts
+	opts.Compress = offer
+	if offer && (opts.HandshakeTimeout == 0 || opts.HandshakeTimeout > offerTimeout) {
+		opts.HandshakeTimeout = offerTimeout
+	}
+	s, err := newTunnelSession(m.ctx, ep, dialTransport, opts, &m.counters)
+	if err == nil && offer && s.compression == compression.None {
+		logging.Noise.Infof("endpoint %s refuses compression", ep)
+		m.offerLock.Lock()
+		m.noOffer[index] = true
+		m.offerLock.Unlock()
+	}
+	if err != nil && offer && m.ctx.Err() == nil {
+		logging.Noise.Infof("endpoint %s: %v; trying again without compression", ep, err)
+		opts = m.opts
+		opts.Compress = false
+		s, err = newTunnelSession(m.ctx, ep, dialTransport, opts, &m.counters)
+	}
+	return s, err
+}
+
+// OpenStream opens a new stream with the given priority class on the active
+// session, establishing a session if necessary.
+func (m *SessionManager) OpenStream(class priority.Class) (*smux.Stream, uint32, error) {
+	m.lock.Lock()
+	m.opening++
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		m.opening--
+		m.lock.Unlock()
+	}()
+
+	s, err := m.connect(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	stream, err := s.sess.OpenStream()
+	if err != nil {
+		return nil, 0, fmt.Errorf("session %08x opening stream: %v", s.conn.GetConv(), err)
+	}
+	s.prio.SetClass(stream.ID(), class)
+	if class != priority.Auto {
+		// Have the server schedule its side of the stream the same way.
+		err = s.prio.SendClass(stream.ID(), class)
+		if err != nil {
+			stream.Close()
+			return nil, 0, fmt.Errorf("session %08x sending stream class: %v", s.conn.GetConv(), err)
+		}
+	}
+	return stream, s.conn.GetConv(), nil
+}
+
+// currentTransport returns the transport in use.
+func (m *SessionManager) currentTransport() Transport {
+	m.dialLock.Lock()
+	defer m.dialLock.Unlock()
+	return m.transports[m.transportIndex]
+}
+
+// nextTransport makes the next transport, after the one in use, the one to use
+// for new sessions, logging reason as the reason for the change.
+func (m *SessionManager) nextTransport(reason string) Transport {
+	m.dialLock.Lock()
+	defer m.dialLock.Unlock()
+	old := m.transports[m.transportIndex]
+	m.transportIndex = (m.transportIndex + 1) % len(m.transports)
+	t := m.transports[m.transportIndex]
+	logging.Transport.Warnf("transport %s: %s; falling back to %s", old.Name, reason, t.Name)
+	return t
+}
+
+// ResetTransport moves the active session, if any, onto a new transport of the
+// kind in use, without disturbing the session's streams. Sessions that are
+// being retired keep their old transport.
+func (m *SessionManager) ResetTransport() error {
+	m.lock.Lock()
+	s := m.current
+	m.lock.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.setTransport(m.currentTransport())
+}
+
+// Reconnect is for after a change of network, when the active session may be
+// sending from a socket that no longer goes anywhere. It moves the active
+// session onto a new transport, with new sockets, and waits for a response
+// through it. If one comes, the session is kept, along with its streams.
+// Otherwise, Reconnect closes the session and establishes a new one, beginning
+// with the same endpoint, since it is the network that changed and not the
+// endpoint that failed. It tries again with backoff up to reconnectAttempts
+// times, and returns the error of the last try if all fail. If there is no
+// session, Reconnect does nothing; the next stream establishes one.
+func (m *SessionManager) Reconnect() error {
+	m.lock.Lock()
+	s := m.current
+	m.lock.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	if !s.sess.IsClosed() {
+		err := s.setTransport(m.currentTransport())
+		if err == nil && m.awaitResponse(s) {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no response in %v", reconnectCheckTimeout)
+		}
+		logging.Transport.Warnf("session %08x: %v; reconnecting", s.conn.GetConv(), err)
+		// Leave s as m.current, so that connect replaces it like any
+		// other closed session, though with the same endpoint.
+		s.sess.Close()
+	}
+
+	delay := reconnectBackoff
+	var err error
+	for i := 0; i < reconnectAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(delay):
+			case <-m.closed:
+				return errClosed
+			}
+			delay *= 2
+		}
+		_, err = m.connect(false)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// awaitResponse waits up to reconnectCheckTimeout for s to receive a response
+// through its transport, and returns whether it did.
+func (m *SessionManager) awaitResponse(s *tunnelSession) bool {
+	deadline := time.NewTimer(reconnectCheckTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, received := s.pconn.Counts(); received > 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return false
+		case <-m.closed:
+			return false
+		}
+	}
+}
+
+// setTransport dials t and puts s on it.
+func (s *tunnelSession) setTransport(t Transport) error {
+	remoteAddr, transport, err := t.Dial()
+	if err != nil {
+		return fmt.Errorf("%s: %v", t.Name, err)
+	}
+	err = s.pconn.SetTransport(transport, remoteAddr)
+	if err != nil {
+		return err
+	}
+	logging.Transport.Infof("session %08x has a new transport %s", s.conn.GetConv(), t.Name)
+	return nil
+}
+
+// responseCheckLoop periodically checks whether the active session is getting
+// responses to its queries. If not, it moves to the next transport.
+func (m *SessionManager) responseCheckLoop() {
+	ticker := time.NewTicker(responseCheckInterval)
+	defer ticker.Stop()
+	var last *tunnelSession
+	var lastSent, lastReceived uint64
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+		}
+
+		m.lock.Lock()
+		s := m.current
+		m.lock.Unlock()
+		if s == nil {
+			last = nil
+			continue
+		}
+		sent, received := s.pconn.Counts()
+		if s == last && sent >= lastSent && received >= lastReceived &&
+			sent-lastSent >= minUnansweredQueries && received == lastReceived {
+			reason := fmt.Sprintf("no responses to %d queries in %v", sent-lastSent, responseCheckInterval)
+			t := m.nextTransport(reason)
+			err := s.setTransport(t)
+			if err != nil {
+				logging.Transport.Warnf("session %08x: %v", s.conn.GetConv(), err)
+			}
+			// Start counting afresh on the new transport.
+			last = nil
+			continue
+		}
+		last, lastSent, lastReceived = s, sent, received
+	}
+}
+
+// probeLoop periodically tries to establish a session with the primary
+// endpoint while a fallback endpoint is active. On success, the new session
+// becomes the active one and the fallback session is retired.
+func (m *SessionManager) probeLoop() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+		}
+
+		m.lock.Lock()
+		active := m.current != nil && !m.current.sess.IsClosed()
+		index := m.index
+		m.lock.Unlock()
+		if !active || index == 0 {
+			continue
+		}
+
+		ep := &m.endpoints[0]
+		s, err := m.establish(0, nil)
+		if err != nil {
+			logging.Transport.Infof("probe of primary endpoint %s: %v", ep, err)
+			continue
+		}
+
+		m.lock.Lock()
+		select {
+		case <-m.closed:
+			m.lock.Unlock()
+			s.Close()
+			return
+		default:
+		}
+		old := m.current
+		m.current = s
+		m.index = 0
+		m.lock.Unlock()
+		go m.watch(s)
+		logging.Transport.Infof("failing back to primary endpoint %s", ep)
+		if old != nil {
+			go retire(old)
+		}
+	}
+}
+
+// idleLoop closes the active session once it has had no streams for
+// opts.LazyIdle. The session stays closed until the next call to Connect or
+// OpenStream, so that polling stops in the meantime.
+func (m *SessionManager) idleLoop() {
+	interval := m.opts.LazyIdle / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last *tunnelSession
+	var idleSince time.Time
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+		}
+
+		m.lock.Lock()
+		s := m.current
+		if s == nil || m.opening > 0 || s.sess.NumStreams() > 0 || s != last {
+			last = s
+			idleSince = time.Now()
+		} else if time.Since(idleSince) >= m.opts.LazyIdle {
+			logging.KCP.Infof("session %08x idle for %v", s.conn.GetConv(), m.opts.LazyIdle)
+			s.Close()
+			m.current = nil
+			last = nil
+			m.setState(Disconnected)
+		}
+		m.lock.Unlock()
+	}
+}
+
+// retire closes s once it has no more open streams.
+func retire(s *tunnelSession) {
+	ticker := time.NewTicker(retireCheckInterval)
+	defer ticker.Stop()
+	for s.sess.NumStreams() > 0 && !s.sess.IsClosed() {
+		<-ticker.C
+	}
+	s.Close()
+}
+
+// Close closes the active session and stops probing.
+func (m *SessionManager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.cancel()
+	})
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.current != nil {
+		m.current.Close()
+		m.current = nil
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/compression"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	const pubkeyHex = "0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff"
+
+	// Good inputs.
+	for _, test := range []struct {
+		input  string
+		domain string
+	}{
+		{"t.example.com=" + pubkeyHex, "t.example.com"},
+		{"t.example.com.=" + pubkeyHex, "t.example.com"},
+		{"example=" + pubkeyHex, "example"},
+		{"t1.example.com,t2.example.net=" + pubkeyHex, "t1.example.com,t2.example.net"},
+	} {
+		ep, err := ParseEndpoint(test.input)
+		if err != nil {
+			t.Errorf("%+q resulted in error: %v", test.input, err)
+			continue
+		}
+		if ep.String() != test.domain {
+			t.Errorf("%+q: expected domain %+q, got %+q", test.input, test.domain, ep.String())
+		}
+		if len(ep.Pubkey) != 32 || !bytes.Equal(ep.Pubkey[:2], []byte{0x00, 0x00}) || ep.Pubkey[31] != 0xff {
+			t.Errorf("%+q: bad pubkey %x", test.input, ep.Pubkey)
+		}
+	}
+
+	// Bad inputs.
+	for _, input := range []string{
+		"",
+		"t.example.com",
+		"t.example.com=",
+		"=" + pubkeyHex,
+		"t..example.com=" + pubkeyHex,
+		"t1.example.com,=" + pubkeyHex,
+		",t1.example.com=" + pubkeyHex,
+		"t1.example.com,,t2.example.net=" + pubkeyHex,
+		"t.example.com=" + pubkeyHex[:62],
+		"t.example.com=" + pubkeyHex + "00",
+		"t.example.com=xx" + pubkeyHex[2:],
+		pubkeyHex + "=t.example.com",
+	} {
+		_, err := ParseEndpoint(input)
+		if err == nil {
+			t.Errorf("%+q resulted in no error", input)
+		}
+	}
+}
+
+func TestEndpointMTU(t *testing.T) {
+	short, err := dns.ParseNames("t.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := dns.ParseNames("tunnel.long-example-domain.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := append(append([]dns.Name{}, short...), long...)
+	if mtu, expected := EndpointMTU(both, QueryOptions{}), EndpointMTU(long, QueryOptions{}); mtu != expected {
+		t.Errorf("MTU of %v is %d, expected %d", both, mtu, expected)
+	}
+	if EndpointMTU(short, QueryOptions{}) <= EndpointMTU(long, QueryOptions{}) {
+		t.Errorf("MTU of %v is not larger than MTU of %v", short, long)
+	}
+}
+
+// When no transport works, Connect tries each of them once and ends up back
+// at the first.
+func TestConnectTransports(t *testing.T) {
+	ep, err := ParseEndpoint("t.example.com=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed []string
+	var transports []Transport
+	for _, name := range []string{"UDP", "DoT", "DoH"} {
+		name := name
+		transports = append(transports, Transport{
+			Name: name,
+			Dial: func() (net.Addr, net.PacketConn, error) {
+				dialed = append(dialed, name)
+				return nil, nil, errors.New("blocked")
+			},
+		})
+	}
+	m := NewSessionManager([]Endpoint{ep}, transports, Options{})
+	defer m.Close()
+	err = m.Connect()
+	if err == nil {
+		t.Fatal("Connect succeeded")
+	}
+	if strings.Join(dialed, ",") != "UDP,DoT,DoH" {
+		t.Errorf("dialed %v", dialed)
+	}
+	if name := m.currentTransport().Name; name != "UDP" {
+		t.Errorf("ended on transport %s", name)
+	}
+}
+
+// A failed Connect reports the states it goes through, ending Disconnected.
+func TestConnectStates(t *testing.T) {
+	ep, err := ParseEndpoint("t.example.com=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The resolver receives queries, but never responds.
+	resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	var states []string
+	m := NewSessionManager([]Endpoint{ep}, []Transport{UDPTransport(resolver.LocalAddr().String(), TransportOptions{})}, Options{
+		HandshakeTimeout: 200 * time.Millisecond,
+		StateFunc: func(s State) {
+			states = append(states, s.String())
+		},
+	})
+	defer m.Close()
+	if err := m.Connect(); err == nil {
+		t.Fatal("Connect succeeded")
+	}
+	if got := strings.Join(states, ","); got != "connecting,handshaking,disconnected" {
+		t.Errorf("states %s", got)
+	}
+	if m.State() != Disconnected {
+		t.Errorf("ended in state %v", m.State())
+	}
+	if stats := m.Stats(); stats.QueriesSent == 0 || stats.ResponsesReceived != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// Close does not wait for a handshake in progress, and cuts it short.
+func TestCloseDuringConnect(t *testing.T) {
+	ep, err := ParseEndpoint("t.example.com=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The resolver receives queries, but never responds.
+	resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	handshaking := make(chan struct{}, 1)
+	m := NewSessionManager([]Endpoint{ep}, []Transport{UDPTransport(resolver.LocalAddr().String(), TransportOptions{})}, Options{
+		HandshakeTimeout: time.Minute,
+		StateFunc: func(s State) {
+			if s == Handshaking {
+				handshaking <- struct{}{}
+			}
+		},
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.Connect()
+	}()
+	<-handshaking
+
+	start := time.Now()
+	m.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Connect succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect not cut short by Close")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	if _, _, err := m.OpenStream(0); err == nil {
+		t.Error("OpenStream after Close succeeded")
+	}
+}
+
+// Without a session, Reconnect leaves establishing one to the next stream.
+func TestReconnectWithoutSession(t *testing.T) {
+	ep, err := ParseEndpoint("t.example.com=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := 0
+	transport := Transport{
+		Name: "UDP",
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			dialed++
+			return nil, nil, errors.New("blocked")
+		},
+	}
+	m := NewSessionManager([]Endpoint{ep}, []Transport{transport}, Options{})
+	defer m.Close()
+	if err := m.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if dialed != 0 || m.State() != Disconnected {
+		t.Errorf("dialed %d times, state %v", dialed, m.State())
+	}
+}
+
+// An offer of compression is accepted by a server that supports it, and
+// refused by one that supports none of the offered algorithms. A server that
+// does not know about compression holds up the session for no longer than
+// offerTimeout, and is offered compression again next time.
+func TestCompressionOffer(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		respond  func([]byte) ([]byte, error)
+		alg      string
+		noOffer  bool
+		tolerate time.Duration
+	}{
+		{"accept", func(offer []byte) ([]byte, error) {
+			reply, _ := compression.Select(offer)
+			return reply, nil
+		}, compression.Deflate, false, 0},
+		{"refuse", func(offer []byte) ([]byte, error) {
+			return []byte(compression.None), nil
+		}, compression.None, true, 0},
+		{"old", nil, compression.None, false, offerTimeout},
+	} {
+		server := startTestServer(t, "t.example.com", test.respond)
+		m := NewSessionManager([]Endpoint{server.Endpoint(0)}, []Transport{server.Transport()}, Options{
+			Compress:         true,
+			HandshakeTimeout: time.Minute,
+		})
+		start := time.Now()
+		stream, _, err := m.OpenStream(0)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if d := time.Since(start); d > test.tolerate+10*time.Second {
+			t.Errorf("%s: session took %v", test.name, d)
+		}
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var buf [5]byte
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(stream, buf[:]); err != nil || string(buf[:]) != "hello" {
+			t.Errorf("%s: echo %+q, %v", test.name, buf, err)
+		}
+		m.lock.Lock()
+		alg := m.current.compression
+		m.lock.Unlock()
+		m.offerLock.Lock()
+		noOffer := m.noOffer[0]
+		m.offerLock.Unlock()
+		if alg != test.alg || noOffer != test.noOffer {
+			t.Errorf("%s: compression %s, noOffer %v", test.name, alg, noOffer)
+		}
+		m.Close()
+	}
+}
+
+// When the session does not survive a change of network, Reconnect establishes
+// a new one with the same endpoint, rather than failing over to the next.
+func TestReconnectSameEndpoint(t *testing.T) {
+	server := startTestServer(t, "t1.example.com,t2.example.com", nil)
+	// The resolver of the new network receives queries, but never responds.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	var changed atomic.Bool
+	transport := Transport{
+		Name: "UDP",
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			if changed.Swap(false) {
+				return UDPTransport(dead.LocalAddr().String(), TransportOptions{}).Dial()
+			}
+			return server.Transport().Dial()
+		},
+	}
+	m := NewSessionManager([]Endpoint{server.Endpoint(0), server.Endpoint(1)}, []Transport{transport}, Options{})
+	defer m.Close()
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	m.lock.Lock()
+	first := m.current
+	m.lock.Unlock()
+
+	changed.Store(true)
+	if err := m.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	m.lock.Lock()
+	index, current := m.index, m.current
+	m.lock.Unlock()
+	if current == first || current.sess.IsClosed() {
+		t.Errorf("session was not replaced")
+	}
+	if index != 0 || current.endpoint != &m.endpoints[0] {
+		t.Errorf("new session is with endpoint %d, %s", index, current.endpoint)
+	}
+	if n := server.Handshakes.Load(); n != 2 {
+		t.Errorf("%d handshakes", n)
+	}
+}
@@ -1,15 +1,15 @@
-package main
+package client
 
 import (
 	"bufio"
 	"context"
 	"encoding/binary"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 
+	"www.bamsoftware.com/git/dnstt.git/logging"
 	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
 )
 
@@ -61,14 +61,14 @@ func NewTLSPacketConn(addr string, dialTLSContext func(ctx context.Context, netw
 			go func() {
 				err := c.recvLoop(conn)
 				if err != nil {
-					log.Printf("recvLoop: %v", err)
+					logging.Transport.Warnf("recvLoop: %v", err)
 				}
 				wg.Done()
 			}()
 			go func() {
 				err := c.sendLoop(conn)
 				if err != nil {
-					log.Printf("sendLoop: %v", err)
+					logging.Transport.Warnf("sendLoop: %v", err)
 				}
 				wg.Done()
 			}()
@@ -78,7 +78,7 @@ func NewTLSPacketConn(addr string, dialTLSContext func(ctx context.Context, netw
 			// Whenever the TLS connection dies, redial a new one.
 			conn, err = dial()
 			if err != nil {
-				log.Printf("dial tls: %v", err)
+				logging.Transport.Warnf("dial tls: %v", err)
 				break
 			}
 		}
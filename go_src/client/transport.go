@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	utls "github.com/refraction-networking/utls"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// TransportOptions are settings of the transports made by UDPTransport,
+// DoTTransport, DoHTransport, and DoQTransport.
+type TransportOptions struct {
+	// UTLSClientHelloID, if not nil, is the TLS fingerprint with which DoT
+	// and DoH connections are camouflaged using uTLS. If nil, they use
+	// crypto/tls.
+	UTLSClientHelloID *utls.ClientHelloID
+	// Control, if not nil, is called with every socket that the transport
+	// opens, before it is connected, as with net.Dialer.Control. It may,
+	// for example, protect the socket from being routed into a VPN.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// dialer returns a net.Dialer for the TCP connections of a transport.
+func (opts *TransportOptions) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: dialTimeout, Control: opts.Control}
+}
+
+// listenConfig returns a net.ListenConfig for the UDP sockets of a transport.
+func (opts *TransportOptions) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: opts.Control}
+}
+
+// listenUDP opens an unconnected UDP socket using lc, of the same address
+// family as raddr, from which to send to raddr. lc may be nil.
+func listenUDP(ctx context.Context, lc *net.ListenConfig, raddr *net.UDPAddr) (net.PacketConn, error) {
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+	if raddr.IP.To4() != nil {
+		return lc.ListenPacket(ctx, "udp4", "0.0.0.0:0")
+	}
+	return lc.ListenPacket(ctx, "udp6", "[::]:0")
+}
+
+// UDPTransport returns a Transport for the plain UDP DNS resolver at addr.
+// Every dial resolves addr again and opens a new socket. When addr is a host
+// name with several addresses, of IPv6 or IPv4, the dial uses the first that
+// answers a probe query, trying IPv6 first; an IPv4 address that cannot be
+// routed to, as on a network with only IPv6, is reached through NAT64.
+func UDPTransport(addr string, opts TransportOptions) Transport {
+	return Transport{
+		Name: "UDP " + addr,
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			udpAddr, pconn, err := dialUDP(opts.listenConfig(), addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return udpAddr, pconn, nil
+		},
+	}
+}
+
+// DoTTransport returns a Transport for the DNS over TLS resolver at addr.
+func DoTTransport(addr string, opts TransportOptions) Transport {
+	return Transport{
+		Name: "DoT " + addr,
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			dialer := opts.dialer()
+			var dialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+			if opts.UTLSClientHelloID == nil {
+				dialTLSContext = (&tls.Dialer{NetDialer: dialer}).DialContext
+			} else {
+				dialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return utlsDialContext(ctx, dialer, network, addr, nil, opts.UTLSClientHelloID)
+				}
+			}
+			pconn, err := NewTLSPacketConn(addr, dialTLSContext)
+			return turbotunnel.DummyAddr{}, pconn, err
+		},
+	}
+}
+
+// DoHTransport returns a Transport for the DNS over HTTPS resolver at
+// urlString.
+func DoHTransport(urlString string, opts TransportOptions) Transport {
+	return Transport{
+		Name: "DoH " + urlString,
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			dialer := opts.dialer()
+			var rt http.RoundTripper
+			if opts.UTLSClientHelloID == nil {
+				transport := http.DefaultTransport.(*http.Transport).Clone()
+				// Disable DefaultTransport's default Proxy =
+				// ProxyFromEnvironment setting, for conformity
+				// with utlsRoundTripper and with DoT mode,
+				// which do not take a proxy from the
+				// environment.
+				transport.Proxy = nil
+				transport.DialContext = dialer.DialContext
+				rt = transport
+			} else {
+				rt = NewUTLSRoundTripper(dialer, nil, opts.UTLSClientHelloID)
+			}
+			pconn, err := NewHTTPPacketConn(rt, urlString, 32)
+			return turbotunnel.DummyAddr{}, pconn, err
+		},
+	}
+}
+
+// DoQTransport returns a Transport for the DNS over QUIC resolver at addr.
+// DoQ does not use uTLS.
+func DoQTransport(addr string, opts TransportOptions) Transport {
+	return Transport{
+		Name: "DoQ " + addr,
+		Dial: func() (net.Addr, net.PacketConn, error) {
+			pconn, err := NewQUICPacketConn(addr, nil, opts.listenConfig())
+			return turbotunnel.DummyAddr{}, pconn, err
+		},
+	}
+}
+
+// ParseTransport returns the transport for a DNS resolver given in one of
+// these forms:
+//
+//	192.0.2.1 or 192.0.2.1:53 or udp://192.0.2.1:53  UDP DNS
+//	tls://dns.example:853                          DNS over TLS
+//	https://dns.example/dns-query                  DNS over HTTPS
+//	quic://dns.example:853                         DNS over QUIC
+//
+// The ports shown are the defaults.
+func ParseTransport(spec string, opts TransportOptions) (Transport, error) {
+	// withPort adds port to addr if it has none.
+	withPort := func(addr, port string) string {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+		}
+		return addr
+	}
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		scheme, rest = "udp", spec
+	}
+	if rest == "" {
+		return Transport{}, fmt.Errorf("invalid DNS server %+q", spec)
+	}
+	switch strings.ToLower(scheme) {
+	case "udp":
+		return UDPTransport(withPort(rest, "53"), opts), nil
+	case "tls":
+		return DoTTransport(withPort(rest, "853"), opts), nil
+	case "https":
+		return DoHTransport(spec, opts), nil
+	case "quic":
+		return DoQTransport(withPort(rest, "853"), opts), nil
+	default:
+		return Transport{}, fmt.Errorf("unknown DNS server scheme %+q", scheme)
+	}
+}
+
+// maxExpandedResolvers is the most resolvers that ExpandResolvers returns, so
+// that a mistyped prefix length does not make millions.
+const maxExpandedResolvers = 1 << 16
+
+// ExpandResolvers returns the resolvers in specs, in the forms accepted by
+// ParseTransport, with blank entries and comments beginning with "#" removed,
+// and with every CIDR range, like "192.0.2.0/24" or "tls://192.0.2.0/28",
+// replaced by each of its addresses. A range takes the default port.
+func ExpandResolvers(specs []string) ([]string, error) {
+	var resolvers []string
+	for _, spec := range specs {
+		if i := strings.Index(spec, "#"); i >= 0 {
+			spec = spec[:i]
+		}
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		scheme, rest, ok := strings.Cut(spec, "://")
+		prefix, err := netip.ParsePrefix(rest)
+		if !ok {
+			prefix, err = netip.ParsePrefix(spec)
+		}
+		if err != nil {
+			resolvers = append(resolvers, spec)
+			continue
+		}
+		if bits := prefix.Addr().BitLen() - prefix.Bits(); bits > 16 ||
+			len(resolvers)+1<<bits > maxExpandedResolvers {
+			return nil, fmt.Errorf("%s: more than %d resolvers", spec, maxExpandedResolvers)
+		}
+		for addr := prefix.Masked().Addr(); prefix.Contains(addr); addr = addr.Next() {
+			if ok {
+				resolvers = append(resolvers, scheme+"://"+addr.String())
+			} else {
+				resolvers = append(resolvers, addr.String())
+			}
+		}
+	}
+	return resolvers, nil
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// controlRecorder returns TransportOptions whose Control records the network of
+// every socket, and a function that returns the recorded networks.
+func controlRecorder() (TransportOptions, func() []string) {
+	var lock sync.Mutex
+	var networks []string
+	opts := TransportOptions{
+		Control: func(network, address string, c syscall.RawConn) error {
+			lock.Lock()
+			defer lock.Unlock()
+			networks = append(networks, network)
+			return nil
+		},
+	}
+	return opts, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), networks...)
+	}
+}
+
+// A UDP transport sends from a socket that has been through Control, of the
+// address family of the resolver.
+func TestUDPTransport(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts, networks := controlRecorder()
+	transport := UDPTransport(server.LocalAddr().String(), opts)
+	addr, pconn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	if _, err := pconn.WriteTo([]byte("query"), addr); err != nil {
+		t.Fatal(err)
+	}
+	var buf [16]byte
+	n, _, err := server.ReadFrom(buf[:])
+	if err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("read %+q %v", buf[:n], err)
+	}
+	// The route check and the socket itself both go through Control.
+	got := networks()
+	if len(got) == 0 {
+		t.Errorf("Control not called")
+	}
+	for _, network := range got {
+		if network != "udp4" {
+			t.Errorf("Control called for %v", got)
+			break
+		}
+	}
+}
+
+// The TCP connections of DoT and the UDP socket of DoQ go through Control,
+// whether or not the TLS handshake then succeeds.
+func TestTransportControl(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	quicLn, err := quic.ListenAddr("127.0.0.1:0", selfSignedConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quicLn.Close()
+
+	for _, test := range []struct {
+		transport func(string, TransportOptions) Transport
+		addr      string
+		network   string
+	}{
+		{DoTTransport, ln.Addr().String(), "tcp4"},
+		{DoQTransport, quicLn.Addr().String(), "udp4"},
+	} {
+		opts, networks := controlRecorder()
+		transport := test.transport(test.addr, opts)
+		_, pconn, err := transport.Dial()
+		if err == nil {
+			pconn.Close()
+		}
+		if got := networks(); len(got) == 0 || got[0] != test.network {
+			t.Errorf("%s: Control called for %v", transport.Name, got)
+		}
+	}
+}
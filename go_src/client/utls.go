@@ -1,4 +1,4 @@
-package main
+package client
 
 // Support code for TLS camouflage using uTLS.
 
@@ -61,10 +61,10 @@ func utlsLookup(label string) *utls.ClientHelloID {
 	return nil
 }
 
-// utlsDialContext connects to the given network address and initiates a TLS
-// handshake with the provided ClientHelloID, and returns the resulting TLS
-// connection.
-func utlsDialContext(ctx context.Context, network, addr string, config *utls.Config, id *utls.ClientHelloID) (*utls.UConn, error) {
+// utlsDialContext connects to the given network address using dialer and
+// initiates a TLS handshake with the provided ClientHelloID, and returns the
+// resulting TLS connection.
+func utlsDialContext(ctx context.Context, dialer *net.Dialer, network, addr string, config *utls.Config, id *utls.ClientHelloID) (*utls.UConn, error) {
 	// Set the SNI from addr, if not already set.
 	if config == nil {
 		config = &utls.Config{}
@@ -77,7 +77,6 @@ func utlsDialContext(ctx context.Context, network, addr string, config *utls.Con
 		}
 		config.ServerName = host
 	}
-	dialer := &net.Dialer{}
 	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
@@ -138,16 +137,23 @@ func utlsDialContext(ctx context.Context, network, addr string, config *utls.Con
 type utlsRoundTripper struct {
 	clientHelloID *utls.ClientHelloID
 	config        *utls.Config
-	innerLock     sync.Mutex
-	inner         http.RoundTripper
+	dialer        *net.Dialer
+	// plain handles http requests, which do not use TLS.
+	plain     *http.Transport
+	innerLock sync.Mutex
+	inner     http.RoundTripper
 }
 
 // NewUTLSRoundTripper creates a utlsRoundTripper with the given TLS
-// configuration and ClientHelloID.
-func NewUTLSRoundTripper(config *utls.Config, id *utls.ClientHelloID) *utlsRoundTripper {
+// configuration and ClientHelloID, which makes its connections using dialer.
+func NewUTLSRoundTripper(dialer *net.Dialer, config *utls.Config, id *utls.ClientHelloID) *utlsRoundTripper {
+	plain := http.DefaultTransport.(*http.Transport).Clone()
+	plain.DialContext = dialer.DialContext
 	return &utlsRoundTripper{
 		clientHelloID: id,
 		config:        config,
+		dialer:        dialer,
+		plain:         plain,
 		// inner will be set in the first call to RoundTrip.
 	}
 }
@@ -156,7 +162,7 @@ func (rt *utlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	switch req.URL.Scheme {
 	case "http":
 		// If http, don't invoke uTLS; just pass it to an ordinary http.Transport.
-		return http.DefaultTransport.RoundTrip(req)
+		return rt.plain.RoundTrip(req)
 	case "https":
 	default:
 		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
@@ -167,7 +173,7 @@ func (rt *utlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	if rt.inner == nil {
 		// On the first call, make an http.Transport or http2.Transport
 		// as appropriate.
-		rt.inner, err = makeRoundTripper(req, rt.config, rt.clientHelloID)
+		rt.inner, err = makeRoundTripper(req, rt.dialer, rt.config, rt.clientHelloID)
 	}
 	rt.innerLock.Unlock()
 	if err != nil {
@@ -178,18 +184,18 @@ func (rt *utlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	return rt.inner.RoundTrip(req)
 }
 
-// makeRoundTripper makes a bootstrap TLS configuration using the given TLS
-// configuration and ClientHelloID, and creates an http.Transport or
+// makeRoundTripper makes a bootstrap TLS configuration using the given dialer,
+// TLS configuration, and ClientHelloID, and creates an http.Transport or
 // http2.Transport, depending on the negotated ALPN. The Transport is set up to
-// make future TLS connections using the same TLS configuration and
+// make future TLS connections using the same dialer, TLS configuration, and
 // ClientHelloID.
-func makeRoundTripper(req *http.Request, config *utls.Config, id *utls.ClientHelloID) (http.RoundTripper, error) {
+func makeRoundTripper(req *http.Request, dialer *net.Dialer, config *utls.Config, id *utls.ClientHelloID) (http.RoundTripper, error) {
 	addr, err := addrForDial(req.URL)
 	if err != nil {
 		return nil, err
 	}
 
-	bootstrapConn, err := utlsDialContext(req.Context(), "tcp", addr, config, id)
+	bootstrapConn, err := utlsDialContext(req.Context(), dialer, "tcp", addr, config, id)
 	if err != nil {
 		return nil, err
 	}
@@ -213,7 +219,7 @@ func makeRoundTripper(req *http.Request, config *utls.Config, id *utls.ClientHel
 		}
 
 		// Later dials make a new connection.
-		uconn, err := utlsDialContext(ctx, "tcp", addr, config, id)
+		uconn, err := utlsDialContext(ctx, dialer, "tcp", addr, config, id)
 		if err != nil {
 			return nil, err
 		}
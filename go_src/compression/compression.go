@@ -0,0 +1,126 @@
+// Package compression provides optional compression of a tunnel session, and
+// the negotiation of the compression algorithm during the Noise handshake.
+//
+// Compression sits between smux and Noise: everything smux writes is
+// compressed before it is encrypted. The algorithm is negotiated using the
+// payloads of the Noise handshake messages. A client that wants compression
+// sends an offer, a comma-separated list of algorithm names in order of
+// preference, as the payload of its handshake message. The server always
+// replies to an offer, with the name of the algorithm it has chosen, or with
+// "none" to refuse compression. A client that sends no offer gets no
+// compression, and never receives a non-empty server payload, so clients that
+// do not know about compression continue to work. A server that does not know
+// about compression fails the handshake when it receives an offer, without
+// replying; it is up to the client to give up on the offer soon, and try again
+// without one.
+package compression
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// None means no compression.
+	None = "none"
+	// Deflate is DEFLATE (RFC 1951) compression, flushed after every write.
+	Deflate = "deflate"
+)
+
+// supported is the list of algorithms this package implements, in order of
+// preference.
+var supported = []string{Deflate}
+
+// Offer returns the handshake payload that offers every supported algorithm.
+func Offer() []byte {
+	return []byte(strings.Join(supported, ","))
+}
+
+// Select parses a client's offer and returns the handshake payload to send in
+// reply, along with the chosen algorithm. The first offered algorithm that is
+// supported wins. If none is supported, the algorithm is None and the reply is
+// "none", which refuses the offer. If the offer is empty, the algorithm is
+// None and the reply is empty.
+func Select(offer []byte) ([]byte, string) {
+	if len(offer) == 0 {
+		return nil, None
+	}
+	for _, name := range strings.Split(string(offer), ",") {
+		for _, alg := range supported {
+			if name == alg {
+				return []byte(alg), alg
+			}
+		}
+	}
+	return []byte(None), None
+}
+
+// Accept parses the server's reply to an offer and returns the chosen
+// algorithm, which is None if the server refused the offer. It is an error for
+// the server to choose an algorithm that was not offered.
+func Accept(reply []byte) (string, error) {
+	if len(reply) == 0 || string(reply) == None {
+		return None, nil
+	}
+	for _, alg := range supported {
+		if string(reply) == alg {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("server chose unknown compression %+q", reply)
+}
+
+// NewConn wraps rwc so that data is compressed with alg in both directions. If
+// alg is None, rwc is returned unchanged.
+func NewConn(rwc io.ReadWriteCloser, alg string) (io.ReadWriteCloser, error) {
+	switch alg {
+	case None:
+		return rwc, nil
+	case Deflate:
+		return newDeflateConn(rwc), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %+q", alg)
+	}
+}
+
+// deflateConn compresses writes and decompresses reads using DEFLATE. Every
+// Write is flushed, so that the peer can decompress it right away.
+type deflateConn struct {
+	r io.ReadCloser
+	// writeLock controls access to w.
+	writeLock sync.Mutex
+	w         *flate.Writer
+	io.ReadWriteCloser
+}
+
+func newDeflateConn(rwc io.ReadWriteCloser) *deflateConn {
+	w, err := flate.NewWriter(rwc, flate.DefaultCompression)
+	if err != nil {
+		// Only happens with an invalid compression level.
+		panic(err)
+	}
+	return &deflateConn{
+		r:               flate.NewReader(rwc),
+		w:               w,
+		ReadWriteCloser: rwc,
+	}
+}
+
+// Read reads decompressed data.
+func (c *deflateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write compresses p and flushes it to the wrapped io.Writer.
+func (c *deflateConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
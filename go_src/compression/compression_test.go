@@ -0,0 +1,97 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	for _, test := range []struct {
+		offer string
+		reply string
+		alg   string
+	}{
+		{"", "", None},
+		{"deflate", "deflate", Deflate},
+		{"zstd,deflate", "deflate", Deflate},
+		{"deflate,zstd", "deflate", Deflate},
+		{"zstd", "none", None},
+		{"none", "none", None},
+		{",", "none", None},
+	} {
+		reply, alg := Select([]byte(test.offer))
+		if string(reply) != test.reply || alg != test.alg {
+			t.Errorf("%+q returned (%+q, %+q), expected (%+q, %+q)",
+				test.offer, reply, alg, test.reply, test.alg)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	for _, test := range []struct {
+		reply string
+		alg   string
+	}{
+		{"", None},
+		{"none", None},
+		{"deflate", Deflate},
+		{"zstd", "error"},
+		{"deflate,zstd", "error"},
+	} {
+		alg, err := Accept([]byte(test.reply))
+		if test.alg == "error" {
+			if err == nil {
+				t.Errorf("%+q returned (%+q, %v), expected error", test.reply, alg, err)
+			}
+		} else if err != nil || alg != test.alg {
+			t.Errorf("%+q returned (%+q, %v), expected (%+q, %v)", test.reply, alg, err, test.alg, nil)
+		}
+	}
+
+	// Whatever Select chooses from our own offer must be acceptable.
+	reply, expected := Select(Offer())
+	alg, err := Accept(reply)
+	if err != nil || alg != expected {
+		t.Errorf("Accept(Select(Offer())) returned (%+q, %v), expected (%+q, %v)", alg, err, expected, nil)
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	c, s := net.Pipe()
+	client, err := NewConn(c, Deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewConn(s, Deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	messages := [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		bytes.Repeat([]byte("abcd"), 10000),
+		{0},
+	}
+	go func() {
+		for _, msg := range messages {
+			if _, err := client.Write(msg); err != nil {
+				panic(err)
+			}
+		}
+	}()
+	// Each message must be readable without waiting for a later write.
+	for _, msg := range messages {
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(server, buf)
+		if err != nil {
+			t.Fatalf("reading %d bytes: %v", len(msg), err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("read %+q, expected %+q", buf, msg)
+		}
+	}
+}
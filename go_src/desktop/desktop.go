@@ -5,6 +5,12 @@ package main
 #include <stdlib.h>
 #include <stdint.h>
 #include <stdbool.h>
+
+typedef void (*dnstt_log_callback)(const char *level, const char *tag, const char *message);
+
+static void dnstt_call_log_callback(dnstt_log_callback cb, const char *level, const char *tag, const char *message) {
+	cb(level, tag, message);
+}
 */
 import "C"
 import (
@@ -23,91 +29,139 @@ import (
 )
 
 var (
-	client     *mobile.DnsttClient
-	clientLock sync.Mutex
-	lastError  string
+	// The client of dnstt_create_client and the other functions without a
+	// handle, 0 if none
+	legacyHandle int64
+	legacyLock   sync.Mutex
+
+	// The error of the last call that failed, other than those on a handle
+	lastError     string
+	lastErrorLock sync.Mutex
 
 	// For testing - use a different port range to avoid conflicts
 	testPortCounter int = 17000
 	testPortLock    sync.Mutex
 )
 
+// The stats of a client that does not exist
+const emptyStats = `{"bytes_sent":0,"bytes_received":0,"queries_sent":0,"responses_received":0}`
+
+// setLastError records err for dnstt_get_last_error.
+func setLastError(err string) {
+	lastErrorLock.Lock()
+	defer lastErrorLock.Unlock()
+	lastError = err
+}
+
+// dnstt_create_client and the functions below it, down to dnstt_get_stats,
+// work on a single client, which each call of dnstt_create_client replaces.
+// They are kept for callers that predate handles; dnstt_client_new and the
+// other dnstt_client_ functions allow several clients at once.
+
 //export dnstt_create_client
 func dnstt_create_client(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C.char, listenAddr *C.char) C.int {
-	clientLock.Lock()
-	defer clientLock.Unlock()
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
 
 	// Clean up existing client if any
-	if client != nil {
+	if legacyHandle != 0 {
 		log.Printf("Stopping existing client before creating new one")
-		client.Stop()
-		client = nil
+		freeInstance(legacyHandle)
+		legacyHandle = 0
 	}
 
-	c, err := mobile.NewClient(
+	h := newInstance(
 		C.GoString(dnsServer),
 		C.GoString(tunnelDomain),
 		C.GoString(pubKeyHex),
 		C.GoString(listenAddr),
 	)
-	if err != nil {
-		lastError = fmt.Sprintf("failed to create client: %v", err)
+	if h == 0 {
 		return -1
 	}
 
-	client = c
-	log.Printf("dnstt client created")
+	legacyHandle = h
 	return 0
 }
 
 //export dnstt_start
 func dnstt_start() C.int {
-	clientLock.Lock()
-	defer clientLock.Unlock()
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
 
-	if client == nil {
-		lastError = "client not created"
+	if legacyHandle == 0 {
+		setLastError("client not created")
 		return -1
 	}
 
-	err := client.Start()
-	if err != nil {
-		lastError = fmt.Sprintf("failed to start: %v", err)
+	if err := startInstance(legacyHandle); err != nil {
+		setLastError(err.Error())
 		return -1
 	}
-
-	log.Printf("dnstt client started")
 	return 0
 }
 
 //export dnstt_stop
 func dnstt_stop() C.int {
-	clientLock.Lock()
-	defer clientLock.Unlock()
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
 
-	if client == nil {
+	if legacyHandle == 0 {
 		return 0
 	}
 
-	client.Stop()
-	client = nil
-	log.Printf("dnstt client stopped")
+	freeInstance(legacyHandle)
+	legacyHandle = 0
 	return 0
 }
 
 //export dnstt_is_running
 func dnstt_is_running() C.bool {
-	clientLock.Lock()
-	defer clientLock.Unlock()
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
 
-	if client == nil {
+	if legacyHandle == 0 {
 		return C.bool(false)
 	}
-	return C.bool(client.IsRunning())
+	return C.bool(instanceRunning(legacyHandle))
+}
+
+//export dnstt_get_state
+// dnstt_get_state returns the state of the client, one of "stopped",
+// "disconnected", "connecting", "handshaking", "connected", or
+// "reconnecting". The string must be freed with dnstt_free_string.
+func dnstt_get_state() *C.char {
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
+
+	if legacyHandle == 0 {
+		return C.CString(mobile.StateStopped)
+	}
+	return C.CString(instanceState(legacyHandle))
+}
+
+//export dnstt_get_stats
+// dnstt_get_stats returns the traffic since the client was started, as a JSON
+// object with the fields bytes_sent, bytes_received, queries_sent, and
+// responses_received. The string must be freed with dnstt_free_string.
+func dnstt_get_stats() *C.char {
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
+
+	if legacyHandle == 0 {
+		return C.CString(emptyStats)
+	}
+	return C.CString(instanceStats(legacyHandle))
 }
 
 //export dnstt_get_last_error
+// dnstt_get_last_error returns the error of the last call that failed, other
+// than the dnstt_client_ functions that take a handle, whose errors are kept
+// apart for dnstt_client_get_last_error. The string must be freed with
+// dnstt_free_string.
 func dnstt_get_last_error() *C.char {
+	lastErrorLock.Lock()
+	defer lastErrorLock.Unlock()
 	return C.CString(lastError)
 }
 
@@ -116,6 +170,62 @@ func dnstt_free_string(s *C.char) {
 	C.free(unsafe.Pointer(s))
 }
 
+// logCallback is a mobile.LogListener that calls a C function.
+type logCallback struct {
+	cb C.dnstt_log_callback
+}
+
+func (l logCallback) OnLog(level, tag, message string) {
+	cLevel := C.CString(level)
+	cTag := C.CString(tag)
+	cMessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cLevel))
+	defer C.free(unsafe.Pointer(cTag))
+	defer C.free(unsafe.Pointer(cMessage))
+	C.dnstt_call_log_callback(l.cb, cLevel, cTag, cMessage)
+}
+
+//export dnstt_set_log_callback
+// dnstt_set_log_callback sets a function to be called with every log message,
+// or removes it if cb is NULL. It is called from a thread of its own, with
+// the level ("debug", "info", "warn", or "error"), the subsystem
+// ("transport", "kcp", "noise", "stream", "proxy", or "app"), and the message.
+// The strings are only valid during the call.
+func dnstt_set_log_callback(cb C.dnstt_log_callback) {
+	if cb == nil {
+		mobile.SetLogListener(nil)
+		return
+	}
+	mobile.SetLogListener(logCallback{cb})
+}
+
+//export dnstt_set_log_level
+// dnstt_set_log_level discards log messages below level, one of "debug",
+// "info", "warn", or "error". Returns 0 on success, -1 on error.
+func dnstt_set_log_level(level *C.char) C.int {
+	err := mobile.SetLogLevel(C.GoString(level))
+	if err != nil {
+		setLastError(err.Error())
+		return -1
+	}
+	return 0
+}
+
+//export dnstt_export_logs
+// dnstt_export_logs returns the most recent log messages, one per line, for a
+// bug report. The string must be freed with dnstt_free_string.
+func dnstt_export_logs() *C.char {
+	return C.CString(mobile.ExportLogs())
+}
+
+// testFailed records and logs the failure of dnstt_test_dns_server, and
+// returns -1.
+func testFailed(err string) C.int {
+	setLastError(err)
+	log.Printf("Test failed: %s", err)
+	return -1
+}
+
 // getNextTestPort returns a unique port for testing
 func getNextTestPort() int {
 	testPortLock.Lock()
@@ -133,6 +243,8 @@ func getNextTestPort() int {
 // 1. Creating a temporary dnstt client
 // 2. Making an HTTP request through the SOCKS5 proxy
 // 3. Returns latency in milliseconds on success, -1 on failure
+// It blocks for as long as the test takes; dnstt_scan_start tests many
+// resolvers in the background, and needs no URL.
 func dnstt_test_dns_server(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C.char, testUrl *C.char, timeoutMs C.int) C.int {
 	dns := C.GoString(dnsServer)
 	domain := C.GoString(tunnelDomain)
@@ -149,17 +261,13 @@ func dnstt_test_dns_server(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C
 	// Create temporary client
 	testClient, err := mobile.NewClient(dns, domain, pubKey, listenAddr)
 	if err != nil {
-		lastError = fmt.Sprintf("failed to create test client: %v", err)
-		log.Printf("Test failed: %s", lastError)
-		return -1
+		return testFailed(fmt.Sprintf("failed to create test client: %v", err))
 	}
 
 	// Start the client
 	err = testClient.Start()
 	if err != nil {
-		lastError = fmt.Sprintf("failed to start test client: %v", err)
-		log.Printf("Test failed: %s", lastError)
-		return -1
+		return testFailed(fmt.Sprintf("failed to start test client: %v", err))
 	}
 
 	// Ensure cleanup
@@ -174,9 +282,7 @@ func dnstt_test_dns_server(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C
 	// Create SOCKS5 dialer
 	dialer, err := proxy.SOCKS5("tcp", listenAddr, nil, proxy.Direct)
 	if err != nil {
-		lastError = fmt.Sprintf("failed to create SOCKS5 dialer: %v", err)
-		log.Printf("Test failed: %s", lastError)
-		return -1
+		return testFailed(fmt.Sprintf("failed to create SOCKS5 dialer: %v", err))
 	}
 
 	// Create HTTP client with SOCKS5 proxy
@@ -194,18 +300,14 @@ func dnstt_test_dns_server(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C
 	start := time.Now()
 	resp, err := httpClient.Get(url)
 	if err != nil {
-		lastError = fmt.Sprintf("HTTP request failed: %v", err)
-		log.Printf("Test failed: %s", lastError)
-		return -1
+		return testFailed(fmt.Sprintf("HTTP request failed: %v", err))
 	}
 	defer resp.Body.Close()
 
 	// Read response body to ensure full round-trip
 	_, err = io.ReadAll(resp.Body)
 	if err != nil {
-		lastError = fmt.Sprintf("failed to read response: %v", err)
-		log.Printf("Test failed: %s", lastError)
-		return -1
+		return testFailed(fmt.Sprintf("failed to read response: %v", err))
 	}
 
 	latency := time.Since(start)
@@ -215,9 +317,7 @@ func dnstt_test_dns_server(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C
 		return C.int(latency.Milliseconds())
 	}
 
-	lastError = fmt.Sprintf("HTTP status %d", resp.StatusCode)
-	log.Printf("Test failed: %s", lastError)
-	return -1
+	return testFailed(fmt.Sprintf("HTTP status %d", resp.StatusCode))
 }
 
 func main() {}
@@ -0,0 +1,298 @@
+package main
+
+/*
+#include <stdint.h>
+#include <stdbool.h>
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/mobile"
+)
+
+// instance is a client created by dnstt_client_new, with the error of the last
+// call on it that failed.
+type instance struct {
+	client *mobile.DnsttClient
+	lock   sync.Mutex // Serializes starting and stopping client
+
+	errorLock sync.Mutex
+	lastError string
+}
+
+// fail records err as the error of the last call on the instance that
+// failed, for dnstt_client_get_last_error, and returns it.
+func (inst *instance) fail(err error) error {
+	inst.errorLock.Lock()
+	defer inst.errorLock.Unlock()
+	inst.lastError = err.Error()
+	return err
+}
+
+// err returns the error recorded by fail.
+func (inst *instance) err() string {
+	inst.errorLock.Lock()
+	defer inst.errorLock.Unlock()
+	return inst.lastError
+}
+
+var (
+	// The clients made by dnstt_client_new, by handle. Handles start at 1
+	// and are never reused, so that a stale handle is never taken for a
+	// newer client.
+	instances           = make(map[int64]*instance)
+	nextHandle    int64 = 1
+	instancesLock sync.Mutex
+)
+
+// The functions below do the work of the dnstt_client_ functions, with Go
+// types in place of C types.
+
+// errNoClient is the error of a call on handle h when there is no such client.
+func errNoClient(h int64) error {
+	return fmt.Errorf("no client with handle %d", h)
+}
+
+// lookup returns the instance with handle h, or nil if there is none.
+func lookup(h int64) *instance {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	return instances[h]
+}
+
+// newInstance creates a client as mobile.NewClient does, and returns its
+// handle, or 0 with the error recorded for dnstt_get_last_error.
+func newInstance(dnsServer, tunnelDomain, pubKeyHex, listenAddr string) int64 {
+	c, err := mobile.NewClient(dnsServer, tunnelDomain, pubKeyHex, listenAddr)
+	if err != nil {
+		setLastError(fmt.Sprintf("failed to create client: %v", err))
+		return 0
+	}
+	return addInstance(c)
+}
+
+// newInstanceFromJSON creates a client as mobile.NewClientFromJSON does, and
+// returns its handle, or 0 with the problems with configJSON recorded for
+// dnstt_get_last_error.
+func newInstanceFromJSON(configJSON string) int64 {
+	c, err := mobile.NewClientFromJSON(configJSON)
+	if err != nil {
+		if _, ok := err.(mobile.ConfigErrors); !ok {
+			err = mobile.ConfigErrors{{Message: err.Error()}}
+		}
+		setLastError(err.Error())
+		return 0
+	}
+	return addInstance(c)
+}
+
+// addInstance gives c a handle, and returns it.
+func addInstance(c *mobile.DnsttClient) int64 {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	h := nextHandle
+	nextHandle++
+	instances[h] = &instance{client: c}
+	logging.App.Infof("dnstt client %d created", h)
+	return h
+}
+
+// freeInstance stops the client with handle h, if any, and forgets the handle.
+func freeInstance(h int64) {
+	instancesLock.Lock()
+	inst := instances[h]
+	delete(instances, h)
+	instancesLock.Unlock()
+	if inst == nil {
+		return
+	}
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+	inst.client.Stop()
+	logging.App.Infof("dnstt client %d freed", h)
+}
+
+// setSSH sets the SSH settings of the client with handle h.
+func setSSH(h int64, username, password, privateKey, passphrase, hostKey string) error {
+	inst := lookup(h)
+	if inst == nil {
+		return errNoClient(h)
+	}
+	err := inst.client.SetSSH(username, password, privateKey, passphrase, hostKey)
+	if err != nil {
+		return inst.fail(err)
+	}
+	return nil
+}
+
+// startInstance starts the client with handle h.
+func startInstance(h int64) error {
+	inst := lookup(h)
+	if inst == nil {
+		return errNoClient(h)
+	}
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+
+	err := inst.client.Start()
+	if err != nil {
+		return inst.fail(fmt.Errorf("failed to start: %v", err))
+	}
+	logging.App.Infof("dnstt client %d started", h)
+	return nil
+}
+
+// stopInstance stops the client with handle h.
+func stopInstance(h int64) error {
+	inst := lookup(h)
+	if inst == nil {
+		return errNoClient(h)
+	}
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+
+	inst.client.Stop()
+	logging.App.Infof("dnstt client %d stopped", h)
+	return nil
+}
+
+// instanceRunning returns whether the client with handle h is running.
+func instanceRunning(h int64) bool {
+	inst := lookup(h)
+	if inst == nil {
+		return false
+	}
+	return inst.client.IsRunning()
+}
+
+// instanceState returns the state of the client with handle h.
+func instanceState(h int64) string {
+	inst := lookup(h)
+	if inst == nil {
+		return mobile.StateStopped
+	}
+	return inst.client.GetState()
+}
+
+// instanceStats returns the traffic of the client with handle h, as JSON.
+func instanceStats(h int64) string {
+	inst := lookup(h)
+	if inst == nil {
+		return emptyStats
+	}
+	return inst.client.GetStats()
+}
+
+// instanceError returns the error of the last call on the client with handle h
+// that failed.
+func instanceError(h int64) string {
+	inst := lookup(h)
+	if inst == nil {
+		return errNoClient(h).Error()
+	}
+	return inst.err()
+}
+
+// status returns the result of a dnstt_client_ function that fails with err:
+// 0 if err is nil, or -1.
+func status(err error) C.int {
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+//export dnstt_client_new
+// dnstt_client_new creates a client, as mobile.NewClient does, and returns a
+// handle to it, to be passed to the other dnstt_client_ functions. Returns 0
+// on error, which dnstt_get_last_error then describes. Any number of clients
+// may exist at once, each with a listenAddr of its own. A client is not
+// started until dnstt_client_start, and must be released with
+// dnstt_client_free.
+func dnstt_client_new(dnsServer *C.char, tunnelDomain *C.char, pubKeyHex *C.char, listenAddr *C.char) C.int64_t {
+	return C.int64_t(newInstance(
+		C.GoString(dnsServer),
+		C.GoString(tunnelDomain),
+		C.GoString(pubKeyHex),
+		C.GoString(listenAddr),
+	))
+}
+
+//export dnstt_create_client_json
+// dnstt_create_client_json creates a client from a configuration document, as
+// mobile.NewClientFromJSON does, and returns a handle to it, like
+// dnstt_client_new. Returns 0 on error. dnstt_get_last_error then returns
+// the problems with the document as a JSON array of objects with the fields
+// field (like "resolvers[1]", or "" for the document as a whole) and message.
+func dnstt_create_client_json(configJSON *C.char) C.int64_t {
+	return C.int64_t(newInstanceFromJSON(C.GoString(configJSON)))
+}
+
+//export dnstt_client_set_ssh
+// dnstt_client_set_ssh makes the client with handle h reach its destinations
+// through an SSH server that is the tunnel server's upstream, as
+// mobile.DnsttClient.SetSSH does; an empty username disables SSH. privateKey
+// and password may each be empty. hostKey is the server's key or its
+// "SHA256:" fingerprint; when it is empty or wrong, dnstt_client_start fails
+// with an error that tells the server's fingerprint. Takes effect at the next
+// dnstt_client_start. Returns 0 on success, -1 on error.
+func dnstt_client_set_ssh(h C.int64_t, username *C.char, password *C.char, privateKey *C.char, passphrase *C.char, hostKey *C.char) C.int {
+	return status(setSSH(int64(h),
+		C.GoString(username),
+		C.GoString(password),
+		C.GoString(privateKey),
+		C.GoString(passphrase),
+		C.GoString(hostKey),
+	))
+}
+
+//export dnstt_client_start
+// dnstt_client_start starts the client with handle h. Returns 0 on success,
+// -1 on error, which dnstt_client_get_last_error then describes.
+func dnstt_client_start(h C.int64_t) C.int {
+	return status(startInstance(int64(h)))
+}
+
+//export dnstt_client_stop
+// dnstt_client_stop stops the client with handle h, which may be started
+// again. Returns 0, or -1 if there is no such client.
+func dnstt_client_stop(h C.int64_t) C.int {
+	return status(stopInstance(int64(h)))
+}
+
+//export dnstt_client_free
+// dnstt_client_free stops the client with handle h, if it is running, and
+// releases it. The handle is not valid afterward.
+func dnstt_client_free(h C.int64_t) {
+	freeInstance(int64(h))
+}
+
+//export dnstt_client_is_running
+func dnstt_client_is_running(h C.int64_t) C.bool {
+	return C.bool(instanceRunning(int64(h)))
+}
+
+//export dnstt_client_get_state
+// dnstt_client_get_state returns the state of the client with handle h, as
+// dnstt_get_state does. The string must be freed with dnstt_free_string.
+func dnstt_client_get_state(h C.int64_t) *C.char {
+	return C.CString(instanceState(int64(h)))
+}
+
+//export dnstt_client_get_stats
+// dnstt_client_get_stats returns the traffic of the client with handle h, as
+// dnstt_get_stats does. The string must be freed with dnstt_free_string.
+func dnstt_client_get_stats(h C.int64_t) *C.char {
+	return C.CString(instanceStats(int64(h)))
+}
+
+//export dnstt_client_get_last_error
+// dnstt_client_get_last_error returns the error of the last call on the
+// client with handle h that failed, or "" if none has. Errors of one client
+// do not affect another. The string must be freed with dnstt_free_string.
+func dnstt_client_get_last_error(h C.int64_t) *C.char {
+	return C.CString(instanceError(int64(h)))
+}
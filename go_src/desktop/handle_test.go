@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/mobile"
+)
+
+const testPubkey = "0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff"
+
+// newLazyInstance creates a client in lazy mode, which starts without
+// reaching the tunnel server, and returns its handle.
+func newLazyInstance(t *testing.T, listenAddr string) int64 {
+	t.Helper()
+	h := newInstance("127.0.0.1:53", "t.example.com", testPubkey, listenAddr)
+	if h == 0 {
+		t.Fatal("newInstance failed")
+	}
+	lookup(h).client.SetLazy(true)
+	return h
+}
+
+// Two clients on separate handles start and stop independently.
+func TestInstancesSeparate(t *testing.T) {
+	h1 := newLazyInstance(t, "127.0.0.1:0")
+	defer freeInstance(h1)
+	h2 := newLazyInstance(t, "127.0.0.1:0")
+	defer freeInstance(h2)
+	if h1 == h2 || lookup(h1) == lookup(h2) {
+		t.Fatalf("handles %d and %d are the same client", h1, h2)
+	}
+
+	for _, h := range []int64{h1, h2} {
+		if err := startInstance(h); err != nil {
+			t.Fatalf("client %d: %v", h, err)
+		}
+	}
+	if err := stopInstance(h1); err != nil {
+		t.Fatal(err)
+	}
+	if instanceRunning(h1) || instanceState(h1) != mobile.StateStopped {
+		t.Errorf("client %d is %s after stopping", h1, instanceState(h1))
+	}
+	if !instanceRunning(h2) || instanceState(h2) == mobile.StateStopped {
+		t.Errorf("client %d is %s after stopping client %d", h2, instanceState(h2), h1)
+	}
+}
+
+// The error of a call on one handle is not seen on another, nor as the
+// error of the calls without a handle.
+func TestInstanceErrors(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	h1 := newLazyInstance(t, busy.Addr().String())
+	defer freeInstance(h1)
+	h2 := newLazyInstance(t, "127.0.0.1:0")
+	defer freeInstance(h2)
+	setLastError("")
+
+	err = startInstance(h1)
+	if err == nil {
+		t.Fatal("started a client on a busy address")
+	}
+	if instanceError(h1) != err.Error() {
+		t.Errorf("client %d: error %+q, expected %+q", h1, instanceError(h1), err)
+	}
+	if err := startInstance(h2); err != nil {
+		t.Fatal(err)
+	}
+	if e := instanceError(h2); e != "" {
+		t.Errorf("client %d: error %+q", h2, e)
+	}
+	if err := setSSH(h2, "user", "", "", "", "not a key"); err == nil {
+		t.Fatal("setSSH accepted a bad host key")
+	}
+	if instanceError(h1) != err.Error() {
+		t.Errorf("client %d: error %+q after a failure of client %d", h1, instanceError(h1), h2)
+	}
+	if lastError != "" {
+		t.Errorf("error %+q recorded outside the handles", lastError)
+	}
+}
+
+// Calls on a handle that was freed fail, or answer as for a stopped client,
+// and freeing it again does nothing.
+func TestInstanceStale(t *testing.T) {
+	h := newLazyInstance(t, "127.0.0.1:0")
+	other := newLazyInstance(t, "127.0.0.1:0")
+	defer freeInstance(other)
+	if err := startInstance(h); err != nil {
+		t.Fatal(err)
+	}
+	freeInstance(h)
+	freeInstance(h)
+
+	if lookup(h) != nil {
+		t.Fatalf("client %d still exists", h)
+	}
+	if err := startInstance(h); err == nil {
+		t.Error("started a freed client")
+	}
+	if err := stopInstance(h); err == nil {
+		t.Error("stopped a freed client")
+	}
+	if err := setSSH(h, "", "", "", "", ""); err == nil {
+		t.Error("set SSH on a freed client")
+	}
+	if instanceRunning(h) || instanceState(h) != mobile.StateStopped || instanceStats(h) != emptyStats {
+		t.Errorf("freed client is %s, with stats %s", instanceState(h), instanceStats(h))
+	}
+	if e := instanceError(h); !strings.Contains(e, "no client") {
+		t.Errorf("error %+q", e)
+	}
+
+	// The other client is unaffected, and handles are not reused.
+	if lookup(other) == nil {
+		t.Errorf("client %d was freed with client %d", other, h)
+	}
+	h2 := newLazyInstance(t, "127.0.0.1:0")
+	defer freeInstance(h2)
+	if h2 == h || h2 == other {
+		t.Errorf("handle %d was reused", h2)
+	}
+}
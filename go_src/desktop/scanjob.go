@@ -0,0 +1,276 @@
+package main
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+
+typedef void (*dnstt_scan_callback)(int64_t job, const char *result);
+
+static void dnstt_call_scan_callback(dnstt_scan_callback cb, int64_t job, const char *result) {
+	cb(job, result);
+}
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+)
+
+// scanCallback is called with the handle of a scan job and the result of
+// each resolver as it is known, then with "" once the job is done.
+type scanCallback func(h int64, result string)
+
+// scanJob is a scan started by dnstt_scan_start.
+type scanJob struct {
+	id     int64
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	cbLock sync.Mutex // Held during every call of cb
+	cb     scanCallback
+
+	lock    sync.Mutex
+	results []json.RawMessage // Not yet returned by dnstt_scan_poll
+	done    bool
+	err     string
+}
+
+// add records r and passes it to the callback.
+func (j *scanJob) add(r client.ScanResult) {
+	result, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	j.lock.Lock()
+	j.results = append(j.results, json.RawMessage(result))
+	j.lock.Unlock()
+	j.callback(string(result))
+}
+
+// callback calls the job's callback, if any, with result.
+func (j *scanJob) callback(result string) {
+	j.cbLock.Lock()
+	defer j.cbLock.Unlock()
+	if j.cb != nil {
+		j.cb(j.id, result)
+	}
+}
+
+// run does the scan, then marks the job done.
+func (j *scanJob) run(ep client.Endpoint, resolvers []string, transportOpts client.TransportOptions, opts client.ScanOptions) {
+	defer j.cancel()
+	opts.Progress = j.add
+	_, err := client.Scan(j.ctx, ep, resolvers, transportOpts, opts)
+	j.lock.Lock()
+	j.done = true
+	if err != nil {
+		j.err = fmt.Sprintf("scan failed: %v", err)
+	}
+	j.lock.Unlock()
+	logging.App.Infof("scan %d done", j.id)
+	j.callback("")
+}
+
+var (
+	// The scans started by dnstt_scan_start, by job handle. As with client
+	// handles, job handles start at 1 and are never reused.
+	scanJobs           = make(map[int64]*scanJob)
+	nextScanJob  int64 = 1
+	scanJobsLock sync.Mutex
+)
+
+// The functions below do the work of the dnstt_scan_ functions, with Go types
+// in place of C types.
+
+// lookupScanJob returns the job with handle h, or nil if there is none.
+func lookupScanJob(h int64) *scanJob {
+	scanJobsLock.Lock()
+	defer scanJobsLock.Unlock()
+	return scanJobs[h]
+}
+
+// newScanJob gives a new job a handle, and returns it. The job's context
+// exists before cancelScanJob can be called, so that no cancellation is lost.
+func newScanJob(cb scanCallback) *scanJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &scanJob{ctx: ctx, cancel: cancel, cb: cb}
+	scanJobsLock.Lock()
+	defer scanJobsLock.Unlock()
+	j.id = nextScanJob
+	nextScanJob++
+	scanJobs[j.id] = j
+	return j
+}
+
+// startScanJob starts a scan job, as dnstt_scan_start describes, and returns
+// its handle.
+func startScanJob(resolvers, tunnelDomain, pubKeyHex, mode string, workers int, timeout time.Duration, cb scanCallback) (int64, error) {
+	pubKey, err := noise.DecodeKey(pubKeyHex)
+	if err != nil {
+		return 0, fmt.Errorf("invalid public key: %v", err)
+	}
+	domains, err := dns.ParseNames(tunnelDomain)
+	if err != nil {
+		return 0, fmt.Errorf("invalid domain: %v", err)
+	}
+	specs, err := client.ExpandResolvers(strings.FieldsFunc(resolvers, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}))
+	if err != nil {
+		return 0, err
+	}
+	if len(specs) == 0 {
+		return 0, fmt.Errorf("no resolvers")
+	}
+	utlsClientHelloID, err := client.SampleUTLSDistribution(client.DefaultUTLSDistribution)
+	if err != nil {
+		return 0, err
+	}
+	switch mode {
+	case "", client.ScanData, client.ScanHandshake, client.ScanEcho:
+	default:
+		return 0, fmt.Errorf("unknown scan mode %+q", mode)
+	}
+	opts := client.ScanOptions{
+		Workers: workers,
+		Timeout: timeout,
+		Mode:    mode,
+	}
+
+	j := newScanJob(cb)
+	logging.App.Infof("scan %d started for %d resolvers", j.id, len(specs))
+	go j.run(client.Endpoint{Domains: domains, Pubkey: pubKey}, specs,
+		client.TransportOptions{UTLSClientHelloID: utlsClientHelloID}, opts)
+	return j.id, nil
+}
+
+// pollScanJob returns the progress of the scan job h, as dnstt_scan_poll
+// describes.
+func pollScanJob(h int64) (string, error) {
+	j := lookupScanJob(h)
+	if j == nil {
+		return "", fmt.Errorf("no scan with handle %d", h)
+	}
+	j.lock.Lock()
+	progress := struct {
+		Done    bool              `json:"done"`
+		Error   string            `json:"error,omitempty"`
+		Results []json.RawMessage `json:"results"`
+	}{j.done, j.err, j.results}
+	j.results = nil
+	j.lock.Unlock()
+	if progress.Results == nil {
+		progress.Results = []json.RawMessage{}
+	}
+	text, err := json.Marshal(progress)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// cancelScanJob stops the scan job h, if there is one.
+func cancelScanJob(h int64) {
+	if j := lookupScanJob(h); j != nil {
+		j.cancel()
+	}
+}
+
+// freeScanJob cancels the scan job h and forgets it. Its callback is not
+// called after freeScanJob returns.
+func freeScanJob(h int64) {
+	scanJobsLock.Lock()
+	j := scanJobs[h]
+	delete(scanJobs, h)
+	scanJobsLock.Unlock()
+	if j == nil {
+		return
+	}
+	j.cancel()
+	j.cbLock.Lock()
+	j.cb = nil
+	j.cbLock.Unlock()
+}
+
+//export dnstt_scan_start
+// dnstt_scan_start starts testing many resolvers at once, as
+// mobile.Scanner.Scan does, in the background, and returns a handle to the job
+// at once, or 0 on error, which dnstt_get_last_error then describes. resolvers
+// is a list separated by commas or newlines, which may include CIDR ranges.
+// workers is how many are tested at once, and timeoutMs how long each test may
+// take; 0 means the default. mode is "data", "handshake", or "echo", as for
+// mobile.Scanner.SetMode; "echo" needs no more than the tunnel and an echo
+// server as the server's upstream, which must have at least the default -mtu,
+// and "" means "data". cb, if not NULL, is called from a thread of its own
+// with the job handle and the result of each resolver as it is known, a JSON
+// object as described by mobile.Scanner.Scan, and finally with a NULL result
+// once the job is done. The result string is only valid during the call.
+// Results can also be had with dnstt_scan_poll. The job must be released with
+// dnstt_scan_free.
+func dnstt_scan_start(resolvers *C.char, tunnelDomain *C.char, pubKeyHex *C.char, mode *C.char, workers C.int, timeoutMs C.int, cb C.dnstt_scan_callback) C.int64_t {
+	var callback scanCallback
+	if cb != nil {
+		callback = func(h int64, result string) {
+			var cResult *C.char
+			if result != "" {
+				cResult = C.CString(result)
+				defer C.free(unsafe.Pointer(cResult))
+			}
+			C.dnstt_call_scan_callback(cb, C.int64_t(h), cResult)
+		}
+	}
+	h, err := startScanJob(
+		C.GoString(resolvers),
+		C.GoString(tunnelDomain),
+		C.GoString(pubKeyHex),
+		C.GoString(mode),
+		int(workers),
+		time.Duration(timeoutMs)*time.Millisecond,
+		callback,
+	)
+	if err != nil {
+		setLastError(err.Error())
+		return 0
+	}
+	return C.int64_t(h)
+}
+
+//export dnstt_scan_poll
+// dnstt_scan_poll returns the progress of the scan job h, as a JSON object
+// with the fields done (whether the job is over), error (why the scan failed
+// as a whole, if it did), and results (an array of the results that have come
+// since the last call, in the form of dnstt_scan_start). It returns NULL
+// if there is no such job. The string must be freed with dnstt_free_string.
+func dnstt_scan_poll(h C.int64_t) *C.char {
+	progress, err := pollScanJob(int64(h))
+	if err != nil {
+		setLastError(err.Error())
+		return nil
+	}
+	return C.CString(progress)
+}
+
+//export dnstt_scan_cancel
+// dnstt_scan_cancel stops the scan job h. The resolvers not yet tested get
+// results that say so, and the job is then done.
+func dnstt_scan_cancel(h C.int64_t) {
+	cancelScanJob(int64(h))
+}
+
+//export dnstt_scan_free
+// dnstt_scan_free cancels the scan job h, if it is not done, and releases it.
+// Its callback is not called after dnstt_scan_free returns, so
+// dnstt_scan_free must not be called from the callback itself.
+func dnstt_scan_free(h C.int64_t) {
+	freeScanJob(int64(h))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+)
+
+// callbackCounter is a scanCallback that counts its calls.
+type callbackCounter struct {
+	lock    sync.Mutex
+	results int
+	done    int
+	doneCh  chan struct{}
+}
+
+func newCallbackCounter() *callbackCounter {
+	return &callbackCounter{doneCh: make(chan struct{}, 1)}
+}
+
+func (c *callbackCounter) callback(h int64, result string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if result == "" {
+		c.done++
+		select {
+		case c.doneCh <- struct{}{}:
+		default:
+		}
+	} else {
+		c.results++
+	}
+}
+
+func (c *callbackCounter) counts() (int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.results, c.done
+}
+
+// deadResolvers returns n resolvers that receive queries, but never respond.
+func deadResolvers(t *testing.T, n int) []string {
+	var resolvers []string
+	for i := 0; i < n; i++ {
+		resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resolver.Close() })
+		resolvers = append(resolvers, resolver.LocalAddr().String())
+	}
+	return resolvers
+}
+
+// progress is the parsed form of what pollScanJob returns.
+type progress struct {
+	Done    bool                `json:"done"`
+	Results []client.ScanResult `json:"results"`
+}
+
+func poll(t *testing.T, h int64) progress {
+	t.Helper()
+	text, err := pollScanJob(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p progress
+	if err := json.Unmarshal([]byte(text), &p); err != nil {
+		t.Fatalf("%s: %v", text, err)
+	}
+	return p
+}
+
+// A job canceled before it starts finishes at once, with every resolver
+// failed, and calls its callback once when done.
+func TestScanJobCancelBeforeStart(t *testing.T) {
+	resolvers := deadResolvers(t, 3)
+	ep, err := client.ParseEndpoint("t.example.com=" + testPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := newCallbackCounter()
+	j := newScanJob(cb.callback)
+	defer freeScanJob(j.id)
+	cancelScanJob(j.id)
+
+	start := time.Now()
+	j.run(ep, resolvers, client.TransportOptions{}, client.ScanOptions{Timeout: time.Minute})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("canceled job took %v", d)
+	}
+	p := poll(t, j.id)
+	if !p.Done || len(p.Results) != len(resolvers) {
+		t.Fatalf("progress %+v", p)
+	}
+	for _, r := range p.Results {
+		if r.OK {
+			t.Errorf("result %+v", r)
+		}
+	}
+	if results, done := cb.counts(); results != len(resolvers) || done != 1 {
+		t.Errorf("callback got %d results and %d done", results, done)
+	}
+}
+
+// Canceling a job that is done changes nothing, and its callback is not
+// called again.
+func TestScanJobCancelAfterDone(t *testing.T) {
+	resolvers := deadResolvers(t, 1)
+	cb := newCallbackCounter()
+	h, err := startScanJob(strings.Join(resolvers, ","), "t.example.com", testPubkey, "", 0, 200*time.Millisecond, cb.callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freeScanJob(h)
+	select {
+	case <-cb.doneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job not done")
+	}
+	p := poll(t, h)
+	if !p.Done || len(p.Results) != 1 || p.Results[0].OK {
+		t.Fatalf("progress %+v", p)
+	}
+
+	cancelScanJob(h)
+	time.Sleep(100 * time.Millisecond)
+	if p := poll(t, h); !p.Done || len(p.Results) != 0 {
+		t.Errorf("progress after cancel %+v", p)
+	}
+	if results, done := cb.counts(); results != 1 || done != 1 {
+		t.Errorf("callback got %d results and %d done", results, done)
+	}
+}
+
+// A job that is freed cannot be polled or canceled, and its callback is not
+// called again, even as the job winds down.
+func TestScanJobFree(t *testing.T) {
+	resolvers := deadResolvers(t, 2)
+	cb := newCallbackCounter()
+	h, err := startScanJob(strings.Join(resolvers, "\n"), "t.example.com", testPubkey, "", 1, time.Minute, cb.callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := lookupScanJob(h)
+	freeScanJob(h)
+	freeScanJob(h)
+	cancelScanJob(h)
+	if _, err := pollScanJob(h); err == nil {
+		t.Error("polled a freed job")
+	}
+
+	// Freeing canceled the job, which ends soon.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j.lock.Lock()
+		done := j.done
+		j.lock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("freed job did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if results, done := cb.counts(); results != 0 || done != 0 {
+		t.Errorf("callback got %d results and %d done after free", results, done)
+	}
+}
+
+// Jobs that cannot start return an error, and no handle.
+func TestScanJobStartErrors(t *testing.T) {
+	for _, test := range []struct {
+		resolvers, domain, pubkey, mode string
+	}{
+		{"192.0.2.1", "t.example.com", "xx", ""},
+		{"192.0.2.1", "t..example.com", testPubkey, ""},
+		{"", "t.example.com", testPubkey, ""},
+		{"192.0.2.1", "t.example.com", testPubkey, "bogus"},
+	} {
+		h, err := startScanJob(test.resolvers, test.domain, test.pubkey, test.mode, 0, 0, nil)
+		if err == nil || h != 0 {
+			t.Errorf("%+v: handle %d, error %v", test, h, err)
+			freeScanJob(h)
+		}
+	}
+}
@@ -46,6 +46,7 @@ var (
 
 const (
 	// https://tools.ietf.org/html/rfc1035#section-3.2.2
+	RRTypeNS  = 2
 	RRTypeTXT = 16
 	// https://tools.ietf.org/html/rfc6891#section-6.1.1
 	RRTypeOPT = 41
@@ -106,6 +107,23 @@ func ParseName(s string) (Name, error) {
 	}
 }
 
+// ParseNames parses a comma-separated list of one or more names, as
+// ParseName does.
+func ParseNames(s string) ([]Name, error) {
+	var names []Name
+	for _, name := range strings.Split(s, ",") {
+		if name == "" {
+			return nil, fmt.Errorf("empty domain in %+q", s)
+		}
+		n, err := ParseName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain %+q: %v", name, err)
+		}
+		names = append(names, n)
+	}
+	return names, nil
+}
+
 // String returns a reversible string representation of name. Labels are
 // separated by dots, and any bytes in a label that are outside the set
 // [0-9A-Za-z-] are replaced with a \xXX hex escape sequence.
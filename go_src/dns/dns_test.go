@@ -138,6 +138,19 @@ func TestParseName(t *testing.T) {
 	}
 }
 
+func TestParseNames(t *testing.T) {
+	names, err := ParseNames("t.example.com,T2.example.net.")
+	if err != nil || len(names) != 2 ||
+		names[0].String() != "t.example.com" || names[1].String() != "T2.example.net" {
+		t.Errorf("got (%v, %v)", names, err)
+	}
+	for _, s := range []string{"", "t.example.com,", ",t.example.com", "t..example.com"} {
+		if _, err := ParseNames(s); err == nil {
+			t.Errorf("%+q: no error", s)
+		}
+	}
+}
+
 func unescapeString(s string) ([][]byte, error) {
 	if s == "." {
 		return [][]byte{}, nil
@@ -0,0 +1,227 @@
+// Package dnsproxy implements a local DNS server that forwards every query to
+// a resolver using DNS over TCP (RFC 7766), through a caller-supplied dial
+// function. Applications and operating systems can be pointed at the local
+// server, so that their DNS lookups go through the tunnel rather than
+// revealing their destinations outside it.
+//
+// Queries are accepted over both UDP and TCP. Each query is forwarded over its
+// own connection, so that a slow response does not hold up others.
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+const (
+	// How long to wait for the response to a query.
+	exchangeTimeout = 10 * time.Second
+	// How long to wait for the next query on a TCP connection.
+	tcpIdleTimeout = 30 * time.Second
+)
+
+// DialFunc connects to addr, a "host:port" string.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Exchange sends query to resolver using DNS over TCP, over a connection made
+// by dial, and returns the response.
+func Exchange(dial DialFunc, resolver string, query []byte) ([]byte, error) {
+	if len(query) > 0xffff {
+		return nil, errors.New("query too long")
+	}
+	c, err := dial("tcp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	err = writeMessage(c, query)
+	if err != nil {
+		return nil, err
+	}
+	return readMessage(c)
+}
+
+// writeMessage writes a length-prefixed DNS message.
+// https://tools.ietf.org/html/rfc1035#section-4.2.2
+func writeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMessage reads a length-prefixed DNS message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return msg, err
+}
+
+// Server is a local DNS server listening on UDP and TCP.
+type Server struct {
+	resolver  string
+	dial      DialFunc
+	allow     func(net.Addr) bool
+	udpConn   net.PacketConn
+	tcpLn     net.Listener
+	closeOnce sync.Once
+}
+
+// Listen starts a DNS server on the UDP and TCP ports of addr, forwarding
+// queries to resolver using dial.
+func Listen(addr, resolver string, dial DialFunc) (*Server, error) {
+	return ListenAllow(addr, resolver, dial, nil)
+}
+
+// ListenAllow is like Listen, but if allow is not nil, it ignores queries from
+// clients for whose address allow returns false.
+func ListenAllow(addr, resolver string, dial DialFunc, allow func(net.Addr) bool) (*Server, error) {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Listen on the same TCP port, which matters if addr has port 0.
+	tcpLn, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	s := &Server{
+		resolver: resolver,
+		dial:     dial,
+		allow:    allow,
+		udpConn:  udpConn,
+		tcpLn:    tcpLn,
+	}
+	go func() {
+		err := s.serveUDP()
+		if err != nil {
+			logging.Proxy.Warnf("DNS proxy: UDP: %v", err)
+		}
+	}()
+	go func() {
+		err := s.serveTCP()
+		if err != nil {
+			logging.Proxy.Warnf("DNS proxy: TCP: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.udpConn.LocalAddr()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.udpConn.Close()
+		if err2 := s.tcpLn.Close(); err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+// isClosed returns whether err results from the server being closed.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+func (s *Server) serveUDP() error {
+	var buf [65535]byte
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf[:])
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		if s.allow != nil && !s.allow(addr) {
+			continue
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			resp, err := Exchange(s.dial, s.resolver, query)
+			if err != nil {
+				logging.Proxy.Warnf("DNS proxy: query to %s: %v", s.resolver, err)
+				return
+			}
+			s.udpConn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *Server) serveTCP() error {
+	for {
+		conn, err := s.tcpLn.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		if s.allow != nil && !s.allow(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			err := s.handleTCP(conn)
+			if err != nil {
+				logging.Proxy.Warnf("DNS proxy: TCP from %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handleTCP answers the queries on a TCP connection, one at a time, until the
+// client closes the connection or is idle for tcpIdleTimeout.
+func (s *Server) handleTCP(conn net.Conn) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readMessage(conn)
+		var netErr net.Error
+		if err == io.EOF {
+			return nil
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp, err := Exchange(s.dial, s.resolver, query)
+		if err != nil {
+			return err
+		}
+		err = writeMessage(conn, resp)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoDialer returns a DialFunc for a DNS over TCP resolver that answers each
+// query with the query itself, and records the address it was asked to dial.
+func echoDialer(dialed chan<- string) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			query, err := readMessage(s)
+			if err != nil {
+				return
+			}
+			writeMessage(s, query)
+		}()
+		return c, nil
+	}
+}
+
+func TestServer(t *testing.T) {
+	dialed := make(chan string, 10)
+	s, err := Listen("127.0.0.1:0", "192.0.2.1:53", echoDialer(dialed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	query := []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x07example\x03com\x00\x00\x01\x00\x01")
+
+	// UDP.
+	udpConn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	_, err = udpConn.Write(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], query) {
+		t.Errorf("UDP response %x, expected %x", buf[:n], query)
+	}
+	if addr := <-dialed; addr != "192.0.2.1:53" {
+		t.Errorf("dialed %+q", addr)
+	}
+
+	// TCP, with two queries on one connection.
+	tcpConn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		err = writeMessage(tcpConn, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readMessage(tcpConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp, query) {
+			t.Errorf("TCP response %x, expected %x", resp, query)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	dialed := make(chan string, 10)
+	s, err := ListenAllow("127.0.0.1:0", "192.0.2.1:53", echoDialer(dialed), func(addr net.Addr) bool {
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tcpConn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeMessage(tcpConn, []byte("\x12\x34\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	if _, err := readMessage(tcpConn); err == nil {
+		t.Errorf("query from a disallowed client was answered")
+	}
+	select {
+	case addr := <-dialed:
+		t.Errorf("dialed %+q for a disallowed client", addr)
+	default:
+	}
+}
@@ -2,19 +2,26 @@
 //
 // Usage:
 //
-//	dnstt-client [-doh URL|-dot ADDR|-udp ADDR] -pubkey-file PUBKEYFILE DOMAIN LOCALADDR
+//	dnstt-client [-udp ADDR] [-dot ADDR] [-doh URL] [-doq ADDR] -pubkey-file PUBKEYFILE [-cover DURATION] [-fallback DOMAIN=PUBKEY]... [-dns ADDR] [-socks ADDR] [-http ADDR] [-tproxy ADDR] [-rules FILE] [-priority TARGET=CLASS]... DOMAIN LOCALADDR
+//	dnstt-client -scan FILE [-scan-workers N] [-scan-timeout DURATION] -pubkey-file PUBKEYFILE DOMAIN
 //
 // Examples:
 //
 //	dnstt-client -doh https://resolver.example/dns-query -pubkey-file server.pub t.example.com 127.0.0.1:7000
 //	dnstt-client -dot resolver.example:853 -pubkey-file server.pub t.example.com 127.0.0.1:7000
 //
-// The program supports DNS over HTTPS (DoH), DNS over TLS (DoT), and UDP DNS.
-// Use one of these options:
+// The program supports UDP DNS, DNS over TLS (DoT), DNS over HTTPS (DoH), and
+// DNS over QUIC (DoQ). Use one or more of these options:
 //
-//	-doh https://resolver.example/dns-query
-//	-dot resolver.example:853
 //	-udp resolver.example:53
+//	-dot resolver.example:853
+//	-doh https://resolver.example/dns-query
+//	-doq resolver.example:853
+//
+// When more than one is given, the client starts with the first in the order
+// above, and falls back to the next when no server can be reached over the
+// one in use, or when queries over it get no responses. After the last, it
+// returns to the first. Each step is logged with its reason.
 //
 // You can give the server's public key as a file or as a hex string. Use
 // "dnstt-server -gen-key" to get the public key.
@@ -23,11 +30,145 @@
 //	-pubkey 0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff
 //
 // DOMAIN is the root of the DNS zone reserved for the tunnel. See README for
-// instructions on setting it up.
+// instructions on setting it up. DOMAIN may be a comma-separated list of
+// several domains that are all delegated to the same server, for example
+// "t1.example.com,t2.example.net". Queries are then spread randomly across the
+// domains.
 //
 // LOCALADDR is the TCP address that will listen for connections and forward
 // them over the tunnel.
 //
+// You can name additional tunnel servers to use when the first one is not
+// reachable, each with its own domain and public key, using the -fallback
+// option one or more times. When the active server fails its handshake or
+// stops responding, new connections move to the next server in order. While a
+// fallback server is in use, the client periodically tries the first server
+// again and returns to it when it is reachable.
+//
+//	-fallback t2.example.net=0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff
+//
+// The -compress option offers to compress the tunnel, which helps with
+// text-heavy traffic. The server and client agree on compression during the
+// handshake. A server that does not support compression does not complete a
+// handshake that offers it; in that case the client tries again without the
+// offer, after a delay of 5 seconds.
+//
+// The -cover option enables cover traffic mode, in which the client sends
+// queries at a constant rate, whether or not there is data to send, and pads
+// every query to the same length. The rate of queries then does not reveal
+// when the tunnel is in use. The option's argument is the interval between
+// queries; it also limits the upstream bandwidth of the tunnel. With
+// -cover-random, the interval varies randomly between 0.5 and 1.5 times the
+// given value.
+//
+//	-cover 200ms
+//
+// The -random-shape option varies the structure of queries, so that they do
+// not all share one fingerprint: label lengths, letter case, the EDNS(0) UDP
+// payload size, EDNS(0) options (a client cookie and RFC 7830 padding), and
+// the AD bit are all chosen at random for each query. Random label lengths
+// cost a few bytes of MTU. Some of the advertised payload sizes are as small
+// as 1232, so the server's -mtu must not be larger than that. The -decoy-rate
+// option mixes in decoy queries of QTYPE A and AAAA, which carry no data: each
+// query is followed by a decoy with the given probability. With -cover, a decoy
+// instead takes the place of a polling query with that probability, so that the
+// rate of queries stays constant.
+//
+//	-random-shape -decoy-rate 0.2
+//
+// The -socks option opens a SOCKS5 proxy listener in addition to LOCALADDR.
+// Unlike connections to LOCALADDR, which are forwarded as they are, the client
+// handles SOCKS5 requests itself, so it knows the destination of each
+// connection, and carries it through the tunnel by making a SOCKS5 request of
+// the server's upstream, which therefore must be a SOCKS5 proxy.
+//
+//	-socks 127.0.0.1:1080
+//
+// The -http option opens an HTTP proxy listener in addition to LOCALADDR, for
+// applications that support an HTTP proxy but not SOCKS. It accepts CONNECT
+// requests and plain requests with an absolute URI. Unlike connections to
+// LOCALADDR, the client carries the target of each HTTP proxy request through
+// the tunnel in the same way as for -socks.
+//
+//	-http 127.0.0.1:8080
+//
+// On Linux, the -tproxy option opens a listener for connections that a
+// firewall has diverted to it with a REDIRECT or TPROXY rule. The client
+// recovers the original destination of each connection and carries it through
+// the tunnel in the same way as for -socks. A router can then send a whole LAN
+// through the tunnel, without configuring a proxy on each device. TPROXY rules
+// require the client to have CAP_NET_ADMIN.
+//
+//	-tproxy 0.0.0.0:7001
+//	iptables -t nat -A PREROUTING -i eth1 -p tcp -j REDIRECT --to-ports 7001
+//
+// The -dns option runs a DNS server, on both UDP and TCP, that forwards every
+// query through the tunnel to the resolver given by -dns-resolver (1.1.1.1:53
+// by default), using DNS over TCP. Pointing applications or the system at it
+// keeps DNS lookups inside the tunnel. As with -socks, the server's upstream
+// must be a SOCKS5 proxy.
+//
+//	-dns 127.0.0.1:5353 -dns-resolver 9.9.9.9:53
+//
+// The -rules option reads split tunneling rules from a file, which decide for
+// each connection of the -socks, -http, -tproxy, and -dns listeners whether it
+// goes through the tunnel, directly to its destination, or nowhere. Local and
+// domestic traffic need not use up the small capacity of the tunnel. Each line
+// is an action (tunnel, direct, or block) followed by patterns: domain names,
+// which also match their subdomains; IP addresses and CIDR prefixes; ports and
+// port ranges written after a colon; or "*" for everything. The first matching
+// rule decides, and connections that match none go through the tunnel. Names
+// are not resolved locally, so address patterns match only destinations given
+// as addresses. Connections to LOCALADDR always go through the tunnel.
+//
+//	# rules.txt
+//	direct 10.0.0.0/8 192.168.0.0/16 .lan .ir
+//	block :25
+//
+//	-socks 127.0.0.1:1080 -rules rules.txt
+//
+// The -lazy option makes the client wait until the first connection arrives
+// before connecting to the server, and disconnect again once there have been
+// no connections for the time given by -lazy-idle (1 minute by default). While
+// disconnected, the client sends no queries at all, which saves battery and
+// data on mobile networks, and leaves no constant polling pattern.
+//
+//	-lazy -lazy-idle 5m
+//
+// Streams are scheduled by priority class, so that an interactive stream, like
+// an SSH session, is not stuck behind a large download. Data of interactive
+// streams is always sent before data of bulk streams, and while both are
+// active, less bulk data is allowed in flight. By default, every stream is in
+// the auto class: it is interactive until it sends 32 KiB in one burst without
+// a pause of a second, and bulk for the rest of that burst. The -priority
+// option sets the class of the streams of a listener (local for LOCALADDR,
+// socks, http, tproxy, or dns), or of streams to a destination port, which is
+// known only to the socks, http, tproxy, and dns listeners. A port rule takes
+// precedence over a listener rule. The class of each stream is sent to the
+// server, which schedules its side of the stream by it.
+//
+//	-priority local=interactive -priority 22=interactive -priority 443=bulk
+//
+// The -scan option, instead of running a tunnel, tests many resolvers at once
+// to find those through which the server can be reached, and writes the
+// results to standard output as JSON, best first. The file, or "-" for
+// standard input, lists one resolver per line, in any of the forms
+// "192.0.2.1:53", "udp://192.0.2.1:53", "tls://dns.example:853",
+// "https://dns.example/dns-query", or "quic://dns.example:853", or a CIDR
+// range like "192.0.2.0/24" for each of its addresses on the default port. A
+// resolver passes if the handshake with the server succeeds through it, a
+// small request gets a reply from the server's upstream (which is expected to
+// be a SOCKS5 proxy, though any reply will do), and no response comes back
+// truncated. -scan-workers sets how many resolvers are tested at once (16 by
+// default), and -scan-timeout how long each test may take (15s by default).
+// LOCALADDR is not given.
+//
+//	-scan resolvers.txt -scan-workers 64 -scan-timeout 10s
+//
+// Sending the process SIGHUP makes it open a new transport (a new UDP socket,
+// or new DoH or DoT connections) and move the active session onto it, without
+// interrupting open connections. This is useful after the network changes.
+//
 // In -doh and -dot modes, the program's TLS fingerprint is camouflaged with
 // uTLS by default. The specific TLS fingerprint is selected randomly from a
 // weighted distribution. You can set your own distribution (or specific single
@@ -39,49 +180,40 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	utls "github.com/refraction-networking/utls"
-	"github.com/xtaci/kcp-go/v5"
-	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/client"
 	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/dnsproxy"
+	"www.bamsoftware.com/git/dnstt.git/httpproxy"
 	"www.bamsoftware.com/git/dnstt.git/noise"
-	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+	"www.bamsoftware.com/git/dnstt.git/socksproxy"
+	"www.bamsoftware.com/git/dnstt.git/tproxy"
 )
 
-// smux streams will be closed after this much time without receiving data.
-const idleTimeout = 2 * time.Minute
-
-// dnsNameCapacity returns the number of bytes remaining for encoded data after
-// including domain in a DNS name.
-func dnsNameCapacity(domain dns.Name) int {
-	// Names must be 255 octets or shorter in total length.
-	// https://tools.ietf.org/html/rfc1035#section-2.3.4
-	capacity := 255
-	// Subtract the length of the null terminator.
-	capacity -= 1
-	for _, label := range domain {
-		// Subtract the length of the label and the length octet.
-		capacity -= len(label) + 1
-	}
-	// Each label may be up to 63 bytes long and requires 64 bytes to
-	// encode.
-	capacity = capacity * 63 / 64
-	// Base32 expands every 5 bytes to 8.
-	capacity = capacity * 5 / 8
-	return capacity
+// stringListFlag is a flag.Value that collects the values of an option that
+// may be given more than once.
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringListFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 // readKeyFromFile reads a key from a named file.
@@ -94,35 +226,17 @@ func readKeyFromFile(filename string) ([]byte, error) {
 	return noise.ReadKey(f)
 }
 
-// sampleUTLSDistribution parses a weighted uTLS Client Hello ID distribution
-// string of the form "3*Firefox,2*Chrome,1*iOS", matches each label to a
-// utls.ClientHelloID from utlsClientHelloIDMap, and randomly samples one
-// utls.ClientHelloID from the distribution.
-func sampleUTLSDistribution(spec string) (*utls.ClientHelloID, error) {
-	weights, labels, err := parseWeightedList(spec)
-	if err != nil {
-		return nil, err
-	}
-	ids := make([]*utls.ClientHelloID, 0, len(labels))
-	for _, label := range labels {
-		var id *utls.ClientHelloID
-		if label == "none" {
-			id = nil
-		} else {
-			id = utlsLookup(label)
-			if id == nil {
-				return nil, fmt.Errorf("unknown TLS fingerprint %q", label)
-			}
-		}
-		ids = append(ids, id)
-	}
-	return ids[sampleWeighted(weights)], nil
+// tunnel is a SessionManager along with the priority rules for the streams
+// opened on it.
+type tunnel struct {
+	*client.SessionManager
+	priorities priorityRules
 }
 
-func handle(local *net.TCPConn, sess *smux.Session, conv uint32) error {
-	stream, err := sess.OpenStream()
+func handle(local *net.TCPConn, t *tunnel) error {
+	stream, conv, err := t.OpenStream(t.priorities.classify(listenerLocal, ""))
 	if err != nil {
-		return fmt.Errorf("session %08x opening stream: %v", conv, err)
+		return err
 	}
 	defer func() {
 		log.Printf("end stream %08x:%d", conv, stream.ID())
@@ -162,8 +276,35 @@ func handle(local *net.TCPConn, sess *smux.Session, conv uint32) error {
 	return err
 }
 
-func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.Addr, pconn net.PacketConn) error {
-	defer pconn.Close()
+// listenerOptions are the addresses of optional listeners, besides the plain
+// forwarder at LOCALADDR. A nil address means the listener is disabled.
+type listenerOptions struct {
+	// socksAddr is the address of a SOCKS5 proxy listener.
+	socksAddr *net.TCPAddr
+	// httpAddr is the address of an HTTP proxy listener.
+	httpAddr *net.TCPAddr
+	// tproxyAddr is the address of a listener for connections diverted by
+	// firewall rules (Linux only).
+	tproxyAddr *net.TCPAddr
+	// dnsAddr is the address of a DNS server, on UDP and TCP, that
+	// forwards queries through the tunnel to dnsResolver.
+	dnsAddr     string
+	dnsResolver string
+	// rules decide which connections of the listeners above go through the
+	// tunnel, go direct, or are blocked. nil sends everything through the
+	// tunnel.
+	rules *rules.Rules
+}
+
+func run(endpoints []client.Endpoint, localAddr *net.TCPAddr, listeners listenerOptions, transports []client.Transport, opts client.Options, lazy bool, priorities priorityRules) error {
+	for i := range endpoints {
+		ep := &endpoints[i]
+		mtu := client.EndpointMTU(ep.Domains, opts.Query)
+		if mtu < 80 {
+			return fmt.Errorf("domain %s leaves only %d bytes for payload", ep, mtu)
+		}
+		log.Printf("effective MTU %d for %s", mtu, ep)
+	}
 
 	ln, err := net.ListenTCP("tcp", localAddr)
 	if err != nil {
@@ -171,56 +312,112 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 	}
 	defer ln.Close()
 
-	mtu := dnsNameCapacity(domain) - 8 - 1 - numPadding - 1 // clientid + padding length prefix + padding + data length prefix
-	if mtu < 80 {
-		return fmt.Errorf("domain %s leaves only %d bytes for payload", domain, mtu)
+	var socksLn *net.TCPListener
+	if listeners.socksAddr != nil {
+		socksLn, err = net.ListenTCP("tcp", listeners.socksAddr)
+		if err != nil {
+			return fmt.Errorf("opening SOCKS proxy listener: %v", err)
+		}
+		defer socksLn.Close()
+	}
+	var httpLn *net.TCPListener
+	if listeners.httpAddr != nil {
+		httpLn, err = net.ListenTCP("tcp", listeners.httpAddr)
+		if err != nil {
+			return fmt.Errorf("opening HTTP proxy listener: %v", err)
+		}
+		defer httpLn.Close()
+	}
+	var tproxyLn *net.TCPListener
+	if listeners.tproxyAddr != nil {
+		tproxyLn, err = tproxy.Listen(listeners.tproxyAddr)
+		if err != nil {
+			return fmt.Errorf("opening transparent proxy listener: %v", err)
+		}
+		defer tproxyLn.Close()
 	}
-	log.Printf("effective MTU %d", mtu)
 
-	// Open a KCP conn on the PacketConn.
-	conn, err := kcp.NewConn2(remoteAddr, nil, 0, 0, pconn)
-	if err != nil {
-		return fmt.Errorf("opening KCP conn: %v", err)
+	t := &tunnel{
+		SessionManager: client.NewSessionManager(endpoints, transports, opts),
+		priorities:     priorities,
 	}
-	defer func() {
-		log.Printf("end session %08x", conn.GetConv())
-		conn.Close()
+	defer t.Close()
+
+	// SIGHUP moves the active session onto a fresh transport.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := t.ResetTransport()
+			if err != nil {
+				log.Printf("replacing transport: %v", err)
+			}
+		}
 	}()
-	log.Printf("begin session %08x", conn.GetConv())
-	// Permit coalescing the payloads of consecutive sends.
-	conn.SetStreamMode(true)
-	// Disable the dynamic congestion window (limit only by the maximum of
-	// local and remote static windows).
-	conn.SetNoDelay(
-		0, // default nodelay
-		0, // default interval
-		0, // default resend
-		1, // nc=1 => congestion window off
-	)
-	conn.SetWindowSize(turbotunnel.QueueSize/2, turbotunnel.QueueSize/2)
-	if rc := conn.SetMtu(mtu); !rc {
-		panic(rc)
-	}
-
-	// Put a Noise channel on top of the KCP conn.
-	rw, err := noise.NewClient(conn, pubkey)
-	if err != nil {
-		return err
+	// dialer returns a function that dials on behalf of the named listener,
+	// through the tunnel or as the rules say.
+	dialer := func(listener string) func(network, addr string) (net.Conn, error) {
+		return listeners.rules.Dialer(func(network, addr string) (net.Conn, error) {
+			return dialTarget(t, listener, network, addr)
+		}, dialDirect)
 	}
 
-	// Start a smux session on the Noise channel.
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = idleTimeout
-	smuxConfig.MaxStreamBuffer = 1 * 1024 * 1024 // default is 65536
-	sess, err := smux.Client(rw, smuxConfig)
-	if err != nil {
-		return fmt.Errorf("opening smux session: %v", err)
+	if listeners.dnsAddr != "" {
+		dnsServer, err := dnsproxy.Listen(listeners.dnsAddr, listeners.dnsResolver, dialer(listenerDNS))
+		if err != nil {
+			return fmt.Errorf("opening DNS listener: %v", err)
+		}
+		defer dnsServer.Close()
+		log.Printf("DNS listening on %s, forwarding to %s", dnsServer.Addr(), listeners.dnsResolver)
+	}
+	// Establish the first session now, rather than waiting for the first
+	// stream, unless lazy. If no endpoint is reachable, keep listening; the
+	// next stream will try again.
+	if lazy {
+		log.Printf("lazy mode: waiting for the first connection")
+	} else if err := t.Connect(); err != nil {
+		log.Printf("no endpoint is reachable: %v", err)
+	}
+
+	if socksLn != nil {
+		log.Printf("SOCKS proxy listening on %s", socksLn.Addr())
+		go func() {
+			err := socksproxy.Serve(socksLn, dialer(listenerSOCKS))
+			if err != nil {
+				log.Printf("SOCKS proxy: %v", err)
+			}
+		}()
+	}
+	if httpLn != nil {
+		log.Printf("HTTP proxy listening on %s", httpLn.Addr())
+		go func() {
+			err := httpproxy.Serve(httpLn, dialer(listenerHTTP))
+			if err != nil {
+				log.Printf("HTTP proxy: %v", err)
+			}
+		}()
+	}
+	if tproxyLn != nil {
+		log.Printf("transparent proxy listening on %s", tproxyLn.Addr())
+		go func() {
+			dial := dialer(listenerTProxy)
+			err := acceptLoop(tproxyLn, t, func(local *net.TCPConn, t *tunnel) error {
+				return handleTransparent(local, dial)
+			})
+			if err != nil {
+				log.Printf("transparent proxy: %v", err)
+			}
+		}()
 	}
-	defer sess.Close()
 
+	return acceptLoop(ln, t, handle)
+}
+
+// acceptLoop accepts connections from ln and calls handler on each of them in
+// a new goroutine. It returns when ln.Accept returns a non-temporary error.
+func acceptLoop(ln *net.TCPListener, t *tunnel, handler func(*net.TCPConn, *tunnel) error) error {
 	for {
-		local, err := ln.Accept()
+		local, err := ln.AcceptTCP()
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Temporary() {
 				continue
@@ -229,7 +426,7 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 		}
 		go func() {
 			defer local.Close()
-			err := handle(local.(*net.TCPConn), sess, conn.GetConv())
+			err := handler(local, t)
 			if err != nil {
 				log.Printf("handle: %v", err)
 			}
@@ -238,16 +435,36 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 }
 
 func main() {
+	var compress bool
+	var coverInterval time.Duration
+	var coverRandom bool
+	var randomShape bool
+	var decoyRate float64
+	var dnsAddr string
+	var dnsResolver string
 	var dohURL string
+	var doqAddr string
 	var dotAddr string
+	var fallbacks stringListFlag
+	var httpAddrString string
+	var lazy bool
+	var lazyIdle time.Duration
+	var priorities priorityRules
 	var pubkeyFilename string
+	var tproxyAddrString string
 	var pubkeyString string
+	var rulesFilename string
+	var scanFilename string
+	var scanTimeout time.Duration
+	var scanWorkers int
+	var socksAddrString string
 	var udpAddr string
 	var utlsDistribution string
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage:
-  %[1]s [-doh URL|-dot ADDR|-udp ADDR] -pubkey-file PUBKEYFILE DOMAIN LOCALADDR
+  %[1]s [-udp ADDR] [-dot ADDR] [-doh URL] [-doq ADDR] -pubkey-file PUBKEYFILE [-cover DURATION] [-fallback DOMAIN=PUBKEY]... [-dns ADDR] [-socks ADDR] [-http ADDR] [-tproxy ADDR] [-rules FILE] [-priority TARGET=CLASS]... DOMAIN LOCALADDR
+  %[1]s -scan FILE [-scan-workers N] [-scan-timeout DURATION] -pubkey-file PUBKEYFILE DOMAIN
 
 Examples:
   %[1]s -doh https://resolver.example/dns-query -pubkey-file server.pub t.example.com 127.0.0.1:7000
@@ -255,11 +472,7 @@ Examples:
 
 `, os.Args[0])
 		flag.PrintDefaults()
-		labels := make([]string, 0, len(utlsClientHelloIDMap))
-		labels = append(labels, "none")
-		for _, entry := range utlsClientHelloIDMap {
-			labels = append(labels, entry.Label)
-		}
+		labels := client.UTLSLabels()
 		fmt.Fprintf(flag.CommandLine.Output(), `
 Known TLS fingerprints for -utls are:
 `)
@@ -277,32 +490,89 @@ Known TLS fingerprints for -utls are:
 			fmt.Fprintln(flag.CommandLine.Output(), line.String())
 		}
 	}
+	flag.BoolVar(&compress, "compress", false, "offer compression of the tunnel to the server")
+	flag.DurationVar(&coverInterval, "cover", 0, "send queries at a constant rate of one per this interval (0 to disable)")
+	flag.BoolVar(&coverRandom, "cover-random", false, "with -cover, vary the interval randomly")
+	flag.Float64Var(&decoyRate, "decoy-rate", 0.0, "probability of following a query with a decoy A or AAAA query")
+	flag.StringVar(&dnsAddr, "dns", "", "also listen for DNS queries at this address, and answer them through the tunnel")
+	flag.StringVar(&dnsResolver, "dns-resolver", "1.1.1.1:53", "with -dns, resolver to forward queries to from the server side")
 	flag.StringVar(&dohURL, "doh", "", "URL of DoH resolver")
+	flag.StringVar(&doqAddr, "doq", "", "address of DoQ resolver")
 	flag.StringVar(&dotAddr, "dot", "", "address of DoT resolver")
+	flag.Var(&fallbacks, "fallback", "fallback server as DOMAIN=PUBKEY (may be repeated)")
+	flag.StringVar(&httpAddrString, "http", "", "also listen for HTTP proxy requests at this address")
+	flag.BoolVar(&lazy, "lazy", false, "connect to the server only when the first connection arrives, and disconnect when idle")
+	flag.DurationVar(&lazyIdle, "lazy-idle", 1*time.Minute, "with -lazy, disconnect after this long without connections (0 to stay connected)")
+	flag.Var(&priorities, "priority", "give streams a priority class as TARGET=CLASS, where TARGET is local, socks, http, tproxy, dns, or a destination port, and CLASS is interactive, bulk, or auto (may be repeated)")
 	flag.StringVar(&pubkeyString, "pubkey", "", fmt.Sprintf("server public key (%d hex digits)", noise.KeyLen*2))
 	flag.StringVar(&pubkeyFilename, "pubkey-file", "", "read server public key from file")
+	flag.BoolVar(&randomShape, "random-shape", false, "randomize the shape of queries")
+	flag.StringVar(&rulesFilename, "rules", "", "read split tunneling rules, deciding which connections go through the tunnel, go direct, or are blocked, from this file")
+	flag.StringVar(&scanFilename, "scan", "", "instead of running a tunnel, test the resolvers listed in this file (- for stdin) and write ranked results as JSON")
+	flag.DurationVar(&scanTimeout, "scan-timeout", 15*time.Second, "with -scan, how long the test of one resolver may take")
+	flag.IntVar(&scanWorkers, "scan-workers", 16, "with -scan, how many resolvers to test at once")
+	flag.StringVar(&socksAddrString, "socks", "", "also listen for SOCKS5 proxy requests at this address")
+	flag.StringVar(&tproxyAddrString, "tproxy", "", "also listen for connections diverted by REDIRECT or TPROXY rules at this address (Linux only)")
 	flag.StringVar(&udpAddr, "udp", "", "address of UDP DNS resolver")
-	flag.StringVar(&utlsDistribution, "utls",
-		"4*random,3*Firefox_120,1*Firefox_105,3*Chrome_120,1*Chrome_102,1*iOS_14,1*iOS_13",
+	flag.StringVar(&utlsDistribution, "utls", client.DefaultUTLSDistribution,
 		"choose TLS fingerprint from weighted distribution")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
 
-	if flag.NArg() != 2 {
+	if !(flag.NArg() == 2 || scanFilename != "" && flag.NArg() == 1) {
 		flag.Usage()
 		os.Exit(1)
 	}
-	domain, err := dns.ParseName(flag.Arg(0))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "invalid domain %+q: %v\n", flag.Arg(0), err)
-		os.Exit(1)
-	}
-	localAddr, err := net.ResolveTCPAddr("tcp", flag.Arg(1))
+	domains, err := dns.ParseNames(flag.Arg(0))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	var localAddr *net.TCPAddr
+	if scanFilename == "" {
+		localAddr, err = net.ResolveTCPAddr("tcp", flag.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	listeners := listenerOptions{
+		dnsAddr:     dnsAddr,
+		dnsResolver: dnsResolver,
+	}
+	if socksAddrString != "" {
+		listeners.socksAddr, err = net.ResolveTCPAddr("tcp", socksAddrString)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-socks: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if httpAddrString != "" {
+		listeners.httpAddr, err = net.ResolveTCPAddr("tcp", httpAddrString)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-http: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if tproxyAddrString != "" {
+		listeners.tproxyAddr, err = net.ResolveTCPAddr("tcp", tproxyAddrString)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-tproxy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if rulesFilename != "" {
+		listeners.rules, err = rules.ParseFile(rulesFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-rules: %v\n", err)
+			os.Exit(1)
+		}
+		if listeners.socksAddr == nil && listeners.httpAddr == nil && listeners.tproxyAddr == nil && listeners.dnsAddr == "" {
+			fmt.Fprintf(os.Stderr, "-rules applies only to the -socks, -http, -tproxy, and -dns listeners\n")
+			os.Exit(1)
+		}
+	}
 
 	var pubkey []byte
 	if pubkeyFilename != "" && pubkeyString != "" {
@@ -328,7 +598,19 @@ Known TLS fingerprints for -utls are:
 		os.Exit(1)
 	}
 
-	utlsClientHelloID, err := sampleUTLSDistribution(utlsDistribution)
+	// The primary endpoint comes from the command line arguments, followed
+	// by any -fallback endpoints in the order given.
+	endpoints := []client.Endpoint{{Domains: domains, Pubkey: pubkey}}
+	for _, spec := range fallbacks {
+		ep, err := client.ParseEndpoint(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing -fallback: %v\n", err)
+			os.Exit(1)
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	utlsClientHelloID, err := client.SampleUTLSDistribution(utlsDistribution)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "parsing -utls: %v\n", err)
 		os.Exit(1)
@@ -337,78 +619,84 @@ Known TLS fingerprints for -utls are:
 		log.Printf("uTLS fingerprint %s %s", utlsClientHelloID.Client, utlsClientHelloID.Version)
 	}
 
-	// Iterate over the remote resolver address options and select one and
-	// only one.
-	var remoteAddr net.Addr
-	var pconn net.PacketConn
+	transportOpts := client.TransportOptions{UTLSClientHelloID: utlsClientHelloID}
+	if scanFilename != "" {
+		if scanWorkers <= 0 || scanTimeout <= 0 {
+			fmt.Fprintf(os.Stderr, "-scan-workers and -scan-timeout must be positive\n")
+			os.Exit(1)
+		}
+		err := scan(endpoints[0], scanFilename, transportOpts, client.ScanOptions{
+			Workers: scanWorkers,
+			Timeout: scanTimeout,
+			Query: client.QueryOptions{
+				RandomShape: randomShape,
+			},
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-scan: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Collect the remote resolver address options that were given, in
+	// order from cheapest to most expensive. The first is used first, and
+	// the others are fallbacks.
+	var transports []client.Transport
 	for _, opt := range []struct {
 		s string
-		f func(string) (net.Addr, net.PacketConn, error)
+		f func(string, client.TransportOptions) client.Transport
 	}{
-		// -doh
-		{dohURL, func(s string) (net.Addr, net.PacketConn, error) {
-			addr := turbotunnel.DummyAddr{}
-			var rt http.RoundTripper
-			if utlsClientHelloID == nil {
-				transport := http.DefaultTransport.(*http.Transport).Clone()
-				// Disable DefaultTransport's default Proxy =
-				// ProxyFromEnvironment setting, for conformity
-				// with utlsRoundTripper and with DoT mode,
-				// which do not take a proxy from the
-				// environment.
-				transport.Proxy = nil
-				rt = transport
-			} else {
-				rt = NewUTLSRoundTripper(nil, utlsClientHelloID)
-			}
-			pconn, err := NewHTTPPacketConn(rt, dohURL, 32)
-			return addr, pconn, err
-		}},
-		// -dot
-		{dotAddr, func(s string) (net.Addr, net.PacketConn, error) {
-			addr := turbotunnel.DummyAddr{}
-			var dialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
-			if utlsClientHelloID == nil {
-				dialTLSContext = (&tls.Dialer{}).DialContext
-			} else {
-				dialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return utlsDialContext(ctx, network, addr, nil, utlsClientHelloID)
-				}
-			}
-			pconn, err := NewTLSPacketConn(dotAddr, dialTLSContext)
-			return addr, pconn, err
-		}},
-		// -udp
-		{udpAddr, func(s string) (net.Addr, net.PacketConn, error) {
-			addr, err := net.ResolveUDPAddr("udp", s)
-			if err != nil {
-				return nil, nil, err
-			}
-			pconn, err := net.ListenUDP("udp", nil)
-			return addr, pconn, err
-		}},
+		{udpAddr, client.UDPTransport}, // -udp
+		{dotAddr, client.DoTTransport}, // -dot
+		{dohURL, client.DoHTransport},  // -doh
+		{doqAddr, client.DoQTransport}, // -doq
 	} {
-		if opt.s == "" {
-			continue
-		}
-		if pconn != nil {
-			fmt.Fprintf(os.Stderr, "only one of -doh, -dot, and -udp may be given\n")
-			os.Exit(1)
+		if opt.s != "" {
+			transports = append(transports, opt.f(opt.s, transportOpts))
 		}
-		var err error
-		remoteAddr, pconn, err = opt.f(opt.s)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	}
+	if len(transports) == 0 {
+		fmt.Fprintf(os.Stderr, "at least one of -udp, -dot, -doh, or -doq is required\n")
+		os.Exit(1)
+	}
+	if len(transports) > 1 {
+		names := make([]string, 0, len(transports))
+		for _, t := range transports {
+			names = append(names, t.Name)
 		}
+		log.Printf("transports in order: %s", strings.Join(names, ", "))
+	}
+
+	if coverInterval < 0 {
+		fmt.Fprintf(os.Stderr, "-cover must not be negative\n")
+		os.Exit(1)
+	}
+	if coverInterval != 0 {
+		log.Printf("cover traffic: one query every %v", coverInterval)
 	}
-	if pconn == nil {
-		fmt.Fprintf(os.Stderr, "one of -doh, -dot, or -udp is required\n")
+	if !(0.0 <= decoyRate && decoyRate <= 1.0) {
+		fmt.Fprintf(os.Stderr, "-decoy-rate must be between 0 and 1\n")
 		os.Exit(1)
 	}
 
-	pconn = NewDNSPacketConn(pconn, remoteAddr, domain)
-	err = run(pubkey, domain, localAddr, remoteAddr, pconn)
+	if lazyIdle < 0 {
+		fmt.Fprintf(os.Stderr, "-lazy-idle must not be negative\n")
+		os.Exit(1)
+	}
+	opts := client.Options{
+		Compress: compress,
+		Query: client.QueryOptions{
+			CoverInterval: coverInterval,
+			CoverRandom:   coverRandom,
+			RandomShape:   randomShape,
+			DecoyRate:     decoyRate,
+		},
+	}
+	if lazy {
+		opts.LazyIdle = lazyIdle
+	}
+	err = run(endpoints, localAddr, listeners, transports, opts, lazy, priorities)
 	if err != nil {
 		log.Fatal(err)
 	}
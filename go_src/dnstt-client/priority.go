@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"www.bamsoftware.com/git/dnstt.git/priority"
+)
+
+// Names of the listeners that priority rules may refer to.
+const (
+	listenerLocal  = "local"
+	listenerSOCKS  = "socks"
+	listenerHTTP   = "http"
+	listenerTProxy = "tproxy"
+	listenerDNS    = "dns"
+)
+
+// priorityRules assigns priority classes to streams, by the listener that
+// accepted the stream's connection and by the port of its destination. It is a
+// flag.Value that parses rules of the form TARGET=CLASS, where TARGET is a
+// listener name or a port number. A port rule applies only to listeners that
+// know the destination of a connection, and takes precedence over a listener
+// rule. Streams that match no rule are in the Auto class.
+type priorityRules struct {
+	listeners map[string]priority.Class
+	ports     map[int]priority.Class
+}
+
+func (r *priorityRules) String() string {
+	var rules []string
+	for name, class := range r.listeners {
+		rules = append(rules, fmt.Sprintf("%s=%s", name, class))
+	}
+	for port, class := range r.ports {
+		rules = append(rules, fmt.Sprintf("%d=%s", port, class))
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+func (r *priorityRules) Set(s string) error {
+	target, className, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("priority rule %+q is not in TARGET=CLASS form", s)
+	}
+	class, err := priority.ParseClass(className)
+	if err != nil {
+		return err
+	}
+	switch target {
+	case listenerLocal, listenerSOCKS, listenerHTTP, listenerTProxy, listenerDNS:
+		if r.listeners == nil {
+			r.listeners = make(map[string]priority.Class)
+		}
+		r.listeners[target] = class
+		return nil
+	}
+	port, err := strconv.ParseUint(target, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("priority rule target %+q is not a listener name or port number", target)
+	}
+	if r.ports == nil {
+		r.ports = make(map[int]priority.Class)
+	}
+	r.ports[int(port)] = class
+	return nil
+}
+
+// classify returns the priority class for a stream from the named listener to
+// addr, a "host:port" string. addr is empty for the plain forwarder, which
+// does not know the destination.
+func (r *priorityRules) classify(listener, addr string) priority.Class {
+	if _, portString, err := net.SplitHostPort(addr); err == nil {
+		if port, err := strconv.Atoi(portString); err == nil {
+			if class, ok := r.ports[port]; ok {
+				return class
+			}
+		}
+	}
+	if class, ok := r.listeners[listener]; ok {
+		return class
+	}
+	return priority.Auto
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/priority"
+)
+
+func TestPriorityRules(t *testing.T) {
+	var r priorityRules
+	for _, s := range []string{"local=interactive", "http=bulk", "socks=bulk", "22=interactive", "443=auto"} {
+		err := r.Set(s)
+		if err != nil {
+			t.Fatalf("%+q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "local", "ftp=bulk", "0=bulk", "65536=bulk", "22=urgent"} {
+		if err := r.Set(s); err == nil {
+			t.Errorf("%+q: no error", s)
+		}
+	}
+	if s := r.String(); s != "22=interactive,443=auto,http=bulk,local=interactive,socks=bulk" {
+		t.Errorf("String() = %+q", s)
+	}
+
+	for _, test := range []struct {
+		listener, addr string
+		class          priority.Class
+	}{
+		{listenerLocal, "", priority.Interactive},
+		{listenerHTTP, "example.com:80", priority.Bulk},
+		{listenerSOCKS, "example.com:22", priority.Interactive},
+		{listenerHTTP, "example.com:22", priority.Interactive},
+		{listenerHTTP, "[2001:db8::1]:443", priority.Auto},
+		{listenerTProxy, "192.0.2.1:80", priority.Auto},
+		{listenerDNS, "192.0.2.1:22", priority.Interactive},
+	} {
+		if class := r.classify(test.listener, test.addr); class != test.class {
+			t.Errorf("%s %s: got %v, expected %v", test.listener, test.addr, class, test.class)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+	"www.bamsoftware.com/git/dnstt.git/tproxy"
+)
+
+// dialTarget opens a new stream through the tunnel and asks the server's
+// upstream, which must be a SOCKS5 proxy, to connect it to addr. It is how
+// listeners that know the destination of a connection, unlike the plain
+// forwarder at LOCALADDR, carry the destination through the tunnel. listener
+// is the name of the listener, for priority rules.
+func dialTarget(t *tunnel, listener, network, addr string) (net.Conn, error) {
+	stream, conv, err := t.OpenStream(t.priorities.classify(listener, addr))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("begin stream %08x:%d to %s", conv, stream.ID(), addr)
+	return client.DialSOCKS(stream, network, addr)
+}
+
+// dialDirect connects to addr outside the tunnel, for connections that split
+// tunneling rules send direct.
+func dialDirect(network, addr string) (net.Conn, error) {
+	log.Printf("direct connection to %s", addr)
+	return client.DialDirect(network, addr, nil)
+}
+
+// handleTransparent handles a connection accepted by the -tproxy listener. It
+// recovers the connection's original destination, and connects to it using
+// dial.
+func handleTransparent(local *net.TCPConn, dial func(network, addr string) (net.Conn, error)) error {
+	dst, err := tproxy.OriginalDst(local)
+	if err != nil {
+		return err
+	}
+	if dst.String() == local.LocalAddr().String() {
+		// Not diverted by a firewall rule; we would connect to
+		// ourselves.
+		return fmt.Errorf("connection from %v was not redirected", local.RemoteAddr())
+	}
+	remote, err := dial("tcp", dst.String())
+	if err != nil {
+		return fmt.Errorf("connecting to %v: %v", dst, err)
+	}
+	defer remote.Close()
+	copyLocal(local, remote)
+	return nil
+}
+
+// copyLocal copies data in both directions between local and remote, until
+// both directions are done.
+func copyLocal(local *net.TCPConn, remote net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(remote, local)
+		if err == io.EOF {
+			// smux Stream.Write may return io.EOF.
+			err = nil
+		}
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("copy %v←local: %v", remote.RemoteAddr(), err)
+		}
+		local.CloseRead()
+		remote.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(local, remote)
+		if err == io.EOF {
+			// smux Stream.WriteTo may return io.EOF.
+			err = nil
+		}
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("copy local←%v: %v", remote.RemoteAddr(), err)
+		}
+		local.CloseWrite()
+	}()
+	wg.Wait()
+}
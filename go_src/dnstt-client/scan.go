@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+// readLines returns the lines of the file named filename, or of standard
+// input if filename is "-".
+func readLines(filename string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// scan tests ep through each of the resolvers listed in the file named
+// filename, reporting each result on standard error as it comes, and writes
+// the ranked results to standard output as JSON. An interrupt stops the scan
+// early, and the results so far are still written.
+func scan(ep client.Endpoint, filename string, transportOpts client.TransportOptions, opts client.ScanOptions) error {
+	lines, err := readLines(filename)
+	if err != nil {
+		return err
+	}
+	resolvers, err := client.ExpandResolvers(lines)
+	if err != nil {
+		return err
+	}
+	if len(resolvers) == 0 {
+		return fmt.Errorf("no resolvers in %s", filename)
+	}
+
+	// Every session logs its beginning and end, and more as it is torn
+	// down; show only the results.
+	logging.SetLevel(logging.Error)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	done := 0
+	opts.Progress = func(r client.ScanResult) {
+		done++
+		if r.OK {
+			fmt.Fprintf(os.Stderr, "%d/%d %s: ok, handshake %d ms, round trip %d ms\n",
+				done, len(resolvers), r.Resolver, r.HandshakeMs, r.RoundTripMs)
+		} else {
+			fmt.Fprintf(os.Stderr, "%d/%d %s: %s: %s\n",
+				done, len(resolvers), r.Resolver, r.Stage, r.Error)
+		}
+	}
+	results, err := client.Scan(ctx, ep, resolvers, transportOpts, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
@@ -32,7 +32,10 @@
 // value is maxUDPPayload.
 //
 // DOMAIN is the root of the DNS zone reserved for the tunnel. See README for
-// instructions on setting it up.
+// instructions on setting it up. DOMAIN may be a comma-separated list of
+// several domains, all delegated to this server, for example
+// "t1.example.com,t2.example.net". The server accepts queries under any of
+// them, and a client may spread the queries of one session across them.
 //
 // UPSTREAMADDR is the TCP address to which incoming tunnelled streams will be
 // forwarded.
@@ -55,8 +58,10 @@ import (
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/compression"
 	"www.bamsoftware.com/git/dnstt.git/dns"
 	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/priority"
 	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
 )
 
@@ -234,21 +239,53 @@ func handleStream(stream *smux.Stream, upstream string, conv uint32) error {
 }
 
 // acceptStreams wraps a KCP session in a Noise channel and an smux.Session,
-// then awaits smux streams. It passes each stream to handleStream.
+// then awaits smux streams. It passes each stream to handleStream. If the
+// client offers compression in the Noise handshake, the smux.Session is
+// compressed with the first offered algorithm that is supported. The offer is
+// always answered, even when no algorithm is supported, so that the client
+// need not wait to find out.
 func acceptStreams(conn *kcp.UDPSession, privkey []byte, upstream string) error {
 	// Put a Noise channel on top of the KCP conn.
-	rw, err := noise.NewServer(conn, privkey)
+	alg := compression.None
+	rw, err := noise.NewServerWithPayload(conn, privkey, func(offer []byte) ([]byte, error) {
+		var reply []byte
+		reply, alg = compression.Select(offer)
+		return reply, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Put compression, if any, between Noise and smux.
+	rw, err = compression.NewConn(rw, alg)
 	if err != nil {
 		return err
 	}
+	if alg != compression.None {
+		log.Printf("session %08x compression %s", conn.GetConv(), alg)
+	}
+
+	// Schedule smux frames so that streams that send little are not held
+	// up behind streams that send a lot. Streams are in the class the
+	// client sends for them, or else in the Auto class.
+	prio := priority.NewConn(rw)
+	prio.SetThrottleFunc(func(throttled bool) {
+		if throttled {
+			conn.SetWindowSize(priority.ThrottledSendWindow, 0)
+		} else {
+			conn.SetWindowSize(turbotunnel.QueueSize/2, 0)
+		}
+	})
 
 	// Put an smux session on top of the encrypted Noise channel.
 	smuxConfig := smux.DefaultConfig()
 	smuxConfig.Version = 2
 	smuxConfig.KeepAliveTimeout = idleTimeout
 	smuxConfig.MaxStreamBuffer = 1 * 1024 * 1024 // default is 65536
-	sess, err := smux.Server(rw, smuxConfig)
+	smuxConfig.MaxFrameSize = priority.MaxFrameSize
+	sess, err := smux.Server(prio, smuxConfig)
 	if err != nil {
+		prio.Close()
 		return err
 	}
 	defer sess.Close()
@@ -356,7 +393,8 @@ func nextPacket(r *bytes.Reader) ([]byte, error) {
 // the returned dns.Message is nil, it means that there should be no response to
 // this query. If the returned dns.Message has an Rcode() of dns.RcodeNoError,
 // the message is a candidate for for carrying downstream data in a TXT record.
-func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
+// The query name must be a subdomain of one of domains.
+func responseFor(query *dns.Message, domains []dns.Name) (*dns.Message, []byte) {
 	resp := &dns.Message{
 		ID:       query.ID,
 		Flags:    0x8000, // QR = 1, RCODE = no error
@@ -426,11 +464,18 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 		return resp, nil
 	}
 	question := query.Question[0]
-	// Check the name to see if it ends in our chosen domain, and extract
-	// all that comes before the domain if it does. If it does not, we will
-	// return RcodeNameError below, but prefer to return RcodeFormatError
-	// for payload size if that applies as well.
-	prefix, ok := question.Name.TrimSuffix(domain)
+	// Check the name to see if it ends in one of our chosen domains, and
+	// extract all that comes before the domain if it does. If one domain is
+	// a subdomain of another, the longer match wins. If the name is not in
+	// any domain, we will return RcodeNameError below, but prefer to return
+	// RcodeFormatError for payload size if that applies as well.
+	var prefix dns.Name
+	ok := false
+	for _, domain := range domains {
+		if p, match := question.Name.TrimSuffix(domain); match && (!ok || len(p) < len(prefix)) {
+			prefix, ok = p, true
+		}
+	}
 	if !ok {
 		// Not a name we are authoritative for.
 		resp.Flags |= dns.RcodeNameError
@@ -498,7 +543,7 @@ type record struct {
 // the incoming DNS queries, and puts them on ttConn's incoming queue. Whenever
 // a query calls for a response, constructs a partial response and passes it to
 // sendLoop over ch.
-func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch chan<- *record) error {
+func recvLoop(domains []dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch chan<- *record) error {
 	for {
 		var buf [4096]byte
 		n, addr, err := dnsConn.ReadFrom(buf[:])
@@ -517,7 +562,7 @@ func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.Queue
 			continue
 		}
 
-		resp, payload := responseFor(&query, domain)
+		resp, payload := responseFor(&query, domains)
 		// Extract the ClientID from the payload.
 		var clientID turbotunnel.ClientID
 		n = copy(clientID[:], payload)
@@ -551,11 +596,77 @@ func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.Queue
 	}
 }
 
+// urgentPacketConn is a turbotunnel.QueuePacketConn that puts outgoing packets
+// consisting only of KCP control segments (acknowledgements and window probes
+// and updates) on a separate urgent queue, which sendLoop serves before the
+// ordinary outgoing queue. Acknowledgements then do not wait behind downstream
+// data, which keeps the client's upstream moving while a download is in
+// progress.
+type urgentPacketConn struct {
+	*turbotunnel.QueuePacketConn
+	urgent *turbotunnel.RemoteMap
+}
+
+// newUrgentPacketConn wraps conn, expiring the urgent queues of clients that
+// are not seen for timeout.
+func newUrgentPacketConn(conn *turbotunnel.QueuePacketConn, timeout time.Duration) *urgentPacketConn {
+	return &urgentPacketConn{
+		QueuePacketConn: conn,
+		urgent:          turbotunnel.NewRemoteMap(timeout),
+	}
+}
+
+// WriteTo queues an outgoing packet for the given address, on the urgent queue
+// if it carries no data and the urgent queue has room, and otherwise on the
+// ordinary outgoing queue.
+func (c *urgentPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isKCPControl(p) {
+		// Copy the slice so that the caller may reuse it.
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		select {
+		case c.urgent.SendQueue(addr) <- buf:
+			return len(buf), nil
+		default:
+		}
+	}
+	return c.QueuePacketConn.WriteTo(p, addr)
+}
+
+// UrgentQueue returns the urgent queue for the given address.
+func (c *urgentPacketConn) UrgentQueue(addr net.Addr) <-chan []byte {
+	return c.urgent.SendQueue(addr)
+}
+
+// isKCPControl returns whether p is a KCP packet made up only of segments that
+// carry no data.
+func isKCPControl(p []byte) bool {
+	const (
+		// conv, cmd, frg, wnd, ts, sn, una, len.
+		kcpHeaderSize = 4 + 1 + 1 + 2 + 4 + 4 + 4 + 4
+		kcpCmdPush    = 81
+	)
+	if len(p) == 0 {
+		return false
+	}
+	for len(p) > 0 {
+		if len(p) < kcpHeaderSize || p[4] == kcpCmdPush {
+			return false
+		}
+		n := binary.LittleEndian.Uint32(p[20:24])
+		if n > uint32(len(p)-kcpHeaderSize) {
+			return false
+		}
+		p = p[kcpHeaderSize+int(n):]
+	}
+	return true
+}
+
 // sendLoop repeatedly receives records from ch. Those that represent an error
 // response, it sends on the network immediately. Those that represent a
 // response capable of carrying data, it packs full of as many packets as will
 // fit while keeping the total size under maxEncodedPayload, then sends it.
-func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-chan *record, maxEncodedPayload int) error {
+func sendLoop(dnsConn net.PacketConn, ttConn *urgentPacketConn, ch <-chan *record, maxEncodedPayload int) error {
 	var nextRec *record
 	for {
 		rec := nextRec
@@ -595,24 +706,33 @@ func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-
 			for {
 				var p []byte
 				unstash := ttConn.Unstash(rec.ClientID)
+				urgent := ttConn.UrgentQueue(rec.ClientID)
 				outgoing := ttConn.OutgoingQueue(rec.ClientID)
 				// Prioritize taking a packet first from the
-				// stash, then from the outgoing queue, then
-				// finally check for the expiration of the timer
-				// or for a receive on ch (indicating a new
-				// query that we must respond to).
+				// stash, then from the urgent queue, then from
+				// the outgoing queue, then finally check for
+				// the expiration of the timer or for a receive
+				// on ch (indicating a new query that we must
+				// respond to).
 				select {
 				case p = <-unstash:
 				default:
 					select {
 					case p = <-unstash:
-					case p = <-outgoing:
+					case p = <-urgent:
 					default:
 						select {
 						case p = <-unstash:
+						case p = <-urgent:
 						case p = <-outgoing:
-						case <-timer.C:
-						case nextRec = <-ch:
+						default:
+							select {
+							case p = <-unstash:
+							case p = <-urgent:
+							case p = <-outgoing:
+							case <-timer.C:
+							case nextRec = <-ch:
+							}
 						}
 					}
 				}
@@ -732,7 +852,7 @@ func computeMaxEncodedPayload(limit int) int {
 			},
 		},
 	}
-	resp, _ := responseFor(query, dns.Name([][]byte{}))
+	resp, _ := responseFor(query, []dns.Name{dns.Name([][]byte{})})
 	// As in sendLoop.
 	resp.Answer = []dns.RR{
 		{
@@ -765,7 +885,7 @@ func computeMaxEncodedPayload(limit int) int {
 	return low
 }
 
-func run(privkey []byte, domain dns.Name, upstream string, dnsConn net.PacketConn) error {
+func run(privkey []byte, domains []dns.Name, upstream string, dnsConn net.PacketConn) error {
 	defer dnsConn.Close()
 
 	log.Printf("pubkey %x", noise.PubkeyFromPrivkey(privkey))
@@ -789,7 +909,7 @@ func run(privkey []byte, domain dns.Name, upstream string, dnsConn net.PacketCon
 	log.Printf("effective MTU %d", mtu)
 
 	// Start up the virtual PacketConn for turbotunnel.
-	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, idleTimeout*2)
+	ttConn := newUrgentPacketConn(turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, idleTimeout*2), idleTimeout*2)
 	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
 	if err != nil {
 		return fmt.Errorf("opening KCP listener: %v", err)
@@ -815,7 +935,7 @@ func run(privkey []byte, domain dns.Name, upstream string, dnsConn net.PacketCon
 		}
 	}()
 
-	return recvLoop(domain, dnsConn, ttConn, ch)
+	return recvLoop(domains, dnsConn, ttConn.QueuePacketConn, ch)
 }
 
 func main() {
@@ -863,9 +983,9 @@ Example:
 			flag.Usage()
 			os.Exit(1)
 		}
-		domain, err := dns.ParseName(flag.Arg(0))
+		domains, err := dns.ParseNames(flag.Arg(0))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "invalid domain %+q: %v\n", flag.Arg(0), err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 		upstream := flag.Arg(1)
@@ -943,7 +1063,7 @@ Example:
 			}
 		}
 
-		err = run(privkey, domain, upstream, dnsConn)
+		err = run(privkey, domains, upstream, dnsConn)
 		if err != nil {
 			log.Fatal(err)
 		}
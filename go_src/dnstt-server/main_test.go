@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// query returns a TXT query for name, with an EDNS(0) OPT RR that allows
+// responses of maxUDPPayload bytes.
+func query(t *testing.T, name string) *dns.Message {
+	t.Helper()
+	n, err := dns.ParseName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dns.Message{
+		ID:       0x1234,
+		Flags:    0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{{Name: n, Type: dns.RRTypeTXT, Class: dns.ClassIN}},
+		Additional: []dns.RR{{
+			Name:  dns.Name{},
+			Type:  dns.RRTypeOPT,
+			Class: uint16(maxUDPPayload),
+			Data:  []byte{},
+		}},
+	}
+}
+
+// Queries under any of the configured domains, in any letter case, are
+// answered with their payload; queries under other domains get NXDOMAIN.
+func TestResponseForDomains(t *testing.T) {
+	domains, err := dns.ParseNames("t.example.com,tunnel.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("hello, world")
+	prefix := strings.ToLower(base32Encoding.EncodeToString(payload))
+
+	for _, test := range []struct {
+		domain string
+		ok     bool
+	}{
+		{"t.example.com", true},
+		{"T.Example.COM", true},
+		{"tunnel.example.net", true},
+		{"TUNNEL.EXAMPLE.NET", true},
+		{"example.com", false},
+		{"u.example.com", false},
+		{"t.example.com.evil.example", false},
+	} {
+		resp, p := responseFor(query(t, prefix+"."+test.domain), domains)
+		if resp == nil {
+			t.Errorf("%s: no response", test.domain)
+			continue
+		}
+		if test.ok {
+			if resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || !bytes.Equal(p, payload) {
+				t.Errorf("%s: rcode %d, flags %04x, payload %+q", test.domain, resp.Rcode(), resp.Flags, p)
+			}
+		} else {
+			if resp.Rcode() != dns.RcodeNameError || resp.Flags&0x0400 != 0 || p != nil {
+				t.Errorf("%s: rcode %d, flags %04x, payload %+q", test.domain, resp.Rcode(), resp.Flags, p)
+			}
+		}
+	}
+}
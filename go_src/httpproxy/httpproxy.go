@@ -0,0 +1,211 @@
+// Package httpproxy implements the server side of an HTTP proxy, for clients
+// that can use an HTTP proxy but not a SOCKS proxy. It supports the CONNECT
+// method, and plain HTTP requests with an absolute URI such as
+//
+//	GET http://example.com/ HTTP/1.1
+//
+// The connection to each target is made by a caller-supplied dial function,
+// which is how requests are carried through the tunnel. Clients may be
+// required to authenticate with Basic authentication in Proxy-Authorization.
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/relay"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+)
+
+// How long to wait for a client to send its request.
+const requestTimeout = 30 * time.Second
+
+// DialFunc connects to addr, a "host:port" string.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// hopHeaders are headers that apply to a single connection, and are not
+// forwarded to the target.
+// https://tools.ietf.org/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Server is an HTTP proxy server.
+type Server struct {
+	// Dial connects to targets.
+	Dial DialFunc
+	// Authenticate, if not nil, makes clients authenticate with a username
+	// and password, and reports whether those sent on conn are valid.
+	Authenticate func(conn net.Conn, username, password string) bool
+}
+
+// Serve accepts connections from ln and handles each as an HTTP proxy client,
+// connecting to targets using dial. It returns when ln.Accept returns a
+// non-temporary error.
+func Serve(ln net.Listener, dial DialFunc) error {
+	return (&Server{Dial: dial}).Serve(ln)
+}
+
+// Handle handles one proxy request from conn, connecting to its target using
+// dial, as Server.Handle does.
+func Handle(conn net.Conn, dial DialFunc) error {
+	return (&Server{Dial: dial}).Handle(conn)
+}
+
+// Serve accepts connections from ln and handles each as an HTTP proxy client.
+// It returns when ln.Accept returns a non-temporary error.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := s.Handle(conn)
+			if err != nil {
+				logging.Proxy.Warnf("HTTP proxy: %v", err)
+			}
+		}()
+	}
+}
+
+// Handle reads one proxy request from conn, connects to its target using
+// s.Dial, and then copies data between conn and the target until both
+// directions are done. A CONNECT request turns conn into a tunnel to the
+// target. Any other request is forwarded to the target with Connection: close,
+// and its response is copied back. Handle does not close conn.
+func (s *Server) Handle(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("reading request: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if s.Authenticate != nil {
+		username, password, ok := proxyBasicAuth(req)
+		if !ok || !s.Authenticate(conn, username, password) {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+				http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired))
+			if !ok {
+				// Clients commonly try without credentials first.
+				return nil
+			}
+			return fmt.Errorf("authentication failed for user %+q from %v", username, conn.RemoteAddr())
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		return handleConnect(conn, br, req, s.Dial)
+	}
+	return handleForward(conn, req, s.Dial)
+}
+
+// proxyBasicAuth returns the username and password of the Proxy-Authorization
+// header of req, if it uses Basic authentication.
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	// Request.BasicAuth reads only the Authorization header.
+	r := http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	return r.BasicAuth()
+}
+
+// handleConnect handles a CONNECT request.
+func handleConnect(conn net.Conn, br *bufio.Reader, req *http.Request, dial DialFunc) error {
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		writeError(conn, http.StatusBadRequest)
+		return fmt.Errorf("CONNECT %+q: %v", target, err)
+	}
+	remote, err := dial("tcp", target)
+	if err != nil {
+		writeError(conn, dialErrorStatus(err))
+		return fmt.Errorf("CONNECT %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	// The client may already have sent data following the request.
+	if n := br.Buffered(); n > 0 {
+		p, _ := br.Peek(n)
+		_, err := remote.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+	relay.Copy(conn, remote)
+	return nil
+}
+
+// handleForward handles a request with an absolute URI.
+func handleForward(conn net.Conn, req *http.Request, dial DialFunc) error {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeError(conn, http.StatusBadRequest)
+		return fmt.Errorf("%s %+q: not an absolute http URI", req.Method, req.RequestURI)
+	}
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "80")
+	}
+	remote, err := dial("tcp", target)
+	if err != nil {
+		writeError(conn, dialErrorStatus(err))
+		return fmt.Errorf("%s %s: %v", req.Method, target, err)
+	}
+	defer remote.Close()
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	// Only one request is handled per connection, so ask the target to
+	// close the connection after its response.
+	req.Close = true
+	// Write sends the request in origin form, "GET / HTTP/1.1".
+	err = req.Write(remote)
+	if err != nil {
+		return fmt.Errorf("%s %s: writing request: %v", req.Method, target, err)
+	}
+	_, err = io.Copy(conn, remote)
+	if err == io.EOF {
+		// smux Stream.Read may return io.EOF through a splice.
+		err = nil
+	}
+	return err
+}
+
+// dialErrorStatus returns the status code for a failure to dial the target:
+// 403 for a target blocked by a rule, and 502 otherwise.
+func dialErrorStatus(err error) int {
+	if errors.Is(err, rules.ErrBlocked) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// writeError writes a response with the given status code and no body.
+func writeError(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code))
+}
@@ -0,0 +1,176 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// pipeDialer returns a DialFunc that records the address it was asked to dial,
+// and hands the far end of a net.Pipe to serve.
+func pipeDialer(dialed *string, serve func(net.Conn)) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		*dialed = addr
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			serve(s)
+		}()
+		return c, nil
+	}
+}
+
+func TestConnect(t *testing.T) {
+	var dialed string
+	dial := pipeDialer(&dialed, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	client, proxy := net.Pipe()
+	go func() {
+		defer proxy.Close()
+		Handle(proxy, dial)
+	}()
+	defer client.Close()
+
+	// Send data right after the request, without waiting for the response.
+	go io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nhello")
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if dialed != "example.com:443" {
+		t.Errorf("dialed %+q", dialed)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %+q", buf)
+	}
+}
+
+func TestForward(t *testing.T) {
+	var dialed string
+	requests := make(chan *http.Request, 1)
+	dial := pipeDialer(&dialed, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			close(requests)
+			return
+		}
+		requests <- req
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	})
+
+	for _, test := range []struct {
+		request string
+		dialed  string
+		uri     string
+	}{
+		{"GET http://example.com/path?q HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\n\r\n", "example.com:80", "/path?q"},
+		{"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080", "/"},
+		{"GET http://[::1]/ HTTP/1.1\r\nHost: [::1]\r\n\r\n", "[::1]:80", "/"},
+	} {
+		client, proxy := net.Pipe()
+		go func() {
+			defer proxy.Close()
+			Handle(proxy, dial)
+		}()
+		go io.WriteString(client, test.request)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		client.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("%+q: got %d %+q", test.request, resp.StatusCode, body)
+		}
+		if dialed != test.dialed {
+			t.Errorf("%+q: dialed %+q, expected %+q", test.request, dialed, test.dialed)
+		}
+		req := <-requests
+		if req == nil {
+			t.Fatalf("%+q: target did not get a request", test.request)
+		}
+		if req.RequestURI != test.uri {
+			t.Errorf("%+q: target got URI %+q, expected %+q", test.request, req.RequestURI, test.uri)
+		}
+		if req.Header.Get("Proxy-Connection") != "" || !req.Close {
+			t.Errorf("%+q: target got headers %v", test.request, req.Header)
+		}
+	}
+
+	// Requests without an absolute http URI are rejected.
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET ftp://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		client, proxy := net.Pipe()
+		go func() {
+			defer proxy.Close()
+			Handle(proxy, dial)
+		}()
+		go io.WriteString(client, request)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+q: got %d", strings.TrimSpace(request), resp.StatusCode)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	var dialed string
+	s := &Server{
+		Dial: pipeDialer(&dialed, func(conn net.Conn) {
+			io.Copy(conn, conn)
+		}),
+		Authenticate: func(conn net.Conn, username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+	}
+	for _, test := range []struct {
+		header string
+		status int
+	}{
+		// alice:secret
+		{"Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n", http.StatusOK},
+		// alice:wrong
+		{"Proxy-Authorization: Basic YWxpY2U6d3Jvbmc=\r\n", http.StatusProxyAuthRequired},
+		// Authorization is for the target, not the proxy.
+		{"Authorization: Basic YWxpY2U6c2VjcmV0\r\n", http.StatusProxyAuthRequired},
+		{"", http.StatusProxyAuthRequired},
+	} {
+		client, proxy := net.Pipe()
+		go func() {
+			defer proxy.Close()
+			s.Handle(proxy)
+		}()
+		go io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"+test.header+"\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%+q: got %d, expected %d", test.header, resp.StatusCode, test.status)
+		}
+		if test.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("%+q: no Proxy-Authenticate", test.header)
+		}
+	}
+}
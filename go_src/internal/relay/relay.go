@@ -0,0 +1,42 @@
+// Package relay copies data between two connections, as the proxy listeners
+// do once a connection to its destination is open.
+package relay
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections that support half-closing, like
+// *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copy copies data in both directions between local and remote, until both
+// directions are done. When one direction ends, the connection it was writing
+// to is half-closed if it supports that, and closed otherwise.
+func Copy(local, remote net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(remote, local)
+		if cw, ok := remote.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			remote.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(local, remote)
+		if cw, ok := local.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			local.Close()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// When one side stops sending, the other side sees EOF and may still reply.
+func TestCopyHalfClose(t *testing.T) {
+	client, local := tcpPair(t)
+	defer client.Close()
+	remote, server := tcpPair(t)
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		Copy(local, remote)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	request, err := io.ReadAll(server)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("server read %+q, %v", request, err)
+	}
+	server.Write([]byte("response"))
+	server.CloseWrite()
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("client read %+q, %v", response, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Copy did not return")
+	}
+}
+
+// Connections that cannot be half-closed are closed instead.
+func TestCopyClose(t *testing.T) {
+	client, local := net.Pipe()
+	remote, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Copy(local, remote)
+		close(done)
+	}()
+	client.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server read error %v, expected EOF", err)
+	}
+	server.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Copy did not return")
+	}
+}
@@ -0,0 +1,246 @@
+// Package tunneltest provides a tunnel server for tests. It answers queries on
+// a local UDP socket and runs KCP, Noise, and smux over them, as dnstt-server
+// does, but with none of its limits on the size and timing of responses.
+package tunneltest
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/compression"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// MTU is the size of the largest packets that a Server sends.
+const MTU = 800
+
+// base32Encoding is a base32 encoding without padding, as in query names.
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Options control a Server.
+type Options struct {
+	// Respond, if not nil, answers the payload of the client's handshake
+	// message, as in noise.NewServerWithPayload, and the session is
+	// compressed as its reply says. If nil, the server is one that does
+	// not expect a payload, as in noise.NewServer.
+	Respond func(payload []byte) ([]byte, error)
+	// Handle, if not nil, is called in a goroutine of its own with each
+	// stream, which it must close. If nil, streams are echoed.
+	Handle func(stream net.Conn)
+}
+
+// Server is a tunnel server for tests.
+type Server struct {
+	conn    net.PacketConn
+	domains []dns.Name
+	privkey []byte
+	opts    Options
+	ttConn  *turbotunnel.QueuePacketConn
+	ln      *kcp.Listener
+	// Handshakes is the number of handshakes that have completed.
+	Handshakes atomic.Int32
+}
+
+// NewServer starts a Server for domains, a comma-separated list, with a new
+// key. It must be closed with Close.
+func NewServer(domains string, opts Options) (*Server, error) {
+	names, err := dns.ParseNames(domains)
+	if err != nil {
+		return nil, err
+	}
+	privkey, err := noise.GeneratePrivkey()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:    conn,
+		domains: names,
+		privkey: privkey,
+		opts:    opts,
+		ttConn:  turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, time.Minute),
+	}
+	s.ln, err = kcp.ServeConn(nil, 0, 0, s.ttConn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.acceptSessions()
+	go s.recvLoop()
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.conn.Close()
+	s.ln.Close()
+	return s.ttConn.Close()
+}
+
+// Addr returns the address of the server's UDP socket, to be used as a
+// resolver.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Domains returns the server's domains.
+func (s *Server) Domains() []dns.Name {
+	return s.domains
+}
+
+// Pubkey returns the server's public key.
+func (s *Server) Pubkey() []byte {
+	return noise.PubkeyFromPrivkey(s.privkey)
+}
+
+func (s *Server) acceptSessions() {
+	for {
+		conn, err := s.ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetNoDelay(0, 0, 0, 1)
+		conn.SetMtu(MTU)
+		go func() {
+			defer conn.Close()
+			var rw io.ReadWriteCloser
+			var err error
+			alg := compression.None
+			if s.opts.Respond != nil {
+				rw, err = noise.NewServerWithPayload(conn, s.privkey, func(payload []byte) ([]byte, error) {
+					reply, err := s.opts.Respond(payload)
+					if err == nil && len(payload) != 0 {
+						alg, err = compression.Accept(reply)
+					}
+					return reply, err
+				})
+			} else {
+				rw, err = noise.NewServer(conn, s.privkey)
+			}
+			if err != nil {
+				return
+			}
+			s.Handshakes.Add(1)
+			rw, err = compression.NewConn(rw, alg)
+			if err != nil {
+				return
+			}
+			smuxConfig := smux.DefaultConfig()
+			smuxConfig.Version = 2
+			sess, err := smux.Server(rw, smuxConfig)
+			if err != nil {
+				return
+			}
+			defer sess.Close()
+			for {
+				stream, err := sess.AcceptStream()
+				if err != nil {
+					return
+				}
+				if s.opts.Handle != nil {
+					go s.opts.Handle(stream)
+					continue
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}()
+	}
+}
+
+// recvLoop takes the packets out of queries, and answers each query with the
+// packets waiting to be sent to its client.
+func (s *Server) recvLoop() {
+	for {
+		var buf [4096]byte
+		n, addr, err := s.conn.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		query, err := dns.MessageFromWireFormat(buf[:n])
+		if err != nil || len(query.Question) != 1 {
+			continue
+		}
+		var prefix dns.Name
+		ok := false
+		for _, domain := range s.domains {
+			if prefix, ok = query.Question[0].Name.TrimSuffix(domain); ok {
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		payload, err := base32Encoding.DecodeString(string(bytes.ToUpper(bytes.Join(prefix, nil))))
+		if err != nil || len(payload) < 8 {
+			continue
+		}
+		var clientID turbotunnel.ClientID
+		copy(clientID[:], payload)
+		for r := bytes.NewReader(payload[8:]); ; {
+			prefix, err := r.ReadByte()
+			if err != nil {
+				break
+			}
+			p := make([]byte, int(prefix)%224)
+			if _, err := io.ReadFull(r, p); err != nil {
+				break
+			}
+			if prefix < 224 {
+				s.ttConn.QueueIncoming(p, clientID)
+			}
+		}
+		go s.respondTo(query, addr, clientID)
+	}
+}
+
+// respondTo sends the response to query, with as many of the packets waiting
+// for clientID as arrive within a short time.
+func (s *Server) respondTo(query dns.Message, addr net.Addr, clientID turbotunnel.ClientID) {
+	var payload bytes.Buffer
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	for payload.Len() < 1000 {
+		select {
+		case p := <-s.ttConn.OutgoingQueue(clientID):
+			binary.Write(&payload, binary.BigEndian, uint16(len(p)))
+			payload.Write(p)
+			timer.Reset(0)
+			continue
+		case <-timer.C:
+		}
+		break
+	}
+	resp := &dns.Message{
+		ID:       query.ID,
+		Flags:    0x8400, // QR = 1, AA = 1
+		Question: query.Question,
+		Answer: []dns.RR{{
+			Name:  query.Question[0].Name,
+			Type:  dns.RRTypeTXT,
+			Class: dns.ClassIN,
+			TTL:   60,
+			Data:  dns.EncodeRDataTXT(payload.Bytes()),
+		}},
+	}
+	buf, err := resp.WireFormat()
+	if err != nil {
+		return
+	}
+	s.conn.WriteTo(buf, addr)
+}
@@ -0,0 +1,214 @@
+// Package logging carries the diagnostic messages of the tunnel's packages to
+// wherever the program wants them.
+//
+// Every message has a Level and a Tag naming the subsystem it comes from, so
+// that an app can filter and display them. By default, messages go to the
+// standard log package, with neither level nor tag, just as when the packages
+// called log.Printf themselves. A program that has no useful standard error,
+// like a mobile app, instead calls SetSink to receive every message as an
+// Entry. A Ring is a Sink that keeps the most recent entries in memory, to be
+// attached to a bug report.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	// Debug messages are only of use when looking for a problem, like a
+	// message for every stream.
+	Debug Level = iota
+	// Info messages tell of normal events, like the start of a session.
+	Info
+	// Warn messages tell of a failure that the tunnel recovers from, like
+	// a transport that cannot be reached.
+	Warn
+	// Error messages tell of a failure that the user will notice, like a
+	// connection that cannot be carried.
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+// ParseLevel returns the Level whose String is s, ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for l := Debug; l <= Error; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %+q", s)
+}
+
+// Tag names the subsystem that a message comes from.
+type Tag string
+
+const (
+	// Transport is the DNS transports, UDP, DoH, DoT, and DoQ, and the
+	// choice among them and among tunnel servers.
+	Transport Tag = "transport"
+	// KCP is the sessions with the tunnel server, which are KCP
+	// connections.
+	KCP Tag = "kcp"
+	// Noise is the Noise handshake, and the negotiation of compression
+	// that follows it.
+	Noise Tag = "noise"
+	// Stream is the smux streams, and the connections they carry.
+	Stream Tag = "stream"
+	// Proxy is the local SOCKS, HTTP, and DNS listeners, and the TUN
+	// device.
+	Proxy Tag = "proxy"
+	// App is everything else, like starting and stopping.
+	App Tag = "app"
+)
+
+// Debugf logs a message with level Debug under the tag t. The arguments are
+// handled in the manner of fmt.Printf.
+func (t Tag) Debugf(format string, v ...interface{}) { Logf(Debug, t, format, v...) }
+
+// Infof logs a message with level Info under the tag t.
+func (t Tag) Infof(format string, v ...interface{}) { Logf(Info, t, format, v...) }
+
+// Warnf logs a message with level Warn under the tag t.
+func (t Tag) Warnf(format string, v ...interface{}) { Logf(Warn, t, format, v...) }
+
+// Errorf logs a message with level Error under the tag t.
+func (t Tag) Errorf(format string, v ...interface{}) { Logf(Error, t, format, v...) }
+
+// Entry is one logged message.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Tag     Tag
+	Message string
+}
+
+// String formats e as one line, without a trailing newline, like
+//
+//	2026-01-02 15:04:05.000 warn transport: sendLoop: timeout
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %s %s: %s", e.Time.UTC().Format("2006-01-02 15:04:05.000"), e.Level, e.Tag, e.Message)
+}
+
+// Sink receives logged messages. Log may be called from many goroutines at
+// once.
+type Sink interface {
+	Log(e Entry)
+}
+
+var (
+	minLevel atomic.Int32 // Messages below this Level are discarded
+	sink     atomic.Pointer[Sink]
+)
+
+func init() {
+	minLevel.Store(int32(Info))
+}
+
+// SetSink sets the Sink that receives every message, or restores the default
+// of the standard log package if s is nil.
+func SetSink(s Sink) {
+	if s == nil {
+		sink.Store(nil)
+	} else {
+		sink.Store(&s)
+	}
+}
+
+// SetLevel discards messages below level l from then on. The default is Info.
+func SetLevel(l Level) {
+	minLevel.Store(int32(l))
+}
+
+// Enabled returns whether messages of level l are logged.
+func Enabled(l Level) bool {
+	return int32(l) >= minLevel.Load()
+}
+
+// Logf logs a message with level l under tag t, if l is enabled. The
+// arguments are handled in the manner of fmt.Printf.
+func Logf(l Level, t Tag, format string, v ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	message := fmt.Sprintf(format, v...)
+	if s := sink.Load(); s != nil {
+		(*s).Log(Entry{Time: time.Now(), Level: l, Tag: t, Message: message})
+	} else {
+		log.Print(message)
+	}
+}
+
+// Ring is a Sink that keeps the most recent entries.
+type Ring struct {
+	lock    sync.Mutex
+	entries []Entry
+	next    int  // Index in entries of the next entry to be overwritten
+	full    bool // Whether entries has wrapped around
+}
+
+// NewRing returns a Ring that keeps the last size entries.
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring{entries: make([]Entry, size)}
+}
+
+// Log adds e to r, dropping the oldest entry if r is full.
+func (r *Ring) Log(e Entry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Entries returns the entries in r, oldest first.
+func (r *Ring) Entries() []Entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]Entry(nil), r.entries[:r.next]...)
+	}
+	return append(append([]Entry(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// WriteTo writes the entries in r to w, oldest first, one per line in the
+// format of Entry.String.
+func (r *Ring) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, e := range r.Entries() {
+		n, err := io.WriteString(w, e.String()+"\n")
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
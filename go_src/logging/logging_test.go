@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	lock    sync.Mutex
+	entries []Entry
+}
+
+func (s *recordingSink) Log(e Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+func TestParseLevel(t *testing.T) {
+	for l := Debug; l <= Error; l++ {
+		got, err := ParseLevel(strings.ToUpper(l.String()))
+		if err != nil || got != l {
+			t.Errorf("%v: got %v %v", l, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("parsed unknown level")
+	}
+}
+
+// Messages go to the sink with their level and tag, and those below the level
+// are discarded.
+func TestSink(t *testing.T) {
+	s := &recordingSink{}
+	SetSink(s)
+	defer SetSink(nil)
+	SetLevel(Warn)
+	defer SetLevel(Info)
+
+	Transport.Infof("ignored")
+	Transport.Warnf("sendLoop: %v", "timeout")
+	Stream.Errorf("failed")
+	if len(s.entries) != 2 {
+		t.Fatalf("got %d entries", len(s.entries))
+	}
+	if e := s.entries[0]; e.Level != Warn || e.Tag != Transport || e.Message != "sendLoop: timeout" {
+		t.Errorf("got %+v", e)
+	}
+	if e := s.entries[1]; e.Level != Error || e.Tag != Stream || e.Message != "failed" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+// Without a sink, messages go to the standard log package unchanged.
+func TestDefaultSink(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+	KCP.Infof("begin session %08x", 1)
+	KCP.Debugf("ignored")
+	if buf.String() != "begin session 00000001\n" {
+		t.Errorf("got %+q", buf.String())
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	if len(r.Entries()) != 0 {
+		t.Fatal("new Ring is not empty")
+	}
+	t0 := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, message := range []string{"a", "b", "c", "d", "e"} {
+		r.Log(Entry{Time: t0.Add(time.Duration(i) * time.Millisecond), Level: Info, Tag: App, Message: message})
+		if i == 1 {
+			if got := r.Entries(); len(got) != 2 || got[0].Message != "a" || got[1].Message != "b" {
+				t.Errorf("got %v", got)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "2026-01-02 15:04:05.002 info app: c\n" +
+		"2026-01-02 15:04:05.003 info app: d\n" +
+		"2026-01-02 15:04:05.004 info app: e\n"
+	if buf.String() != expected {
+		t.Errorf("got\n%s", buf.String())
+	}
+}
@@ -0,0 +1,274 @@
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/access"
+	"www.bamsoftware.com/git/dnstt.git/client"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+	"www.bamsoftware.com/git/dnstt.git/sshtunnel"
+)
+
+// ConfigVersion is the version of the configuration document read by
+// NewClientFromJSON. It changes only when a document of an older version would
+// no longer mean the same thing; new optional fields do not change it.
+const ConfigVersion = 1
+
+// config is the configuration document of NewClientFromJSON.
+type config struct {
+	Version   int      `json:"version"`
+	Domain    string   `json:"domain"`
+	Pubkey    string   `json:"pubkey"`
+	Listen    string   `json:"listen"`
+	Resolvers []string `json:"resolvers"`
+	UTLS      *string  `json:"utls"`
+	HTTPProxy string   `json:"http_proxy"`
+	DNS       struct {
+		Listen   string `json:"listen"`
+		Resolver string `json:"resolver"`
+	} `json:"dns"`
+	Share struct {
+		Enabled           bool     `json:"enabled"`
+		Allow             []string `json:"allow"`
+		MaxConnsPerClient int      `json:"max_conns_per_client"`
+	} `json:"share"`
+	Auth struct {
+		Users []struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"users"`
+	} `json:"auth"`
+	Tuning struct {
+		Lazy                    bool    `json:"lazy"`
+		LazyIdleSeconds         *int    `json:"lazy_idle_seconds"`
+		StatsIntervalSeconds    *int    `json:"stats_interval_seconds"`
+		HandshakeTimeoutSeconds int     `json:"handshake_timeout_seconds"`
+		CoverIntervalMs         int     `json:"cover_interval_ms"`
+		CoverRandom             bool    `json:"cover_random"`
+		RandomShape             bool    `json:"random_shape"`
+		DecoyRate               float64 `json:"decoy_rate"`
+	} `json:"tuning"`
+	Rules string `json:"rules"`
+	SSH   struct {
+		Username             string `json:"username"`
+		Password             string `json:"password"`
+		PrivateKey           string `json:"private_key"`
+		PrivateKeyPassphrase string `json:"private_key_passphrase"`
+		HostKey              string `json:"host_key"`
+	} `json:"ssh"`
+}
+
+// ConfigError is a problem with one field of a configuration document.
+type ConfigError struct {
+	// Field is the path of the field, like "resolvers[1]" or
+	// "tuning.decoy_rate", or "" for the document as a whole.
+	Field string `json:"field"`
+	// Message says what is wrong with it.
+	Message string `json:"message"`
+}
+
+// ConfigErrors are all the problems found in a configuration document. Its
+// Error method returns them as a JSON array of objects with the fields field
+// and message, so that an app can show each beside its setting.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	text, err := json.Marshal([]ConfigError(errs))
+	if err != nil {
+		return fmt.Sprintf("%d configuration errors", len(errs))
+	}
+	return string(text)
+}
+
+// add records a problem with field, if err is not nil.
+func (errs *ConfigErrors) add(field string, err error) {
+	if err != nil {
+		*errs = append(*errs, ConfigError{Field: field, Message: err.Error()})
+	}
+}
+
+// checkAddr returns an error if addr is not empty and not a host and port.
+func checkAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// NewClientFromJSON creates a new dnstt client from a configuration document,
+// a JSON object like this one, in which only version, domain, pubkey, listen,
+// and resolvers are required:
+//
+//	{
+//	  "version": 1,
+//	  "domain": "t.example.com",
+//	  "pubkey": "0123...cdef",
+//	  "listen": "127.0.0.1:1080",
+//	  "resolvers": ["tls://dns.example", "https://dns.example/dns-query"],
+//	  "utls": "3*Firefox,2*Chrome,1*iOS",
+//	  "http_proxy": "127.0.0.1:8080",
+//	  "dns": {"listen": "127.0.0.1:5353", "resolver": "9.9.9.9:53"},
+//	  "share": {"enabled": true, "allow": ["192.168.43.0/24"], "max_conns_per_client": 16},
+//	  "auth": {"users": [{"username": "alice", "password": "secret"}]},
+//	  "tuning": {
+//	    "lazy": true, "lazy_idle_seconds": 60, "stats_interval_seconds": 1,
+//	    "handshake_timeout_seconds": 10, "cover_interval_ms": 0,
+//	    "cover_random": false, "random_shape": true, "decoy_rate": 0.1
+//	  },
+//	  "rules": "direct 10.0.0.0/8 192.168.0.0/16\nblock :25",
+//	  "ssh": {"username": "alice", "password": "secret", "host_key": "SHA256:uNiVz..."}
+//	}
+//
+// The fields mean what the arguments of NewClient and the setters of
+// DnsttClient mean: resolvers are the resolver of NewClient followed by those
+// of AddResolver; utls is as for SetUTLSFingerprint; auth.users are added with
+// AddShareProxyUser; rules are as for SetRules; and ssh, with the fields
+// username, password, private_key, private_key_passphrase, and host_key, is as
+// for SetSSH. The tuning fields cover_interval_ms, cover_random, random_shape,
+// and decoy_rate control cover traffic and the shape of queries, as the
+// -cover, -cover-random, -random-shape, and -decoy-rate options of
+// dnstt-client do, and handshake_timeout_seconds is how long a Noise
+// handshake may take. version must be at most ConfigVersion, and unknown
+// fields are refused, so that a setting is never silently ignored. Settings
+// that are not part of the document, like SetTunFd and SetProtectSocket, are
+// made on the client afterward. If the document has problems, the error is a
+// ConfigErrors listing all of them.
+func NewClientFromJSON(configJSON string) (*DnsttClient, error) {
+	var cfg config
+	dec := json.NewDecoder(strings.NewReader(configJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, ConfigErrors{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	if dec.More() {
+		return nil, ConfigErrors{{Message: "invalid JSON: data after the document"}}
+	}
+
+	var errs ConfigErrors
+	switch {
+	case cfg.Version == 0:
+		errs.add("version", fmt.Errorf("missing"))
+	case cfg.Version < 0 || cfg.Version > ConfigVersion:
+		errs.add("version", fmt.Errorf("unsupported version %d; this client reads up to %d", cfg.Version, ConfigVersion))
+	}
+	_, err := dns.ParseNames(cfg.Domain)
+	errs.add("domain", err)
+	_, err = noise.DecodeKey(cfg.Pubkey)
+	errs.add("pubkey", err)
+	if cfg.Listen == "" {
+		errs.add("listen", fmt.Errorf("missing"))
+	} else {
+		errs.add("listen", checkAddr(cfg.Listen))
+	}
+	if len(cfg.Resolvers) == 0 {
+		errs.add("resolvers", fmt.Errorf("at least one resolver is required"))
+	}
+	for i, spec := range cfg.Resolvers {
+		_, err := client.ParseTransport(spec, client.TransportOptions{})
+		errs.add(fmt.Sprintf("resolvers[%d]", i), err)
+	}
+	if cfg.UTLS != nil {
+		_, err := client.SampleUTLSDistribution(*cfg.UTLS)
+		errs.add("utls", err)
+	}
+	errs.add("http_proxy", checkAddr(cfg.HTTPProxy))
+	errs.add("dns.listen", checkAddr(cfg.DNS.Listen))
+	errs.add("dns.resolver", checkAddr(cfg.DNS.Resolver))
+	shareAllow, err := access.ParsePrefixes(strings.Join(cfg.Share.Allow, ","))
+	if err != nil {
+		for i, s := range cfg.Share.Allow {
+			_, err := access.ParsePrefixes(s)
+			errs.add(fmt.Sprintf("share.allow[%d]", i), err)
+		}
+	}
+	if cfg.Share.MaxConnsPerClient < 0 {
+		errs.add("share.max_conns_per_client", fmt.Errorf("must not be negative"))
+	}
+	for i, user := range cfg.Auth.Users {
+		if user.Username == "" || len(user.Username) > 255 || len(user.Password) > 255 {
+			errs.add(fmt.Sprintf("auth.users[%d]", i), fmt.Errorf("username and password must be 1 to 255 bytes"))
+		}
+	}
+	tuning := &cfg.Tuning
+	if tuning.LazyIdleSeconds != nil && *tuning.LazyIdleSeconds < 0 {
+		errs.add("tuning.lazy_idle_seconds", fmt.Errorf("must not be negative"))
+	}
+	if tuning.StatsIntervalSeconds != nil && *tuning.StatsIntervalSeconds < 0 {
+		errs.add("tuning.stats_interval_seconds", fmt.Errorf("must not be negative"))
+	}
+	if tuning.HandshakeTimeoutSeconds < 0 {
+		errs.add("tuning.handshake_timeout_seconds", fmt.Errorf("must not be negative"))
+	}
+	if tuning.CoverIntervalMs < 0 {
+		errs.add("tuning.cover_interval_ms", fmt.Errorf("must not be negative"))
+	}
+	if tuning.DecoyRate < 0 || tuning.DecoyRate > 1 {
+		errs.add("tuning.decoy_rate", fmt.Errorf("must be between 0 and 1"))
+	}
+	rs, err := rules.Parse(strings.NewReader(cfg.Rules))
+	errs.add("rules", err)
+	var sshCfg *sshtunnel.Config
+	if ssh := &cfg.SSH; ssh.Username != "" || ssh.Password != "" || ssh.PrivateKey != "" || ssh.HostKey != "" {
+		sshCfg = &sshtunnel.Config{
+			User:     ssh.Username,
+			Password: ssh.Password,
+			HostKey:  ssh.HostKey,
+		}
+		if ssh.PrivateKey != "" {
+			sshCfg.PrivateKey = []byte(ssh.PrivateKey)
+			sshCfg.Passphrase = []byte(ssh.PrivateKeyPassphrase)
+		}
+		_, err := sshtunnel.New(*sshCfg, nil)
+		errs.add("ssh", err)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	c, err := NewClient(cfg.Resolvers[0], cfg.Domain, cfg.Pubkey, cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	c.resolvers = cfg.Resolvers[1:]
+	if cfg.UTLS != nil {
+		c.utlsSpec = *cfg.UTLS
+	}
+	c.httpProxyAddr = cfg.HTTPProxy
+	c.dnsListenAddr = cfg.DNS.Listen
+	c.dnsResolver = cfg.DNS.Resolver
+	c.shareProxy = cfg.Share.Enabled
+	c.shareAllow = shareAllow
+	c.shareMaxConns = cfg.Share.MaxConnsPerClient
+	for _, user := range cfg.Auth.Users {
+		if c.shareUsers == nil {
+			c.shareUsers = make(map[string]string)
+		}
+		c.shareUsers[user.Username] = user.Password
+	}
+	c.lazy = tuning.Lazy
+	if tuning.LazyIdleSeconds != nil {
+		c.lazyIdle = time.Duration(*tuning.LazyIdleSeconds) * time.Second
+	}
+	if tuning.StatsIntervalSeconds != nil {
+		c.statsInterval = time.Duration(*tuning.StatsIntervalSeconds) * time.Second
+	}
+	c.handshakeTimeout = time.Duration(tuning.HandshakeTimeoutSeconds) * time.Second
+	c.query = client.QueryOptions{
+		CoverInterval: time.Duration(tuning.CoverIntervalMs) * time.Millisecond,
+		CoverRandom:   tuning.CoverRandom,
+		RandomShape:   tuning.RandomShape,
+		DecoyRate:     tuning.DecoyRate,
+	}
+	if rs.Len() > 0 {
+		c.rules = rs
+	}
+	c.ssh = sshCfg
+	return c, nil
+}
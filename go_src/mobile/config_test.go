@@ -0,0 +1,132 @@
+package mobile
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+)
+
+const testPubkey = "0000111122223333444455556666777788889999aaaabbbbccccddddeeeeffff"
+
+// configJSON returns a valid configuration document with extra appended to its
+// fields, which may override them.
+func configJSON(extra string) string {
+	doc := `{"version": 1, "domain": "t.example.com", "pubkey": "` + testPubkey + `", ` +
+		`"listen": "127.0.0.1:1080", "resolvers": ["udp://127.0.0.1:53"]`
+	if extra != "" {
+		doc += ", " + extra
+	}
+	return doc + "}"
+}
+
+// Problems with a document are all reported, each with the path of its field.
+func TestNewClientFromJSONErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		doc    string
+		fields []string
+		text   string // Found in the message of the first error
+	}{
+		{"missing version", strings.Replace(configJSON(""), `"version": 1, `, "", 1), []string{"version"}, "missing"},
+		{"newer version", configJSON(`"version": 2`), []string{"version"}, "unsupported version 2"},
+		{"unknown field", configJSON(`"colour": "blue"`), []string{""}, "unknown field"},
+		{"trailing data", configJSON("") + ` {}`, []string{""}, "data after the document"},
+		{"not JSON", "version: 1", []string{""}, "invalid JSON"},
+		{
+			"several",
+			configJSON(`"resolvers": ["udp://127.0.0.1:53", "ftp://dns.example"], ` +
+				`"share": {"allow": ["not a prefix"]}, ` +
+				`"tuning": {"decoy_rate": 2}, ` +
+				`"ssh": {"username": "alice"}`),
+			[]string{"resolvers[1]", "share.allow[0]", "tuning.decoy_rate", "ssh"},
+			"",
+		},
+	} {
+		c, err := NewClientFromJSON(test.doc)
+		var errs ConfigErrors
+		if c != nil || !errors.As(err, &errs) {
+			t.Errorf("%s: got (%v, %v)", test.name, c, err)
+			continue
+		}
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: errors in %+q, expected %+q: %v", test.name, fields, test.fields, err)
+		}
+		if !strings.Contains(errs[0].Message, test.text) {
+			t.Errorf("%s: message %+q does not contain %+q", test.name, errs[0].Message, test.text)
+		}
+	}
+}
+
+// A valid document sets the fields of the client.
+func TestNewClientFromJSON(t *testing.T) {
+	c, err := NewClientFromJSON(configJSON(`
+		"resolvers": ["udp://127.0.0.1:53", "https://dns.example/dns-query"],
+		"utls": "Firefox",
+		"http_proxy": "127.0.0.1:8080",
+		"dns": {"listen": "127.0.0.1:5353", "resolver": "9.9.9.9:53"},
+		"share": {"enabled": true, "allow": ["192.168.43.0/24"], "max_conns_per_client": 16},
+		"auth": {"users": [{"username": "alice", "password": "secret"}]},
+		"tuning": {
+			"lazy": true, "lazy_idle_seconds": 0, "stats_interval_seconds": 5,
+			"handshake_timeout_seconds": 10, "cover_interval_ms": 200,
+			"cover_random": true, "random_shape": true, "decoy_rate": 0.1
+		},
+		"rules": "direct 10.0.0.0/8",
+		"ssh": {"username": "bob", "password": "hunter2", "host_key": "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"domain", c.domain, "t.example.com"},
+		{"dnsAddr", c.dnsAddr, "udp://127.0.0.1:53"},
+		{"listenAddr", c.listenAddr, "127.0.0.1:1080"},
+		{"resolvers", c.resolvers, []string{"https://dns.example/dns-query"}},
+		{"utlsSpec", c.utlsSpec, "Firefox"},
+		{"httpProxyAddr", c.httpProxyAddr, "127.0.0.1:8080"},
+		{"dnsListenAddr", c.dnsListenAddr, "127.0.0.1:5353"},
+		{"dnsResolver", c.dnsResolver, "9.9.9.9:53"},
+		{"shareProxy", c.shareProxy, true},
+		{"shareAllow", c.shareAllow, []netip.Prefix{netip.MustParsePrefix("192.168.43.0/24")}},
+		{"shareMaxConns", c.shareMaxConns, 16},
+		{"shareUsers", c.shareUsers, map[string]string{"alice": "secret"}},
+		{"lazy", c.lazy, true},
+		{"lazyIdle", c.lazyIdle, time.Duration(0)},
+		{"statsInterval", c.statsInterval, 5 * time.Second},
+		{"handshakeTimeout", c.handshakeTimeout, 10 * time.Second},
+		{"query", c.query, client.QueryOptions{
+			CoverInterval: 200 * time.Millisecond,
+			CoverRandom:   true,
+			RandomShape:   true,
+			DecoyRate:     0.1,
+		}},
+		{"rules", c.rules != nil, true},
+		{"ssh.User", c.ssh.User, "bob"},
+		{"ssh.Password", c.ssh.Password, "hunter2"},
+	} {
+		if !reflect.DeepEqual(check.got, check.expected) {
+			t.Errorf("%s: got %v, expected %v", check.name, check.got, check.expected)
+		}
+	}
+
+	// Settings left out keep the defaults of NewClient.
+	c, err = NewClientFromJSON(configJSON(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.utlsSpec != client.DefaultUTLSDistribution || c.lazyIdle != defaultLazyIdle ||
+		c.statsInterval != defaultStatsInterval || c.rules != nil || c.ssh != nil {
+		t.Errorf("defaults not kept: %+v", c)
+	}
+}
@@ -0,0 +1,124 @@
+package mobile
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+const (
+	// How many log messages ExportLogs returns, when not set
+	defaultLogBufferSize = 1000
+
+	// How many log messages may wait for the log listener before more are
+	// dropped
+	logQueueLen = 1024
+)
+
+// LogListener receives the log messages of the tunnel, as they are logged.
+// OnLog is called one message at a time, in order, from a goroutine of its
+// own, but messages are dropped if the listener falls far behind.
+type LogListener interface {
+	// OnLog is called with the level of a message, one of "debug", "info",
+	// "warn", or "error"; the subsystem it comes from, one of "transport",
+	// "kcp", "noise", "stream", "proxy", or "app"; and the message itself.
+	OnLog(level, tag, message string)
+}
+
+var (
+	logMu       sync.Mutex // Guards logListener and logRing
+	logListener LogListener
+	logRing     = logging.NewRing(defaultLogBufferSize)
+	logQueue    = make(chan logging.Entry, logQueueLen)
+	// Messages still go to standard error, which Android sends to logcat.
+	stderrLog = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+func init() {
+	logging.SetSink(logSink{})
+	// Also catch what is written to the standard log package, by this
+	// package's callers for example.
+	log.SetFlags(0)
+	log.SetOutput(logWriter{})
+	go func() {
+		for e := range logQueue {
+			logMu.Lock()
+			l := logListener
+			logMu.Unlock()
+			if l != nil {
+				l.OnLog(e.Level.String(), string(e.Tag), e.Message)
+			}
+		}
+	}()
+}
+
+// logSink is the logging.Sink of this package. It keeps messages in logRing,
+// writes them to standard error, and queues them for logListener.
+type logSink struct{}
+
+func (logSink) Log(e logging.Entry) {
+	logMu.Lock()
+	logRing.Log(e)
+	listening := logListener != nil
+	logMu.Unlock()
+	stderrLog.Printf("%s %s: %s", e.Level, e.Tag, e.Message)
+	if listening {
+		select {
+		case logQueue <- e:
+		default:
+		}
+	}
+}
+
+// logWriter is an io.Writer that logs every line written to it with level
+// info and tag app.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	logging.App.Infof("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// SetLogListener sets the listener to receive every log message, or removes
+// it if l is nil. The log is shared by all clients.
+func SetLogListener(l LogListener) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logListener = l
+}
+
+// SetLogLevel discards log messages below level, one of "debug", "info",
+// "warn", or "error". The default is "info".
+func SetLogLevel(level string) error {
+	l, err := logging.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logging.SetLevel(l)
+	return nil
+}
+
+// SetLogBufferSize sets how many of the most recent log messages are kept for
+// ExportLogs, 1000 by default. It discards the messages already kept.
+func SetLogBufferSize(lines int) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logRing = logging.NewRing(lines)
+}
+
+// ExportLogs returns the most recent log messages, oldest first, one per line,
+// to be attached to a bug report. Every line has the time in UTC, the level,
+// the subsystem, and the message, like
+//
+//	2026-01-02 15:04:05.000 warn transport: sendLoop: timeout
+func ExportLogs() string {
+	logMu.Lock()
+	ring := logRing
+	logMu.Unlock()
+	var b strings.Builder
+	ring.WriteTo(&b)
+	return b.String()
+}
@@ -2,47 +2,86 @@
 package mobile
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/base32"
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/access"
+	"www.bamsoftware.com/git/dnstt.git/client"
 	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/dnsproxy"
+	"www.bamsoftware.com/git/dnstt.git/httpproxy"
+	"www.bamsoftware.com/git/dnstt.git/logging"
 	"www.bamsoftware.com/git/dnstt.git/noise"
-	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+	"www.bamsoftware.com/git/dnstt.git/priority"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+	"www.bamsoftware.com/git/dnstt.git/socksproxy"
+	"www.bamsoftware.com/git/dnstt.git/sshtunnel"
+	"www.bamsoftware.com/git/dnstt.git/tun"
 )
 
 const (
-	// smux streams will be closed after this much time without receiving data.
-	idleTimeout = 2 * time.Minute
+	// Connection timeout for handshake (10 seconds for faster feedback),
+	// when not set
+	defaultHandshakeTimeout = 10 * time.Second
 
-	// Connection timeout for handshake (10 seconds for faster feedback)
-	handshakeTimeout = 10 * time.Second
+	// Resolver used by the DNS listener when none is set
+	defaultDNSResolver = "1.1.1.1:53"
 
-	// Padding configuration
-	numPadding        = 3
-	numPaddingForPoll = 8
+	// How long a lazy session may go without streams, when not set
+	defaultLazyIdle = 1 * time.Minute
 
-	// Poll timing
-	initPollDelay       = 500 * time.Millisecond
-	maxPollDelay        = 10 * time.Second
-	pollDelayMultiplier = 2.0
-	pollLimit           = 16
+	// How often to report traffic counters to the status listener, when
+	// not set
+	defaultStatsInterval = 1 * time.Second
+
+	// How many status events may wait for the status listener before
+	// more are dropped
+	statusQueueLen = 256
+)
+
+// States reported to a StatusListener and by GetState.
+const (
+	// Running, but there is no session. In lazy mode, one is established
+	// on first use.
+	StateDisconnected = "disconnected"
+	// Opening a transport to the DNS resolver for a new session
+	StateConnecting = "connecting"
+	// Doing the Noise handshake of a new session with the tunnel server
+	StateHandshaking = "handshaking"
+	// The tunnel is up
+	StateConnected = "connected"
+	// Establishing a new session after the last one was lost
+	StateReconnecting = "reconnecting"
+	// Not running
+	StateStopped = "stopped"
 )
 
-// base32Encoding is a base32 encoding without padding.
-var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+// StatusListener receives the state, traffic, and errors of a DnsttClient. Its
+// methods are called one at a time, in order, from a goroutine of their own,
+// so they need not return quickly, but events are dropped if the listener
+// falls far behind.
+type StatusListener interface {
+	// OnStateChanged is called with one of the State constants whenever
+	// the state changes.
+	OnStateChanged(state string)
+	// OnStats is called periodically, while running, with the bytes of
+	// tunnel data and the DNS messages sent and received since Start. It
+	// is not called when the counters have not changed.
+	OnStats(bytesSent, bytesReceived, queriesSent, responsesReceived int64)
+	// OnError is called when Start fails, or when a connection cannot be
+	// carried through the tunnel because no session can be established.
+	OnError(message string)
+}
 
 // ProtectSocketFunc is a callback to protect a socket from VPN routing
 type ProtectSocketFunc func(fd int) bool
@@ -52,20 +91,64 @@ type DnsttClient struct {
 	mu            sync.Mutex
 	running       bool
 	listener      net.Listener
-	conn          net.PacketConn
 	ctx           context.Context
 	cancel        context.CancelFunc
 	pubKey        []byte
 	domain        string
 	dnsAddr       string
 	listenAddr    string
-	sess          *smux.Session
+	resolvers     []string // Fallback DNS servers, after dnsAddr
+	utlsSpec      string   // TLS fingerprint distribution for DoH and DoT
+	manager       *client.SessionManager
 	tunFd         int
 	protectSocket ProtectSocketFunc
-	shareProxy    bool // If true, bind to 0.0.0.0 instead of 127.0.0.1
+	shareProxy    bool   // If true, bind to 0.0.0.0 instead of 127.0.0.1
+	httpProxyAddr string // If not empty, also listen for HTTP proxy requests
+	httpListener  net.Listener
+	tunStack      *tun.Stack
+	dnsListenAddr string // If not empty, also listen for DNS queries
+	dnsResolver   string // Resolver for DNS queries, reached through the tunnel
+	dnsServer     *dnsproxy.Server
+	lazy          bool               // If true, connect on first use and disconnect when idle
+	lazyIdle      time.Duration      // How long a lazy session may go without streams
+	rules         *rules.Rules       // Split tunneling rules, nil to tunnel everything
+	shareUsers    map[string]string  // Usernames and passwords for the shared proxy
+	shareAllow    []netip.Prefix     // Source addresses allowed to use the shared proxy
+	shareMaxConns int                // Per-client connection limit of the shared proxy
+	access        *access.Controller // Shared proxy access control, set by Start
+	statsInterval time.Duration      // How often to call OnStats, 0 to never
+	reconnecting  bool               // If true, NotifyNetworkChanged is reconnecting
+	reconnectMore bool               // If true, reconnect again after that
+
+	ssh       *sshtunnel.Config // If not nil, reach the Internet through SSH
+	sshClient *sshtunnel.Client // The SSH stage, set by Start when ssh is set
+
+	// Tuning, set only by NewClientFromJSON
+	handshakeTimeout time.Duration       // How long the Noise handshake may take, 0 for the default
+	query            client.QueryOptions // Timing and shape of queries
+
+	// statusMu guards the fields below. It may be locked while mu is
+	// held, but not the other way around.
+	statusMu sync.Mutex
+	status   StatusListener
+	state    string
+	events   chan func(StatusListener) // Queue of status events, nil when stopped
 }
 
-// NewClient creates a new dnstt client
+// NewClient creates a new dnstt client. dnsServer is the resolver through which
+// to reach the tunnel server, in one of these forms:
+//
+//	192.0.2.1 or 192.0.2.1:53 or udp://192.0.2.1:53  UDP DNS
+//	tls://dns.example:853                          DNS over TLS
+//	https://dns.example/dns-query                  DNS over HTTPS
+//	quic://dns.example:853                         DNS over QUIC
+//
+// The ports shown are the defaults. An IPv6 address is written in brackets, as
+// in [2001:db8::1]:53 or quic://[2001:db8::1]. A resolver named by a host with
+// both IPv6 and IPv4 addresses is reached at the first of them to answer, IPv6
+// first, and an IPv4 address is reached through NAT64 on a network with only
+// IPv6. tunnelDomain may be a comma-separated list of domains that are all
+// delegated to the same server.
 func NewClient(dnsServer, tunnelDomain, pubKeyHex, listenAddr string) (*DnsttClient, error) {
 	pubKey, err := noise.DecodeKey(pubKeyHex)
 	if err != nil {
@@ -73,27 +156,73 @@ func NewClient(dnsServer, tunnelDomain, pubKeyHex, listenAddr string) (*DnsttCli
 	}
 
 	return &DnsttClient{
-		pubKey:     pubKey,
-		domain:     tunnelDomain,
-		dnsAddr:    dnsServer,
-		listenAddr: listenAddr,
-		tunFd:      -1,
+		pubKey:        pubKey,
+		domain:        tunnelDomain,
+		dnsAddr:       dnsServer,
+		listenAddr:    listenAddr,
+		tunFd:         -1,
+		lazyIdle:      defaultLazyIdle,
+		utlsSpec:      client.DefaultUTLSDistribution,
+		statsInterval: defaultStatsInterval,
+		state:         StateStopped,
 	}, nil
 }
 
-// SetTunFd sets the TUN file descriptor for routing traffic
+// AddResolver adds a fallback resolver, in any of the forms accepted by
+// NewClient. The client starts with the resolver given to NewClient, and moves
+// to the next when the tunnel server cannot be reached through the one in use,
+// or when queries through it get no responses. After the last, it returns to
+// the first. Changes take effect at the next Start.
+func (c *DnsttClient) AddResolver(spec string) error {
+	if _, err := client.ParseTransport(spec, client.TransportOptions{}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolvers = append(c.resolvers, spec)
+	return nil
+}
+
+// SetUTLSFingerprint sets the TLS fingerprint of DoH and DoT connections, as a
+// weighted distribution like "3*Firefox,2*Chrome,1*iOS" from which one
+// fingerprint is chosen at each Start, or a single fingerprint like "Chrome".
+// "none" disables uTLS camouflage. Changes take effect at the next Start.
+func (c *DnsttClient) SetUTLSFingerprint(spec string) error {
+	if _, err := client.SampleUTLSDistribution(spec); err != nil {
+		return fmt.Errorf("invalid TLS fingerprint: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.utlsSpec = spec
+	return nil
+}
+
+// SetTunFd sets the TUN file descriptor for routing traffic. When it is set,
+// Start runs a userspace TCP/IP stack on the TUN device, and carries its TCP
+// connections and DNS queries through the tunnel, in addition to serving the
+// SOCKS5 listener. The server's upstream must be a SOCKS5 proxy. The client
+// takes ownership of fd once Start gets as far as starting the stack, and
+// closes it in Stop; set a new fd before starting again. A value of -1
+// disables TUN mode.
 func (c *DnsttClient) SetTunFd(fd int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.tunFd = fd
 }
 
-// SetProtectSocket sets a callback to protect sockets from VPN routing
+// SetProtectSocket sets a callback to protect sockets from VPN routing. It is
+// called with every socket the client opens to reach the DNS servers, whether
+// UDP, DoT, DoH, or DoQ, and with the sockets of direct connections.
 func (c *DnsttClient) SetProtectSocket(protectFunc ProtectSocketFunc) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.protectSocket = protectFunc
 }
 
-// SetShareProxy enables or disables proxy sharing (binding to 0.0.0.0)
+// SetShareProxy enables or disables proxy sharing (binding to 0.0.0.0). Access
+// to shared listeners can be limited with AddShareProxyUser,
+// SetShareProxyAllow, and SetShareProxyMaxConnsPerClient, and their usage is
+// reported by GetShareProxyStats.
 func (c *DnsttClient) SetShareProxy(enabled bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -107,166 +236,452 @@ func (c *DnsttClient) IsShareProxyEnabled() bool {
 	return c.shareProxy
 }
 
-// Start starts the SOCKS5 proxy
-func (c *DnsttClient) Start() error {
+// AddShareProxyUser adds a user who may use the shared proxy. Once there is a
+// user, clients of the shared proxy must authenticate: with SOCKS5
+// username/password authentication on the SOCKS5 listener, which is then
+// handled locally rather than forwarded to the server's upstream, and with
+// Basic authentication on the HTTP proxy listener. Adding an existing user
+// changes the password. Changes take effect at the next Start.
+func (c *DnsttClient) AddShareProxyUser(username, password string) error {
+	if username == "" || len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("username and password must be 1 to 255 bytes")
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-
-	if c.running {
-		return nil
+	if c.shareUsers == nil {
+		c.shareUsers = make(map[string]string)
 	}
+	c.shareUsers[username] = password
+	return nil
+}
 
-	// Parse domain
-	domain, err := dns.ParseName(c.domain)
+// ClearShareProxyUsers removes all users of the shared proxy, so that clients
+// need not authenticate.
+func (c *DnsttClient) ClearShareProxyUsers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shareUsers = nil
+}
+
+// SetShareProxyAllow sets the source addresses from which the shared proxy
+// accepts connections and DNS queries, as a list of CIDR prefixes or IP
+// addresses separated by commas, for example "192.168.43.0/24". The device's
+// own loopback addresses are always accepted. An empty list accepts every
+// address.
+func (c *DnsttClient) SetShareProxyAllow(cidrs string) error {
+	prefixes, err := access.ParsePrefixes(cidrs)
 	if err != nil {
-		return fmt.Errorf("invalid domain: %v", err)
+		return fmt.Errorf("invalid allowlist: %v", err)
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shareAllow = prefixes
+	return nil
+}
 
-	// Resolve DNS server address
-	dnsAddr := c.dnsAddr
-	if _, _, err := net.SplitHostPort(dnsAddr); err != nil {
-		dnsAddr = net.JoinHostPort(dnsAddr, "53")
-	}
+// SetShareProxyMaxConnsPerClient sets the maximum number of simultaneous
+// connections to the shared proxy from each client address. 0 means no limit.
+func (c *DnsttClient) SetShareProxyMaxConnsPerClient(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shareMaxConns = n
+}
 
-	remoteAddr, err := net.ResolveUDPAddr("udp", dnsAddr)
+// GetShareProxyStats returns the usage of the shared proxy by each client
+// since Start, as a JSON array of objects with the fields addr, user (the
+// username last authenticated), active (open connections), connections,
+// refused, bytes_up, bytes_down, and last_seen. It returns "[]" when proxy
+// sharing is not enabled.
+func (c *DnsttClient) GetShareProxyStats() string {
+	c.mu.Lock()
+	ac := c.access
+	c.mu.Unlock()
+	stats := []access.ClientStats{}
+	if ac != nil {
+		stats = ac.Stats()
+	}
+	text, err := json.Marshal(stats)
 	if err != nil {
-		return fmt.Errorf("failed to resolve DNS server: %v", err)
+		return "[]"
 	}
+	return string(text)
+}
+
+// SetHTTPProxyAddr sets the address of an HTTP proxy listener to open
+// alongside the SOCKS5 listener, for apps that only support an HTTP proxy.
+// An empty address disables it. The server's upstream must be a SOCKS5 proxy.
+func (c *DnsttClient) SetHTTPProxyAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.httpProxyAddr = addr
+}
+
+// SetDNSListenAddr sets the address of a DNS listener, on UDP and TCP, to open
+// alongside the SOCKS5 listener. It forwards queries through the tunnel to the
+// resolver set by SetDNSResolver, so that the system can be pointed at a DNS
+// server that is inside the tunnel. An empty address disables it. The server's
+// upstream must be a SOCKS5 proxy.
+func (c *DnsttClient) SetDNSListenAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dnsListenAddr = addr
+}
+
+// SetDNSResolver sets the resolver, as reached from the server side of the
+// tunnel, to which DNS queries are forwarded, for example "9.9.9.9:53". It
+// applies to the DNS listener (default 1.1.1.1:53) and to DNS queries on the
+// TUN device (default: the destination of each query).
+func (c *DnsttClient) SetDNSResolver(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dnsResolver = addr
+}
+
+// SetLazy enables or disables lazy mode. In lazy mode, Start opens the
+// listeners without connecting to the server, and the session is established
+// when the first connection arrives. It is closed again once it has had no
+// connections for the time set by SetLazyIdleSeconds, after which no queries
+// are sent until the next connection.
+func (c *DnsttClient) SetLazy(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lazy = enabled
+}
+
+// SetLazyIdleSeconds sets how long, in lazy mode, the session may go without
+// connections before it is closed (default 60). 0 keeps the session open once
+// it has been established.
+func (c *DnsttClient) SetLazyIdleSeconds(seconds int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lazyIdle = time.Duration(seconds) * time.Second
+}
 
-	// Create UDP connection - bind to 0.0.0.0 (IPv4 only) to avoid IPv6 routing issues
-	localAddr := &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 0,
+// SetRules sets split tunneling rules, which decide whether each connection
+// goes through the tunnel, directly to its destination, or nowhere, so that
+// local and domestic traffic does not use up the small capacity of the tunnel.
+// text has one rule per line, an action (tunnel, direct, or block) followed by
+// patterns: domain names, IP addresses and CIDR prefixes, ports like ":25" or
+// ":6881-6889", or "*". For example:
+//
+//	direct 10.0.0.0/8 192.168.0.0/16 .lan .ir
+//	block :25
+//
+// The first matching rule decides, and connections that match none go through
+// the tunnel. The rules apply to the SOCKS5, HTTP proxy, and DNS listeners and
+// to the TUN device. While rules are set, the SOCKS5 listener handles SOCKS5
+// requests itself, rather than forwarding connections to the server's
+// upstream as they are. On the TUN device, only addresses are known, so domain
+// patterns do not apply there. Direct connections are protected from VPN
+// routing. Empty text removes the rules. The rules take effect for new
+// connections, even while the client is running.
+func (c *DnsttClient) SetRules(text string) error {
+	rs, err := rules.Parse(strings.NewReader(text))
+	if err != nil {
+		return fmt.Errorf("invalid rules: %v", err)
+	}
+	if rs.Len() == 0 {
+		rs = nil
 	}
-	pconn, err := net.ListenUDP("udp4", localAddr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rs
+	return nil
+}
+
+// SetRulesFile is like SetRules, but reads the rules from a file.
+func (c *DnsttClient) SetRulesFile(path string) error {
+	text, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to create UDP socket: %v", err)
+		return err
 	}
+	return c.SetRules(string(text))
+}
 
-	// Protect the socket from VPN routing if callback is set
-	if c.protectSocket != nil {
-		// Get the file descriptor from the UDP connection
-		rawConn, err := pconn.SyscallConn()
-		if err != nil {
-			pconn.Close()
-			return fmt.Errorf("failed to get socket control: %v", err)
+// SetSSH makes the client reach its destinations through an SSH server that
+// is the tunnel server's upstream, as "ssh -D" would, rather than through a
+// SOCKS5 proxy. The SSH connection is carried by the tunnel itself, and every
+// connection of the SOCKS5, HTTP proxy, and DNS listeners and of the TUN
+// device is a direct-tcpip channel of it. The client logs in as username,
+// with privateKey (in OpenSSH or PEM format, decrypted with passphrase if it
+// is encrypted) if it is not empty, and with password if it is not empty.
+// hostKey is the server's host key, as in a known_hosts file, like
+// "ssh-ed25519 AAAAC3Nz...", or its fingerprint, like "SHA256:uNiVz..."; a
+// server with any other key is refused, and the error tells the server's
+// fingerprint, so that it can be shown to the user to confirm. Unless in lazy
+// mode, Start makes the SSH connection, and fails if it cannot. In lazy mode,
+// the SSH connection keeps the session open while it lasts. An empty username
+// disables SSH. Changes take effect at the next Start.
+func (c *DnsttClient) SetSSH(username, password, privateKey, passphrase, hostKey string) error {
+	var cfg *sshtunnel.Config
+	if username != "" {
+		cfg = &sshtunnel.Config{
+			User:     username,
+			Password: password,
+			HostKey:  hostKey,
 		}
-
-		var protectErr error
-		err = rawConn.Control(func(fd uintptr) {
-			if !c.protectSocket(int(fd)) {
-				protectErr = fmt.Errorf("failed to protect socket")
-			} else {
-				log.Printf("UDP socket protected from VPN routing (fd=%d)", fd)
-			}
-		})
-		if err != nil {
-			pconn.Close()
-			return fmt.Errorf("failed to control socket: %v", err)
+		if privateKey != "" {
+			cfg.PrivateKey = []byte(privateKey)
+			cfg.Passphrase = []byte(passphrase)
 		}
-		if protectErr != nil {
-			pconn.Close()
-			return protectErr
+		if _, err := sshtunnel.New(*cfg, nil); err != nil {
+			return fmt.Errorf("invalid SSH settings: %v", err)
 		}
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ssh = cfg
+	return nil
+}
 
-	c.conn = pconn
+// shareAddr returns the address to listen on for addr, taking proxy sharing
+// into account.
+func (c *DnsttClient) shareAddr(addr string) string {
+	if c.shareProxy {
+		// Replace 127.0.0.1 with 0.0.0.0 to allow connections from other devices
+		if strings.HasPrefix(addr, "127.0.0.1:") {
+			port := strings.TrimPrefix(addr, "127.0.0.1:")
+			addr = "0.0.0.0:" + port
+			logging.Proxy.Infof("Proxy sharing enabled, listening on %s", addr)
+		}
+	}
+	return addr
+}
 
-	// Create context
-	c.ctx, c.cancel = context.WithCancel(context.Background())
+// Start starts the SOCKS5 proxy. Unless in lazy mode, it first establishes a
+// session, and makes the SSH connection if SSH is enabled; Stop, called in the
+// meantime, cuts that short, and Start then fails.
+func (c *DnsttClient) Start() error {
+	c.mu.Lock()
+	if c.running {
+		c.mu.Unlock()
+		return nil
+	}
+	c.openStatus()
+	err := c.prepare()
+	if err != nil {
+		c.startFailed(err)
+		c.mu.Unlock()
+		return err
+	}
+	// From here on, Stop tears down what prepare set up.
+	c.running = true
+	m, sshClient, lazy := c.manager, c.sshClient, c.lazy
+	c.mu.Unlock()
 
-	// Calculate MTU
-	mtu := dnsNameCapacity(domain) - 8 - 1 - numPadding - 1
-	if mtu < 80 {
-		pconn.Close()
-		return fmt.Errorf("domain %s leaves only %d bytes for payload", domain, mtu)
+	// Connect without c.mu, so that Stop is not held up.
+	if !lazy {
+		err = m.Connect()
+		if err == nil && sshClient != nil {
+			err = sshClient.Connect()
+			if err != nil {
+				err = fmt.Errorf("SSH: %v", err)
+			}
+		}
 	}
-	log.Printf("effective MTU %d", mtu)
 
-	// Wrap in DNSPacketConn
-	dnsConn := newDNSPacketConn(pconn, remoteAddr, domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running || c.manager != m {
+		// Stop was called while connecting, and has already cleaned up.
+		return fmt.Errorf("stopped while starting")
+	}
+	if err == nil {
+		err = c.listen()
+	}
+	if err != nil {
+		c.cancel()
+		c.closeSession()
+		c.running = false
+		c.startFailed(err)
+		return err
+	}
+	logging.App.Infof("dnstt client started, listening on %s", c.listenAddr)
+	return nil
+}
 
-	// Open KCP connection
-	kcpConn, err := kcp.NewConn2(remoteAddr, nil, 0, 0, dnsConn)
+// startFailed reports err, the error of Start, and stops delivering status
+// events. c.mu must be held.
+func (c *DnsttClient) startFailed(err error) {
+	c.emit(func(l StatusListener) { l.OnError(err.Error()) })
+	c.closeStatus()
+}
+
+// prepare sets up the session manager and the SSH stage, if any, for Start,
+// without connecting. c.mu must be held.
+func (c *DnsttClient) prepare() error {
+	// Parse domain
+	domains, err := dns.ParseNames(c.domain)
 	if err != nil {
-		pconn.Close()
-		return fmt.Errorf("opening KCP conn: %v", err)
+		return fmt.Errorf("invalid domain: %v", err)
 	}
 
-	// Configure KCP
-	kcpConn.SetStreamMode(true)
-	kcpConn.SetNoDelay(0, 0, 0, 1)
-	kcpConn.SetWindowSize(turbotunnel.QueueSize/2, turbotunnel.QueueSize/2)
-	if !kcpConn.SetMtu(mtu) {
-		kcpConn.Close()
-		pconn.Close()
-		return fmt.Errorf("failed to set MTU")
+	// Set up the transports to the DNS servers, with their sockets
+	// protected from VPN routing
+	utlsClientHelloID, err := client.SampleUTLSDistribution(c.utlsSpec)
+	if err != nil {
+		return fmt.Errorf("invalid TLS fingerprint: %v", err)
+	}
+	transportOpts := client.TransportOptions{
+		UTLSClientHelloID: utlsClientHelloID,
+		Control:           protectControl(c.protectSocket),
+	}
+	var transports []client.Transport
+	for _, spec := range append([]string{c.dnsAddr}, c.resolvers...) {
+		transport, err := client.ParseTransport(spec, transportOpts)
+		if err != nil {
+			return err
+		}
+		transports = append(transports, transport)
 	}
 
-	// Create Noise channel with timeout
-	type noiseResult struct {
-		conn io.ReadWriteCloser
-		err  error
+	handshakeTimeout := c.handshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	opts := client.Options{
+		HandshakeTimeout: handshakeTimeout,
+		Query:            c.query,
+		StateFunc: func(state client.State) {
+			c.setState(state.String())
+		},
 	}
-	noiseResultChan := make(chan noiseResult, 1)
-	go func() {
-		conn, err := noise.NewClient(kcpConn, c.pubKey)
-		noiseResultChan <- noiseResult{conn, err}
-	}()
 
-	var noiseConn io.ReadWriteCloser
-	select {
-	case result := <-noiseResultChan:
-		if result.err != nil {
-			kcpConn.Close()
-			pconn.Close()
-			return fmt.Errorf("failed to create noise session: %v", result.err)
+	// Calculate MTU
+	mtu := client.EndpointMTU(domains, opts.Query)
+	if mtu < 80 {
+		return fmt.Errorf("domain %s leaves only %d bytes for payload", c.domain, mtu)
+	}
+	logging.App.Infof("effective MTU %d", mtu)
+
+	// Create context
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if c.lazy {
+		opts.LazyIdle = c.lazyIdle
+	}
+	endpoint := client.Endpoint{Domains: domains, Pubkey: c.pubKey}
+	c.manager = client.NewSessionManager([]client.Endpoint{endpoint}, transports, opts)
+	if c.lazy {
+		logging.App.Infof("lazy mode: connecting on first use")
+		c.setState(StateDisconnected)
+	}
+
+	// Set up the SSH stage, if enabled, over a stream of the session
+	if c.ssh != nil {
+		m := c.manager
+		sshClient, err := sshtunnel.New(*c.ssh, func() (net.Conn, error) {
+			stream, _, err := m.OpenStream(priority.Auto)
+			if err != nil {
+				return nil, err
+			}
+			return stream, nil
+		})
+		if err != nil {
+			c.cancel()
+			c.closeSession()
+			return fmt.Errorf("SSH: %v", err)
 		}
-		noiseConn = result.conn
-	case <-time.After(handshakeTimeout):
-		kcpConn.Close()
-		pconn.Close()
-		return fmt.Errorf("connection timeout: DNS server not responding")
-	}
-
-	// Start smux session
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = idleTimeout
-	smuxConfig.MaxStreamBuffer = 1 * 1024 * 1024
-	sess, err := smux.Client(noiseConn, smuxConfig)
-	if err != nil {
-		noiseConn.Close()
-		pconn.Close()
-		return fmt.Errorf("opening smux session: %v", err)
+		c.sshClient = sshClient
 	}
-	c.sess = sess
+	return nil
+}
 
+// listen opens the listeners and the TUN stack for Start, once connected.
+// Start closes the session if it fails. c.mu must be held.
+func (c *DnsttClient) listen() error {
 	// Determine the listen address based on proxy sharing
-	listenAddr := c.listenAddr
+	listenAddr := c.shareAddr(c.listenAddr)
+
+	// Control access to shared listeners
+	c.access = nil
+	var authenticate func(net.Conn, string, string) bool
+	var allow func(net.Addr) bool
 	if c.shareProxy {
-		// Replace 127.0.0.1 with 0.0.0.0 to allow connections from other devices
-		if strings.HasPrefix(listenAddr, "127.0.0.1:") {
-			port := strings.TrimPrefix(listenAddr, "127.0.0.1:")
-			listenAddr = "0.0.0.0:" + port
-			log.Printf("Proxy sharing enabled, listening on %s", listenAddr)
+		c.access = access.NewController(access.Policy{
+			Allow:             c.shareAllow,
+			Users:             c.shareUsers,
+			MaxConnsPerClient: c.shareMaxConns,
+		})
+		if c.access.AuthRequired() {
+			authenticate = c.access.Authenticate
 		}
+		allow = c.access.Allowed
 	}
 
 	// Start TCP listener for SOCKS5
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		sess.Close()
-		pconn.Close()
 		return fmt.Errorf("failed to start listener: %v", err)
 	}
+	if c.access != nil {
+		listener = c.access.Listener(listener)
+	}
 	c.listener = listener
 
+	// Start the HTTP proxy listener, if enabled
+	if c.httpProxyAddr != "" {
+		httpListener, err := net.Listen("tcp", c.shareAddr(c.httpProxyAddr))
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to start HTTP proxy listener: %v", err)
+		}
+		c.httpListener = httpListener
+		if c.access != nil {
+			httpListener = c.access.Listener(httpListener)
+		}
+		server := &httpproxy.Server{Dial: c.dial, Authenticate: authenticate}
+		go server.Serve(httpListener)
+		logging.Proxy.Infof("HTTP proxy listening on %s", httpListener.Addr())
+	}
+
+	// Start the DNS listener, if enabled
+	if c.dnsListenAddr != "" {
+		resolver := c.dnsResolver
+		if resolver == "" {
+			resolver = defaultDNSResolver
+		}
+		dnsServer, err := dnsproxy.ListenAllow(c.shareAddr(c.dnsListenAddr), resolver, c.dial, allow)
+		if err != nil {
+			if c.httpListener != nil {
+				c.httpListener.Close()
+				c.httpListener = nil
+			}
+			listener.Close()
+			return fmt.Errorf("failed to start DNS listener: %v", err)
+		}
+		c.dnsServer = dnsServer
+		logging.Proxy.Infof("DNS listening on %s, forwarding to %s", dnsServer.Addr(), resolver)
+	}
+
+	// Start the TCP/IP stack on the TUN device, if enabled
+	if c.tunFd >= 0 {
+		tunStack, err := tun.New(c.tunFd, 0, c.dial, c.dnsResolver)
+		// tun.New has taken ownership of the fd, even on error.
+		c.tunFd = -1
+		if err != nil {
+			if c.httpListener != nil {
+				c.httpListener.Close()
+				c.httpListener = nil
+			}
+			if c.dnsServer != nil {
+				c.dnsServer.Close()
+				c.dnsServer = nil
+			}
+			listener.Close()
+			return fmt.Errorf("failed to start TUN stack: %v", err)
+		}
+		c.tunStack = tunStack
+		logging.Proxy.Infof("TUN stack running")
+	}
+
 	// Accept connections
 	go c.acceptLoop()
 
-	c.running = true
-	log.Printf("dnstt client started, listening on %s", c.listenAddr)
+	if c.statsInterval > 0 {
+		go c.statsLoop(c.ctx, c.manager, c.statsInterval)
+	}
+
 	return nil
 }
 
@@ -282,341 +697,395 @@ func (c *DnsttClient) Stop() {
 	if c.cancel != nil {
 		c.cancel()
 	}
-	if c.sess != nil {
-		c.sess.Close()
-	}
+	c.closeSession()
 	if c.listener != nil {
 		c.listener.Close()
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	if c.httpListener != nil {
+		c.httpListener.Close()
+		c.httpListener = nil
 	}
+	if c.dnsServer != nil {
+		c.dnsServer.Close()
+		c.dnsServer = nil
+	}
+	if c.tunStack != nil {
+		// This also closes the TUN fd.
+		c.tunStack.Close()
+		c.tunStack = nil
+	}
+	c.closeStatus()
 
 	c.running = false
-	log.Printf("dnstt client stopped")
+	logging.App.Infof("dnstt client stopped")
 }
 
-// IsRunning returns whether the client is running
+// IsRunning returns whether the client is running, which it is from the time
+// Start begins connecting.
 func (c *DnsttClient) IsRunning() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return c.running
 }
 
-// DialTunnel creates a connection through the tunnel to the specified address
-func (c *DnsttClient) DialTunnel(address string) (net.Conn, error) {
+// Reconnect re-establishes the tunnel after a change of network. It moves
+// the session onto new sockets to the DNS server, which are protected like
+// the first, and keeps the session and its connections if the tunnel server
+// can still be reached. Otherwise, it establishes a new session, trying
+// several times with increasing delays. The listeners stay open throughout.
+// Reconnect blocks until it is done, and does nothing if there is no session,
+// as in lazy mode before first use.
+func (c *DnsttClient) Reconnect() error {
 	c.mu.Lock()
-	sess := c.sess
+	m := c.manager
 	c.mu.Unlock()
-
-	if sess == nil {
-		return nil, fmt.Errorf("tunnel not connected")
+	if m == nil {
+		return fmt.Errorf("tunnel not running")
 	}
-
-	stream, err := sess.OpenStream()
+	logging.Transport.Infof("reconnecting")
+	err := m.Reconnect()
 	if err != nil {
-		return nil, err
+		c.emit(func(l StatusListener) { l.OnError(err.Error()) })
 	}
-
-	return stream, nil
+	return err
 }
 
-func (c *DnsttClient) acceptLoop() {
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		default:
-		}
-
-		conn, err := c.listener.Accept()
-		if err != nil {
-			if c.ctx.Err() != nil {
+// NotifyNetworkChanged tells the client that the network has changed, for
+// example from ConnectivityManager.NetworkCallback on Android or
+// NWPathMonitor on iOS. It reconnects in the background, as Reconnect does,
+// and returns at once. Notifications that come while reconnecting cause one
+// more reconnection afterwards.
+func (c *DnsttClient) NotifyNetworkChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return
+	}
+	if c.reconnecting {
+		c.reconnectMore = true
+		return
+	}
+	c.reconnecting = true
+	go func() {
+		for {
+			c.Reconnect()
+			c.mu.Lock()
+			if !c.reconnectMore || !c.running {
+				c.reconnecting = false
+				c.mu.Unlock()
 				return
 			}
-			continue
+			c.reconnectMore = false
+			c.mu.Unlock()
 		}
+	}()
+}
 
-		go c.handleConnection(conn.(*net.TCPConn))
-	}
+// SetStatusListener sets the listener to receive state changes, traffic
+// counters, and errors, or removes it if l is nil. It may be called at any
+// time.
+func (c *DnsttClient) SetStatusListener(l StatusListener) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.status = l
 }
 
-func (c *DnsttClient) handleConnection(local *net.TCPConn) {
-	defer local.Close()
+// SetStatsIntervalSeconds sets how often the status listener's OnStats is
+// called, 1 second by default. 0 disables OnStats. Must be called before
+// Start.
+func (c *DnsttClient) SetStatsIntervalSeconds(seconds int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statsInterval = time.Duration(seconds) * time.Second
+}
 
-	stream, err := c.sess.OpenStream()
+// GetState returns the current state, one of the State constants.
+func (c *DnsttClient) GetState() string {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.state
+}
+
+// GetStats returns the traffic since Start as a JSON object with the fields
+// bytes_sent, bytes_received, queries_sent, and responses_received, the same
+// counters as are passed to OnStats. They are 0 when not running.
+func (c *DnsttClient) GetStats() string {
+	c.mu.Lock()
+	m := c.manager
+	c.mu.Unlock()
+	var stats client.Stats
+	if m != nil {
+		stats = m.Stats()
+	}
+	text, err := json.Marshal(struct {
+		BytesSent         uint64 `json:"bytes_sent"`
+		BytesReceived     uint64 `json:"bytes_received"`
+		QueriesSent       uint64 `json:"queries_sent"`
+		ResponsesReceived uint64 `json:"responses_received"`
+	}{stats.BytesSent, stats.BytesReceived, stats.QueriesSent, stats.ResponsesReceived})
 	if err != nil {
-		log.Printf("failed to open stream: %v", err)
-		return
+		return "{}"
 	}
-	defer stream.Close()
-
-	log.Printf("new stream opened")
+	return string(text)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+// openStatus starts delivering status events to the listener.
+func (c *DnsttClient) openStatus() {
+	events := make(chan func(StatusListener), statusQueueLen)
+	c.statusMu.Lock()
+	c.events = events
+	c.statusMu.Unlock()
 	go func() {
-		defer wg.Done()
-		io.Copy(stream, local)
-		local.CloseRead()
-		stream.Close()
-	}()
-	go func() {
-		defer wg.Done()
-		io.Copy(local, stream)
-		local.CloseWrite()
+		for event := range events {
+			c.statusMu.Lock()
+			l := c.status
+			c.statusMu.Unlock()
+			if l != nil {
+				event(l)
+			}
+		}
 	}()
-	wg.Wait()
 }
 
-// dnsNameCapacity returns the number of bytes remaining for encoded data
-func dnsNameCapacity(domain dns.Name) int {
-	capacity := 255
-	capacity -= 1 // null terminator
-	for _, label := range domain {
-		capacity -= len(label) + 1
+// closeStatus changes the state to StateStopped, and stops delivering status
+// events after that one.
+func (c *DnsttClient) closeStatus() {
+	c.setState(StateStopped)
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if c.events != nil {
+		close(c.events)
+		c.events = nil
 	}
-	capacity = capacity * 63 / 64
-	capacity = capacity * 5 / 8
-	return capacity
 }
 
-// DNSPacketConn wraps a PacketConn to do DNS encoding/decoding
-type dnsPacketConn struct {
-	clientID turbotunnel.ClientID
-	domain   dns.Name
-	pollChan chan struct{}
-	*turbotunnel.QueuePacketConn
+// setState changes the state and reports it to the listener. Changes other
+// than to StateStopped are ignored when not running, as they may come late
+// from a session being closed.
+func (c *DnsttClient) setState(state string) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if state == c.state || (c.events == nil && state != StateStopped) {
+		return
+	}
+	c.state = state
+	c.emitLocked(func(l StatusListener) { l.OnStateChanged(state) })
+}
+
+// emit queues a status event for the listener. The event is dropped if the
+// queue is full.
+func (c *DnsttClient) emit(event func(StatusListener)) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.emitLocked(event)
 }
 
-func newDNSPacketConn(transport net.PacketConn, addr net.Addr, domain dns.Name) *dnsPacketConn {
-	clientID := turbotunnel.NewClientID()
-	c := &dnsPacketConn{
-		clientID:        clientID,
-		domain:          domain,
-		pollChan:        make(chan struct{}, pollLimit),
-		QueuePacketConn: turbotunnel.NewQueuePacketConn(clientID, 0),
+// emitLocked is like emit, but c.statusMu must be held.
+func (c *DnsttClient) emitLocked(event func(StatusListener)) {
+	if c.events == nil {
+		return
+	}
+	select {
+	case c.events <- event:
+	default:
 	}
-	go c.recvLoop(transport)
-	go c.sendLoop(transport, addr)
-	return c
 }
 
-func (c *dnsPacketConn) recvLoop(transport net.PacketConn) {
+// statsLoop reports the traffic counters of m to the listener every interval,
+// until ctx is done.
+func (c *DnsttClient) statsLoop(ctx context.Context, m *client.SessionManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last client.Stats
 	for {
-		var buf [4096]byte
-		n, addr, err := transport.ReadFrom(buf[:])
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
-			}
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
-
-		resp, err := dns.MessageFromWireFormat(buf[:n])
-		if err != nil {
-			continue
-		}
-
-		payload := c.dnsResponsePayload(&resp)
-		if payload == nil {
+		stats := m.Stats()
+		if stats == last {
 			continue
 		}
+		last = stats
+		c.emit(func(l StatusListener) {
+			l.OnStats(int64(stats.BytesSent), int64(stats.BytesReceived), int64(stats.QueriesSent), int64(stats.ResponsesReceived))
+		})
+	}
+}
 
-		r := bytes.NewReader(payload)
-		any := false
-		for {
-			p, err := c.nextPacket(r)
-			if err != nil {
-				break
-			}
-			any = true
-			c.QueuePacketConn.QueueIncoming(p, addr)
-		}
-
-		if any {
-			select {
-			case c.pollChan <- struct{}{}:
-			default:
-			}
-		}
+// DialTunnel creates a connection through the tunnel to the specified address
+func (c *DnsttClient) DialTunnel(address string) (net.Conn, error) {
+	stream, err := c.openStream()
+	if err != nil {
+		return nil, err
 	}
+
+	return stream, nil
 }
 
-func (c *dnsPacketConn) dnsResponsePayload(resp *dns.Message) []byte {
-	if resp.Flags&0x8000 != 0x8000 {
-		return nil
+// openStream opens a new stream on the session, first establishing a session
+// if there is none, as in lazy mode, or if the last one has been closed.
+func (c *DnsttClient) openStream() (*smux.Stream, error) {
+	c.mu.Lock()
+	m := c.manager
+	c.mu.Unlock()
+	if m == nil {
+		return nil, fmt.Errorf("tunnel not connected")
 	}
-	if resp.Flags&0x000f != dns.RcodeNoError {
-		return nil
+	stream, _, err := m.OpenStream(priority.Auto)
+	if err != nil {
+		c.emit(func(l StatusListener) { l.OnError(err.Error()) })
 	}
-	if len(resp.Answer) != 1 {
-		return nil
+	return stream, err
+}
+
+// closeSession closes the SSH stage, if any, and the session manager and its
+// session, if any. c.mu must be held.
+func (c *DnsttClient) closeSession() {
+	if c.sshClient != nil {
+		c.sshClient.Close()
+		c.sshClient = nil
 	}
-	answer := resp.Answer[0]
-	_, ok := answer.Name.TrimSuffix(c.domain)
-	if !ok {
-		return nil
+	if c.manager != nil {
+		c.manager.Close()
+		c.manager = nil
 	}
-	if answer.Type != dns.RRTypeTXT {
-		return nil
+}
+
+// dialTarget opens a stream through the tunnel and asks the server's upstream
+// SOCKS5 proxy to connect it to addr, or, with SSH, opens a channel to addr.
+func (c *DnsttClient) dialTarget(network, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	sshClient := c.sshClient
+	c.mu.Unlock()
+	if sshClient != nil {
+		if err := sshClient.Connect(); err != nil {
+			c.emit(func(l StatusListener) { l.OnError("SSH: " + err.Error()) })
+			return nil, err
+		}
+		return sshClient.Dial(network, addr)
 	}
-	payload, err := dns.DecodeRDataTXT(answer.Data)
+
+	stream, err := c.DialTunnel(addr)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return payload
+	return client.DialSOCKS(stream, network, addr)
 }
 
-func (c *dnsPacketConn) nextPacket(r *bytes.Reader) ([]byte, error) {
-	var n uint16
-	err := binary.Read(r, binary.BigEndian, &n)
-	if err != nil {
-		return nil, err
+// dial connects to addr through the tunnel, or as the split tunneling rules
+// say.
+func (c *DnsttClient) dial(network, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	rs := c.rules
+	c.mu.Unlock()
+	return rs.Dialer(c.dialTarget, c.dialDirect)(network, addr)
+}
+
+// dialDirect connects to addr outside the tunnel, with the socket protected
+// from VPN routing.
+func (c *DnsttClient) dialDirect(network, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	protect := c.protectSocket
+	c.mu.Unlock()
+	logging.Stream.Debugf("direct connection to %s", addr)
+	return client.DialDirect(network, addr, protectControl(protect))
+}
+
+// protectControl returns a net.Dialer.Control function that protects sockets
+// from VPN routing using protect, or nil if protect is nil.
+func protectControl(protect ProtectSocketFunc) func(network, address string, rawConn syscall.RawConn) error {
+	if protect == nil {
+		return nil
 	}
-	p := make([]byte, n)
-	_, err = io.ReadFull(r, p)
-	if err == io.EOF {
-		err = io.ErrUnexpectedEOF
+	return func(network, address string, rawConn syscall.RawConn) error {
+		var protectErr error
+		err := rawConn.Control(func(fd uintptr) {
+			if !protect(int(fd)) {
+				protectErr = fmt.Errorf("failed to protect socket")
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return protectErr
 	}
-	return p, err
 }
 
-func (c *dnsPacketConn) sendLoop(transport net.PacketConn, addr net.Addr) {
-	pollDelay := initPollDelay
-	pollTimer := time.NewTimer(pollDelay)
+func (c *DnsttClient) acceptLoop() {
 	for {
-		var p []byte
-		outgoing := c.QueuePacketConn.OutgoingQueue(addr)
-		pollTimerExpired := false
-
 		select {
-		case p = <-outgoing:
+		case <-c.ctx.Done():
+			return
 		default:
-			select {
-			case p = <-outgoing:
-			case <-c.pollChan:
-			case <-pollTimer.C:
-				pollTimerExpired = true
-			}
-		}
-
-		if len(p) > 0 {
-			select {
-			case <-c.pollChan:
-			default:
-			}
 		}
 
-		if pollTimerExpired {
-			pollDelay = time.Duration(float64(pollDelay) * pollDelayMultiplier)
-			if pollDelay > maxPollDelay {
-				pollDelay = maxPollDelay
-			}
-		} else {
-			if !pollTimer.Stop() {
-				<-pollTimer.C
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
 			}
-			pollDelay = initPollDelay
+			continue
 		}
-		pollTimer.Reset(pollDelay)
 
-		err := c.send(transport, p, addr)
-		if err != nil {
-			log.Printf("send: %v", err)
-		}
+		go c.handleConnection(conn.(halfCloseConn))
 	}
 }
 
-func (c *dnsPacketConn) send(transport net.PacketConn, p []byte, addr net.Addr) error {
-	var decoded []byte
-	{
-		if len(p) >= 224 {
-			return fmt.Errorf("packet too long")
-		}
-		var buf bytes.Buffer
-		buf.Write(c.clientID[:])
-		n := numPadding
-		if len(p) == 0 {
-			n = numPaddingForPoll
-		}
-		buf.WriteByte(byte(224 + n))
-		io.CopyN(&buf, rand.Reader, int64(n))
-		if len(p) > 0 {
-			buf.WriteByte(byte(len(p)))
-			buf.Write(p)
-		}
-		decoded = buf.Bytes()
-	}
+// halfCloseConn is a connection that supports half-closing, like
+// *net.TCPConn.
+type halfCloseConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
 
-	encoded := make([]byte, base32Encoding.EncodedLen(len(decoded)))
-	base32Encoding.Encode(encoded, decoded)
-	encoded = bytes.ToLower(encoded)
-	labels := chunks(encoded, 63)
-	labels = append(labels, c.domain...)
-	name, err := dns.NewName(labels)
-	if err != nil {
-		return err
-	}
+func (c *DnsttClient) handleConnection(local halfCloseConn) {
+	defer local.Close()
 
-	var id uint16
-	binary.Read(rand.Reader, binary.BigEndian, &id)
-	query := &dns.Message{
-		ID:    id,
-		Flags: 0x0100,
-		Question: []dns.Question{
-			{
-				Name:  name,
-				Type:  dns.RRTypeTXT,
-				Class: dns.ClassIN,
-			},
-		},
-		Additional: []dns.RR{
-			{
-				Name:  dns.Name{},
-				Type:  dns.RRTypeOPT,
-				Class: 4096,
-				TTL:   0,
-				Data:  []byte{},
-			},
-		},
+	c.mu.Lock()
+	splitTunnel := c.rules != nil
+	viaSSH := c.sshClient != nil
+	var authenticate func(net.Conn, string, string) bool
+	if c.access != nil && c.access.AuthRequired() {
+		authenticate = c.access.Authenticate
 	}
-	wireData, err := query.WireFormat()
-	if err != nil {
-		return err
+	c.mu.Unlock()
+	if splitTunnel || viaSSH || authenticate != nil {
+		// Handle the SOCKS5 request here, to learn the destination or
+		// to authenticate the client.
+		server := &socksproxy.Server{Dial: c.dial, Authenticate: authenticate}
+		err := server.Handle(local)
+		if err != nil {
+			logging.Proxy.Warnf("SOCKS proxy: %v", err)
+		}
+		return
 	}
 
-	_, err = transport.WriteTo(wireData, addr)
-	// Don't return error on network failures - just log and continue
-	// This prevents temporary network issues from killing the tunnel
-	if err != nil && !isNetworkClosedError(err) {
-		return err
+	stream, err := c.openStream()
+	if err != nil {
+		logging.Stream.Errorf("failed to open stream: %v", err)
+		return
 	}
-	return nil
-}
+	defer stream.Close()
 
-func isNetworkClosedError(err error) bool {
-	if err == nil {
-		return false
-	}
-	// Check for "use of closed network connection" and similar errors
-	errStr := err.Error()
-	return strings.Contains(errStr, "closed network connection") ||
-		strings.Contains(errStr, "broken pipe") ||
-		strings.Contains(errStr, "connection refused")
-}
+	logging.Stream.Debugf("new stream opened")
 
-func chunks(p []byte, n int) [][]byte {
-	var result [][]byte
-	for len(p) > 0 {
-		sz := len(p)
-		if sz > n {
-			sz = n
-		}
-		result = append(result, p[:sz])
-		p = p[sz:]
-	}
-	return result
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stream, local)
+		local.CloseRead()
+		stream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(local, stream)
+		local.CloseWrite()
+	}()
+	wg.Wait()
 }
 
 // GetLocalIPAddresses returns a comma-separated list of local IP addresses
@@ -682,20 +1151,54 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
-// ConnectWithTunFd starts the tunnel using a TUN file descriptor from Android
-// This allows the Go code to handle TCP/IP directly
+// tunClient is the client started by ConnectWithTunFd.
+var (
+	tunClientLock sync.Mutex
+	tunClient     *DnsttClient
+)
+
+// ConnectWithTunFd starts the tunnel using a TUN file descriptor from Android.
+// The Go code handles TCP/IP directly: TCP connections and DNS queries on the
+// TUN device are carried through the tunnel, without a tun2socks process. A
+// SOCKS5 listener is also started at socksAddr. Any client previously started
+// by ConnectWithTunFd is stopped first. The client takes ownership of fd, and
+// closes it even if starting fails.
 func ConnectWithTunFd(fd int, dnsServer, tunnelDomain, pubKeyHex, socksAddr string) error {
-	// Create a file from the fd
-	tunFile := os.NewFile(uintptr(fd), "tun")
-	if tunFile == nil {
-		return fmt.Errorf("invalid tun fd")
+	tunClientLock.Lock()
+	defer tunClientLock.Unlock()
+
+	if tunClient != nil {
+		tunClient.Stop()
+		tunClient = nil
 	}
 
-	log.Printf("TUN fd received: %d", fd)
+	logging.App.Infof("TUN fd received: %d", fd)
+	client, err := NewClient(dnsServer, tunnelDomain, pubKeyHex, socksAddr)
+	if err != nil {
+		os.NewFile(uintptr(fd), "tun").Close()
+		return err
+	}
+	client.SetTunFd(fd)
+	err = client.Start()
+	if err != nil {
+		if client.tunFd >= 0 {
+			// Start failed before handing the fd to the stack.
+			os.NewFile(uintptr(fd), "tun").Close()
+		}
+		return err
+	}
+	tunClient = client
+	return nil
+}
 
-	// For now, we don't use gvisor netstack - that would require more dependencies
-	// Instead, we just log that this feature needs tun2socks integration
-	log.Printf("Note: Full TUN integration requires tun2socks - using SOCKS5 proxy mode")
+// DisconnectTun stops the client started by ConnectWithTunFd, and closes its
+// TUN file descriptor.
+func DisconnectTun() {
+	tunClientLock.Lock()
+	defer tunClientLock.Unlock()
 
-	return nil
+	if tunClient != nil {
+		tunClient.Stop()
+		tunClient = nil
+	}
 }
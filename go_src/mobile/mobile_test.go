@@ -0,0 +1,58 @@
+package mobile
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/tunneltest"
+)
+
+// Stop does not wait for Start to make the SSH connection, and cuts it short.
+func TestStopDuringSSHConnect(t *testing.T) {
+	// The SSH server never answers.
+	streams := make(chan net.Conn, 1)
+	server, err := tunneltest.NewServer("t.example.com", tunneltest.Options{
+		Handle: func(stream net.Conn) { streams <- stream },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	c, err := NewClient(server.Addr().String(), "t.example.com", hex.EncodeToString(server.Pubkey()), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetSSH("user", "password", "", "", "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Start()
+	}()
+	select {
+	case stream := <-streams:
+		defer stream.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("no SSH connection was made")
+	}
+
+	start := time.Now()
+	c.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Stop took %v", d)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Start succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start not cut short by Stop")
+	}
+	if c.IsRunning() || c.GetState() != StateStopped {
+		t.Errorf("client is %s after Stop", c.GetState())
+	}
+}
@@ -0,0 +1,189 @@
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/client"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+)
+
+// Scanner tests many DNS resolvers at once, to find those through which a
+// tunnel server can be reached.
+type Scanner struct {
+	mu            sync.Mutex
+	endpoint      client.Endpoint
+	workers       int
+	timeout       time.Duration
+	mode          string
+	mtu           int
+	protectSocket ProtectSocketFunc
+	listener      ScanListener
+	cancel        context.CancelFunc // Cancels the scan in progress, if any
+}
+
+// ScanListener receives the result of each resolver as soon as it is known,
+// while Scan runs.
+type ScanListener interface {
+	// OnResult is called with the result of one resolver, a JSON object as
+	// described by Scan. Calls are not concurrent.
+	OnResult(result string)
+}
+
+// NewScanner creates a Scanner for the tunnel server at tunnelDomain, which
+// may be a comma-separated list as in NewClient, with the given public key.
+func NewScanner(tunnelDomain, pubKeyHex string) (*Scanner, error) {
+	pubKey, err := noise.DecodeKey(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	domains, err := dns.ParseNames(tunnelDomain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain: %v", err)
+	}
+	return &Scanner{
+		endpoint: client.Endpoint{Domains: domains, Pubkey: pubKey},
+	}, nil
+}
+
+// SetWorkers sets how many resolvers are tested at once, 16 by default.
+func (s *Scanner) SetWorkers(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = n
+}
+
+// SetTimeoutSeconds sets how long the test of one resolver may take, 15
+// seconds by default.
+func (s *Scanner) SetTimeoutSeconds(seconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout = time.Duration(seconds) * time.Second
+}
+
+// SetMode sets how far the test of each resolver goes: "data" (the default),
+// a handshake and a round trip through the tunnel to the server's upstream, to
+// which any reply will do; "handshake", only the handshake; or "echo", a
+// handshake and a round trip that must come back unchanged, in packets of the
+// size set by SetMTU, for a server whose upstream is an echo server, so that
+// the test needs nothing beyond the tunnel.
+func (s *Scanner) SetMode(mode string) error {
+	switch mode {
+	case client.ScanData, client.ScanHandshake, client.ScanEcho:
+	default:
+		return fmt.Errorf("unknown scan mode %+q", mode)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = mode
+	return nil
+}
+
+// SetMTU sets, for the "echo" mode, the size of the packets that a resolver
+// must carry from the server: the effective MTU that dnstt-server logs when
+// it starts, 932 by default, as with the server's default -mtu of 1232.
+func (s *Scanner) SetMTU(mtu int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mtu = mtu
+}
+
+// SetListener sets the listener to receive each result as Scan runs, or
+// removes it if l is nil.
+func (s *Scanner) SetListener(l ScanListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listener = l
+}
+
+// SetProtectSocket sets a callback to protect the scanner's sockets from VPN
+// routing, as with DnsttClient.SetProtectSocket.
+func (s *Scanner) SetProtectSocket(protectFunc ProtectSocketFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protectSocket = protectFunc
+}
+
+// Scan tests each of resolvers, a list separated by commas or newlines of DNS
+// servers in the forms accepted by NewClient, or CIDR ranges like
+// "192.0.2.0/24" or "tls://192.0.2.0/28" that stand for each of their
+// addresses. Lines may have comments beginning with "#". A resolver passes if
+// a tunnel handshake through it succeeds, a small request through the tunnel
+// gets a reply from the server's upstream, and no response is truncated; the
+// mode set by SetMode may change what the request has to be.
+//
+// Scan blocks until every resolver has been tested, or until Cancel is
+// called, and returns a JSON array of results, best first: those that passed,
+// fastest first, then those that failed. Each result is an object with the
+// fields resolver, ok, stage (the check that failed: dial, handshake, data,
+// or size), error, handshake_ms, round_trip_ms, response_size (of the largest
+// DNS response), packet_size (of the largest packet from the server), and
+// truncated (the number of truncated responses).
+func (s *Scanner) Scan(resolvers string) (string, error) {
+	specs, err := client.ExpandResolvers(strings.FieldsFunc(resolvers, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}))
+	if err != nil {
+		return "", err
+	}
+	if len(specs) == 0 {
+		return "", fmt.Errorf("no resolvers")
+	}
+	utlsClientHelloID, err := client.SampleUTLSDistribution(client.DefaultUTLSDistribution)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return "", fmt.Errorf("scan already in progress")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	transportOpts := client.TransportOptions{
+		UTLSClientHelloID: utlsClientHelloID,
+		Control:           protectControl(s.protectSocket),
+	}
+	opts := client.ScanOptions{Workers: s.workers, Timeout: s.timeout, Mode: s.mode, MTU: s.mtu}
+	if l := s.listener; l != nil {
+		opts.Progress = func(r client.ScanResult) {
+			text, err := json.Marshal(r)
+			if err == nil {
+				l.OnResult(string(text))
+			}
+		}
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+		cancel()
+	}()
+
+	results, err := client.Scan(ctx, s.endpoint, specs, transportOpts, opts)
+	if err != nil {
+		return "", err
+	}
+	text, err := json.Marshal(results)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// Cancel stops the scan in progress, if any. Its Scan returns the results so
+// far, with the resolvers not tested marked as failed.
+func (s *Scanner) Cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
@@ -139,44 +139,71 @@ func newConfig() noise.Config {
 // returns after completing the handshake. It returns a non-nil error if there
 // is an error during the handshake.
 func NewClient(rwc io.ReadWriteCloser, serverPubkey []byte) (io.ReadWriteCloser, error) {
+	conn, payload, err := NewClientWithPayload(rwc, serverPubkey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != 0 {
+		return nil, errors.New("unexpected server payload")
+	}
+	return conn, nil
+}
+
+// NewClientWithPayload is like NewClient, but sends payload in the client's
+// handshake message, and returns the payload of the server's handshake message.
+// Both payloads are encrypted. A server that does not expect a payload (one
+// using NewServer) will fail the handshake if payload is not empty.
+func NewClientWithPayload(rwc io.ReadWriteCloser, serverPubkey []byte, payload []byte) (io.ReadWriteCloser, []byte, error) {
 	config := newConfig()
 	config.Initiator = true
 	config.PeerStatic = serverPubkey
 	handshakeState, err := noise.NewHandshakeState(config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// -> e, es
-	msg, _, _, err := handshakeState.WriteMessage(nil, nil)
+	msg, _, _, err := handshakeState.WriteMessage(nil, payload)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = writeMessage(rwc, msg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// <- e, es
 	msg, err = readMessage(rwc)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	payload, sendCipher, recvCipher, err := handshakeState.ReadMessage(nil, msg)
+	serverPayload, sendCipher, recvCipher, err := handshakeState.ReadMessage(nil, msg)
 	if err != nil {
-		return nil, err
-	}
-	if len(payload) != 0 {
-		return nil, errors.New("unexpected server payload")
+		return nil, nil, err
 	}
 
-	return newSocket(rwc, recvCipher, sendCipher), nil
+	return newSocket(rwc, recvCipher, sendCipher), serverPayload, nil
 }
 
 // NewClient wraps an io.ReadWriteCloser in a Noise protocol as a server, and
 // returns after completing the handshake. It returns a non-nil error if there
 // is an error during the handshake.
 func NewServer(rwc io.ReadWriteCloser, serverPrivkey []byte) (io.ReadWriteCloser, error) {
+	return NewServerWithPayload(rwc, serverPrivkey, func(payload []byte) ([]byte, error) {
+		if len(payload) != 0 {
+			return nil, errors.New("unexpected client payload")
+		}
+		return nil, nil
+	})
+}
+
+// NewServerWithPayload is like NewServer, but calls respond with the payload of
+// the client's handshake message. The payload returned by respond is sent in
+// the server's handshake message. If respond returns an error, the handshake
+// fails with that error. Clients that use NewClient expect an empty payload
+// from the server, so respond should return a non-empty payload only in reply
+// to a non-empty client payload.
+func NewServerWithPayload(rwc io.ReadWriteCloser, serverPrivkey []byte, respond func(payload []byte) ([]byte, error)) (io.ReadWriteCloser, error) {
 	config := newConfig()
 	config.Initiator = false
 	config.StaticKeypair = noise.DHKey{
@@ -197,12 +224,13 @@ func NewServer(rwc io.ReadWriteCloser, serverPrivkey []byte) (io.ReadWriteCloser
 	if err != nil {
 		return nil, err
 	}
-	if len(payload) != 0 {
-		return nil, errors.New("unexpected client payload")
+	serverPayload, err := respond(payload)
+	if err != nil {
+		return nil, err
 	}
 
 	// <- e, es
-	msg, recvCipher, sendCipher, err := handshakeState.WriteMessage(nil, nil)
+	msg, recvCipher, sendCipher, err := handshakeState.WriteMessage(nil, serverPayload)
 	if err != nil {
 		return nil, err
 	}
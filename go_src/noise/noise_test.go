@@ -216,3 +216,63 @@ func TestUnexpectedPayload(t *testing.T) {
 		}
 	}()
 }
+
+func TestPayloadExchange(t *testing.T) {
+	privkey, err := GeneratePrivkey()
+	if err != nil {
+		panic(err)
+	}
+	pubkey := PubkeyFromPrivkey(privkey)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	type result struct {
+		payload []byte
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var received []byte
+		server, err := NewServerWithPayload(s, privkey, func(payload []byte) ([]byte, error) {
+			received = payload
+			return []byte("server payload"), nil
+		})
+		if err == nil {
+			// Echo one message to show that the channel works.
+			var buf [100]byte
+			var n int
+			n, err = server.Read(buf[:])
+			if err == nil {
+				_, err = server.Write(buf[:n])
+			}
+		}
+		ch <- result{received, err}
+	}()
+
+	client, payload, err := NewClientWithPayload(c, pubkey, []byte("client payload"))
+	if err != nil {
+		t.Fatalf("NewClientWithPayload: %v", err)
+	}
+	if string(payload) != "server payload" {
+		t.Errorf("client received payload %+q", payload)
+	}
+	_, err = client.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	n, err := client.Read(buf[:])
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("client Read got (%+q, %v)", buf[:n], err)
+	}
+
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("server: %v", r.err)
+	}
+	if string(r.payload) != "client payload" {
+		t.Errorf("server received payload %+q", r.payload)
+	}
+}
@@ -0,0 +1,537 @@
+// Package priority schedules the frames of an smux session so that
+// interactive streams are not held up behind bulk ones.
+//
+// A Conn sits between smux and the layers below it (compression, Noise, KCP).
+// smux writes one frame per Write call, and sends the frames of all its
+// streams in the order they were written, so that a keystroke written just
+// after a large download frame has to wait for the whole download frame to be
+// sent. Conn instead parses each frame, splits large data frames into small
+// chunks, and puts them into one of two queues, interactive and bulk. A single
+// goroutine writes frames to the underlying connection, always taking from the
+// interactive queue first. The frames of any one stream stay in order: a
+// stream's frames go to the interactive queue only while none of its frames
+// are waiting in the bulk queue.
+//
+// Reordering is not enough when the layers below have large buffers of their
+// own, like a KCP send window: an interactive frame would still wait behind
+// the bulk data already in them. A Conn can therefore also call a throttle
+// function while interactive and bulk streams are both active, which the
+// caller uses to make the layers below hold less data for that time. See
+// SetThrottleFunc.
+//
+// Conn only reorders frames; the peer needs no support for it. A Conn can also
+// send the class of a stream to the peer (see SendClass), so that the peer, if
+// it also uses a Conn, schedules its side of the stream the same way. The class
+// travels in an smux NOP frame, which smux itself ignores, so a peer without a
+// Conn is not disturbed by it.
+package priority
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// Class is the priority class of a stream.
+type Class int
+
+const (
+	// Auto treats a stream as interactive until it writes more than
+	// BulkThreshold bytes in one burst, and as bulk for the rest of that
+	// burst. A burst ends when the stream has written nothing for
+	// BurstIdle.
+	Auto Class = iota
+	// Interactive streams always go before bulk streams.
+	Interactive
+	// Bulk streams go only when no interactive stream has data waiting.
+	Bulk
+)
+
+const (
+	// BulkThreshold is the number of bytes an Auto stream may write in one
+	// burst before it is treated as bulk.
+	BulkThreshold = 32 * 1024
+	// BurstIdle is how long an Auto stream must be quiet for its next write
+	// to start a new burst.
+	BurstIdle = 1 * time.Second
+	// ThrottleHold is how long interactive or bulk streams must be quiet
+	// for throttling to end. It is longer than the gaps between keystrokes
+	// and their echoes, so that throttling does not switch on and off
+	// during an interactive session.
+	ThrottleHold = 10 * time.Second
+	// ThrottledSendWindow is the KCP send window, in segments, that the
+	// throttle function should reduce the window to while throttled, so
+	// that interactive data does not wait behind a full window of bulk
+	// data.
+	ThrottledSendWindow = turbotunnel.QueueSize / 16
+
+	// MaxFrameSize is the largest data frame that Conn queues. Larger data
+	// frames are split, so that an interactive frame never waits for more
+	// than one of them. smux sessions on a Conn should set their own
+	// MaxFrameSize to no more than this: smux sends all its frames through
+	// one Write at a time, and a large bulk frame that has to wait for room
+	// in the bulk queue would hold up the interactive frames behind it.
+	MaxFrameSize = 1024
+
+	// Write blocks while the queue a frame is going to holds at least this
+	// many bytes.
+	queueLimit = 64 * 1024
+	// While not throttled, consecutive bulk frames are written to the
+	// underlying connection together, up to this many bytes, which is the
+	// size of the frames smux writes by default. A KCP conn accepts a whole
+	// write whenever its send window is not full, so that large writes keep
+	// more data in flight.
+	bulkWriteSize = 32 * 1024
+
+	// smux frame header fields.
+	headerSize = 8
+	cmdSYN     = 0
+	cmdFIN     = 1
+	cmdPSH     = 2
+	cmdNOP     = 3
+	cmdUPD     = 4
+	// The length of the payload of an UPD frame.
+	updSize = 8
+)
+
+// String returns the name of the class, as accepted by ParseClass.
+func (c Class) String() string {
+	switch c {
+	case Auto:
+		return "auto"
+	case Interactive:
+		return "interactive"
+	case Bulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("Class(%d)", int(c))
+	}
+}
+
+// ParseClass parses the name of a class: "auto", "interactive", or "bulk".
+func ParseClass(s string) (Class, error) {
+	for _, c := range []Class{Auto, Interactive, Bulk} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return Auto, fmt.Errorf("unknown priority class %+q", s)
+}
+
+// stream is the scheduling state of one smux stream.
+type stream struct {
+	class Class
+	// burst is the number of data bytes written in the current burst, and
+	// last is the time of the most recent write.
+	burst int
+	last  time.Time
+	// inBulk is the number of the stream's frames in the bulk queue.
+	inBulk int
+	// fin is set once the stream's FIN frame has been queued.
+	fin bool
+}
+
+// frame is a queued smux frame, header included.
+type frame struct {
+	buf []byte
+	sid uint32
+}
+
+// Conn is an io.ReadWriteCloser that reorders the smux frames written to it
+// according to the priority class of their streams. Reads are passed through
+// unchanged, apart from noting the classes sent by the peer.
+type Conn struct {
+	rwc io.ReadWriteCloser
+
+	// readHeader holds the first readHeaderLen bytes of the header of the
+	// frame being read, and readSkip is the number of bytes of its payload
+	// still to be read. Only Read uses them.
+	readHeader    [headerSize]byte
+	readHeaderLen int
+	readSkip      int
+
+	lock        sync.Mutex
+	cond        *sync.Cond
+	interactive []frame
+	bulk        []frame
+	// interactiveBytes and bulkBytes are the total lengths of the frames in
+	// each queue.
+	interactiveBytes int
+	bulkBytes        int
+	streams          map[uint32]*stream
+	// version is the smux version of the frames written, which SendClass
+	// uses for its own, or 0 before the first frame.
+	version byte
+	// err is the error that makes further writes fail: the error of a
+	// failed write to rwc, or io.ErrClosedPipe after Close.
+	err error
+
+	// throttleLock controls access to the fields below, and serializes
+	// calls to throttle. throttled may also be read without it.
+	throttleLock sync.Mutex
+	throttle     func(bool)
+	throttled    atomic.Bool
+	// lastInteractive and lastBulk are the times of the most recent data
+	// frames written to each queue.
+	lastInteractive time.Time
+	lastBulk        time.Time
+}
+
+// NewConn returns a Conn that writes reordered frames to rwc, and starts its
+// writing goroutine. The goroutine stops when the Conn is closed, or when a
+// write to rwc fails. Streams are in the Auto class unless SetClass says
+// otherwise.
+func NewConn(rwc io.ReadWriteCloser) *Conn {
+	c := &Conn{
+		rwc:     rwc,
+		streams: make(map[uint32]*stream),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	go c.writeLoop()
+	return c
+}
+
+// SetClass sets the priority class of the stream with the given smux stream
+// ID. It applies to frames written after it is called.
+func (c *Conn) SetClass(sid uint32, class Class) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lookup(sid).class = class
+}
+
+// SendClass sends class, the priority class of the stream with the given smux
+// stream ID, to the peer, whose Conn (if it has one) then applies it to the
+// frames it writes on the stream, as SetClass does. It may only be called once
+// a frame has been written, so that the smux version is known; the SYN frame
+// that opens the stream will do.
+func (c *Conn) SendClass(sid uint32, class Class) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.version == 0 {
+		return errors.New("priority: no frame written yet")
+	}
+	err := c.wait(false)
+	if err != nil {
+		return err
+	}
+	// A NOP frame has no payload, and smux ignores its length field, which
+	// therefore carries the class.
+	buf := make([]byte, headerSize)
+	buf[0] = c.version
+	buf[1] = cmdNOP
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(class))
+	binary.LittleEndian.PutUint32(buf[4:8], sid)
+	c.enqueue(false, frame{buf: buf, sid: sid})
+	return nil
+}
+
+// SetThrottleFunc sets a function to be called with true when an interactive
+// stream writes data while a bulk stream is also writing, and with false when
+// one of them has been quiet for ThrottleHold. While throttled, the caller should
+// limit how much data the layers below the Conn may hold, for example by
+// shrinking a KCP send window, so that interactive data does not queue behind
+// bulk data there. Calls to f do not overlap.
+func (c *Conn) SetThrottleFunc(f func(bool)) {
+	c.throttleLock.Lock()
+	defer c.throttleLock.Unlock()
+	c.throttle = f
+}
+
+// noteData records that a data frame was queued, and starts throttling if it
+// is interactive and bulk data has been queued within ThrottleHold. Only
+// interactive data starts throttling, so that an Auto stream that becomes bulk
+// does not throttle itself. c.lock must not be held.
+func (c *Conn) noteData(bulk bool) {
+	c.throttleLock.Lock()
+	defer c.throttleLock.Unlock()
+	now := time.Now()
+	if bulk {
+		c.lastBulk = now
+	} else {
+		c.lastInteractive = now
+	}
+	if c.throttle == nil || c.throttled.Load() || bulk {
+		return
+	}
+	if now.Sub(c.lastBulk) < ThrottleHold {
+		c.throttled.Store(true)
+		c.throttle(true)
+		time.AfterFunc(ThrottleHold, c.checkThrottle)
+	}
+}
+
+// checkThrottle ends throttling if interactive or bulk data has not been
+// queued for ThrottleHold, and otherwise checks again later.
+func (c *Conn) checkThrottle() {
+	c.throttleLock.Lock()
+	defer c.throttleLock.Unlock()
+	if !c.throttled.Load() {
+		return
+	}
+	last := c.lastInteractive
+	if c.lastBulk.Before(last) {
+		last = c.lastBulk
+	}
+	if d := time.Since(last); d < ThrottleHold {
+		time.AfterFunc(ThrottleHold-d, c.checkThrottle)
+		return
+	}
+	c.throttled.Store(false)
+	c.throttle(false)
+}
+
+// lookup returns the state of the stream sid, creating it if necessary. c.lock
+// must be held.
+func (c *Conn) lookup(sid uint32) *stream {
+	s, ok := c.streams[sid]
+	if !ok {
+		s = &stream{class: Auto}
+		c.streams[sid] = s
+	}
+	return s
+}
+
+// Read reads from the underlying connection. It follows the frames that are
+// read, and applies the classes sent by the peer with SendClass as SetClass
+// does. Read must not be called concurrently.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.rwc.Read(p)
+	c.scan(p[:n])
+	return n, err
+}
+
+// scan parses p, which continues the frames of the previous Read, for classes
+// sent by the peer. It skips payloads in the same way smux does: a PSH frame
+// has as many bytes as its length field says, an UPD frame has updSize bytes,
+// and other frames have none.
+func (c *Conn) scan(p []byte) {
+	for len(p) > 0 {
+		if c.readSkip > 0 {
+			n := min(c.readSkip, len(p))
+			c.readSkip -= n
+			p = p[n:]
+			continue
+		}
+		n := copy(c.readHeader[c.readHeaderLen:], p)
+		c.readHeaderLen += n
+		p = p[n:]
+		if c.readHeaderLen < headerSize {
+			break
+		}
+		c.readHeaderLen = 0
+		length := binary.LittleEndian.Uint16(c.readHeader[2:4])
+		sid := binary.LittleEndian.Uint32(c.readHeader[4:8])
+		switch c.readHeader[1] {
+		case cmdPSH:
+			c.readSkip = int(length)
+		case cmdUPD:
+			c.readSkip = updSize
+		case cmdNOP:
+			// smux's own NOPs, keepalives, have a stream ID of 0.
+			if class := Class(length); sid != 0 && class <= Bulk {
+				c.SetClass(sid, class)
+			}
+		}
+	}
+}
+
+// Write queues p, which must be exactly one smux frame. It returns as soon as
+// the frame is queued, and so an error from writing a frame to the underlying
+// connection is returned by a later Write.
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(p) < headerSize || int(binary.LittleEndian.Uint16(p[2:4])) != len(p)-headerSize {
+		return 0, errors.New("priority: write is not a single smux frame")
+	}
+	cmd := p[1]
+	sid := binary.LittleEndian.Uint32(p[4:8])
+
+	c.lock.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			c.lock.Unlock()
+		}
+	}()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.version = p[0]
+
+	if cmd != cmdSYN && cmd != cmdFIN && cmd != cmdPSH {
+		// NOP and UPD are session-level or flow control frames. They do
+		// not need to stay in order with a stream's data.
+		err := c.wait(false)
+		if err != nil {
+			return 0, err
+		}
+		c.enqueue(false, frame{buf: append([]byte(nil), p...), sid: sid})
+		return len(p), nil
+	}
+
+	s := c.lookup(sid)
+	bulk := s.inBulk > 0
+	switch s.class {
+	case Bulk:
+		bulk = true
+	case Auto:
+		now := time.Now()
+		if now.Sub(s.last) >= BurstIdle {
+			s.burst = 0
+		}
+		s.last = now
+		s.burst += len(p) - headerSize
+		if s.burst > BulkThreshold {
+			bulk = true
+		}
+	}
+	err := c.wait(bulk)
+	if err != nil {
+		return 0, err
+	}
+
+	// Split data frames into chunks, each with a copy of the header.
+	data := p[headerSize:]
+	for {
+		n := len(data)
+		if cmd == cmdPSH && n > MaxFrameSize {
+			n = MaxFrameSize
+		}
+		buf := make([]byte, headerSize+n)
+		copy(buf, p[:headerSize])
+		binary.LittleEndian.PutUint16(buf[2:4], uint16(n))
+		copy(buf[headerSize:], data[:n])
+		c.enqueue(bulk, frame{buf: buf, sid: sid})
+		if bulk {
+			s.inBulk++
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			break
+		}
+	}
+	if cmd == cmdFIN {
+		s.fin = true
+		if s.inBulk == 0 {
+			delete(c.streams, sid)
+		}
+	}
+	if cmd == cmdPSH {
+		c.lock.Unlock()
+		locked = false
+		c.noteData(bulk)
+	}
+	return len(p), nil
+}
+
+// wait blocks until there is room in the bulk queue (if bulk is true) or the
+// interactive queue, or until the Conn fails. c.lock must be held.
+func (c *Conn) wait(bulk bool) error {
+	for c.err == nil {
+		if bulk && c.bulkBytes < queueLimit {
+			break
+		}
+		if !bulk && c.interactiveBytes < queueLimit {
+			break
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+// enqueue appends f to the bulk or interactive queue. c.lock must be held.
+func (c *Conn) enqueue(bulk bool, f frame) {
+	if bulk {
+		c.bulk = append(c.bulk, f)
+		c.bulkBytes += len(f.buf)
+	} else {
+		c.interactive = append(c.interactive, f)
+		c.interactiveBytes += len(f.buf)
+	}
+	c.cond.Broadcast()
+}
+
+// dequeue removes and returns the next frames to write: one interactive frame
+// if there is any, and otherwise one or more bulk frames. It blocks while both
+// queues are empty. It returns false when the Conn has failed. c.lock must be
+// held.
+func (c *Conn) dequeue() ([]byte, bool) {
+	for c.err == nil && len(c.interactive) == 0 && len(c.bulk) == 0 {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, false
+	}
+	// Wake any Write waiting for room.
+	defer c.cond.Broadcast()
+	if len(c.interactive) > 0 {
+		f := c.interactive[0]
+		c.interactive[0] = frame{}
+		c.interactive = c.interactive[1:]
+		c.interactiveBytes -= len(f.buf)
+		return f.buf, true
+	}
+	buf := c.popBulk()
+	for !c.throttled.Load() && len(c.bulk) > 0 && len(buf)+len(c.bulk[0].buf) <= bulkWriteSize {
+		buf = append(buf, c.popBulk()...)
+	}
+	return buf, true
+}
+
+// popBulk removes and returns the first frame in the bulk queue, which must
+// not be empty. c.lock must be held.
+func (c *Conn) popBulk() []byte {
+	f := c.bulk[0]
+	c.bulk[0] = frame{}
+	c.bulk = c.bulk[1:]
+	c.bulkBytes -= len(f.buf)
+	if s, ok := c.streams[f.sid]; ok {
+		s.inBulk--
+		if s.fin && s.inBulk == 0 {
+			delete(c.streams, f.sid)
+		}
+	}
+	return f.buf
+}
+
+// writeLoop writes queued frames to the underlying connection until the Conn
+// is closed or a write fails.
+func (c *Conn) writeLoop() {
+	for {
+		c.lock.Lock()
+		buf, ok := c.dequeue()
+		c.lock.Unlock()
+		if !ok {
+			return
+		}
+		_, err := c.rwc.Write(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// fail makes further writes fail with err, unless they already fail with
+// another error.
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.interactive = nil
+	c.bulk = nil
+	c.cond.Broadcast()
+}
+
+// Close discards any queued frames and closes the underlying connection.
+func (c *Conn) Close() error {
+	c.fail(io.ErrClosedPipe)
+	return c.rwc.Close()
+}
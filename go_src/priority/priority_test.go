@@ -0,0 +1,386 @@
+package priority
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// chanConn is an io.ReadWriteCloser whose writes block until they are received
+// from ch. Each write signals on writing before it blocks.
+type chanConn struct {
+	ch      chan []byte
+	writing chan struct{}
+	// pending is what has been received from ch but not yet returned by
+	// nextFrame.
+	pending []byte
+}
+
+func newChanConn() *chanConn {
+	return &chanConn{ch: make(chan []byte), writing: make(chan struct{}, 1)}
+}
+
+func (c *chanConn) Read(p []byte) (int, error) { select {} }
+func (c *chanConn) Close() error               { return nil }
+func (c *chanConn) Write(p []byte) (int, error) {
+	select {
+	case c.writing <- struct{}{}:
+	default:
+	}
+	c.ch <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// nextFrame returns the next frame written to c, receiving from ch as
+// necessary. Several frames may have been written together.
+func (c *chanConn) nextFrame() []byte {
+	for len(c.pending) < headerSize || len(c.pending) < headerSize+int(binary.LittleEndian.Uint16(c.pending[2:4])) {
+		c.pending = append(c.pending, <-c.ch...)
+	}
+	n := headerSize + int(binary.LittleEndian.Uint16(c.pending[2:4]))
+	p := c.pending[:n]
+	c.pending = c.pending[n:]
+	return p
+}
+
+// stall writes a NOP frame to c, and waits until the writing goroutine is
+// blocked writing it to underlying, so that the frames written next stay
+// queued until the NOP is received from underlying.
+func stall(t *testing.T, c *Conn, underlying *chanConn) {
+	_, err := c.Write(makeFrame(3, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-underlying.writing
+}
+
+// makeFrame returns an smux version 2 frame.
+func makeFrame(cmd byte, sid uint32, data []byte) []byte {
+	buf := make([]byte, headerSize+len(data))
+	buf[0] = 2
+	buf[1] = cmd
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], sid)
+	copy(buf[headerSize:], data)
+	return buf
+}
+
+func TestParseClass(t *testing.T) {
+	for _, c := range []Class{Auto, Interactive, Bulk} {
+		parsed, err := ParseClass(c.String())
+		if err != nil || parsed != c {
+			t.Errorf("%v → %v %v", c, parsed, err)
+		}
+	}
+	if _, err := ParseClass("urgent"); err == nil {
+		t.Errorf("unknown class accepted")
+	}
+}
+
+func TestBadWrite(t *testing.T) {
+	c := NewConn(newChanConn())
+	defer c.Close()
+	for _, p := range [][]byte{
+		{},
+		{2, cmdPSH, 0, 0},
+		append(makeFrame(cmdPSH, 3, []byte("abc")), 'd'),
+	} {
+		if _, err := c.Write(p); err == nil {
+			t.Errorf("%x: no error", p)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	underlying := newChanConn()
+	c := NewConn(underlying)
+	defer c.Close()
+	c.SetClass(3, Bulk)
+	c.SetClass(7, Bulk)
+
+	stall(t, c, underlying)
+	bulkData := bytes.Repeat([]byte("x"), 3*MaxFrameSize)
+	for _, p := range [][]byte{
+		makeFrame(cmdPSH, 3, bulkData),
+		makeFrame(cmdPSH, 5, []byte("keystroke")),
+		// Stream 7 was bulk, but is interactive now. It must not
+		// overtake its own bulk frame.
+		makeFrame(cmdPSH, 7, []byte("first")),
+	} {
+		_, err := c.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SetClass(7, Interactive)
+	_, err := c.Write(makeFrame(cmdPSH, 7, []byte("second")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		sid  uint32
+		size int
+	}
+	expected := []result{
+		{0, 0},
+		{5, len("keystroke")},
+		{3, MaxFrameSize},
+		{3, MaxFrameSize},
+		{3, MaxFrameSize},
+		{7, len("first")},
+		{7, len("second")},
+	}
+	for i, e := range expected {
+		p := underlying.nextFrame()
+		sid := binary.LittleEndian.Uint32(p[4:8])
+		size := int(binary.LittleEndian.Uint16(p[2:4]))
+		if sid != e.sid || size != e.size || len(p) != headerSize+size {
+			t.Fatalf("frame %d: sid %d length %d (%d bytes), expected sid %d length %d", i, sid, size, len(p), e.sid, e.size)
+		}
+	}
+}
+
+func TestAuto(t *testing.T) {
+	underlying := newChanConn()
+	c := NewConn(underlying)
+	defer c.Close()
+
+	// Stream 3 writes more than BulkThreshold in one burst, and becomes
+	// bulk.
+	stall(t, c, underlying)
+	for i := 0; i < BulkThreshold/MaxFrameSize+2; i++ {
+		_, err := c.Write(makeFrame(cmdPSH, 3, make([]byte, MaxFrameSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stream 5 has written little, and goes ahead of the rest of stream 3.
+	_, err := c.Write(makeFrame(cmdPSH, 5, []byte("keystroke")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	underlying.nextFrame()
+	var sids []uint32
+	for i := 0; i < BulkThreshold/MaxFrameSize+3; i++ {
+		p := underlying.nextFrame()
+		sids = append(sids, binary.LittleEndian.Uint32(p[4:8]))
+	}
+	// Everything up to the threshold was interactive, so stream 5 comes
+	// after that, but before the bulk tail of stream 3.
+	index := -1
+	for i, sid := range sids {
+		if sid == 5 {
+			index = i
+		}
+	}
+	if index != BulkThreshold/MaxFrameSize {
+		t.Errorf("stream 5 frame at index %d of %v", index, sids)
+	}
+}
+
+// TestSmux runs an smux session with a Conn on each side, and checks that data
+// arrives intact.
+func TestSmux(t *testing.T) {
+	clientPipe, serverPipe := net.Pipe()
+	client := NewConn(clientPipe)
+	server := NewConn(serverPipe)
+	config := smux.DefaultConfig()
+	config.Version = 2
+	clientSess, err := smux.Client(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSess.Close()
+	serverSess, err := smux.Server(server, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSess.Close()
+
+	// The server echoes every stream.
+	go func() {
+		for {
+			stream, err := serverSess.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	data := make([]byte, 200*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	done := make(chan error, 2)
+	for i, class := range []Class{Bulk, Interactive} {
+		stream, err := clientSess.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetClass(stream.ID(), class)
+		msg := data[i*1000:]
+		go func() {
+			defer stream.Close()
+			stream.SetDeadline(time.Now().Add(10 * time.Second))
+			go stream.Write(msg)
+			buf := make([]byte, len(msg))
+			_, err := io.ReadFull(stream, buf)
+			if err == nil && !bytes.Equal(buf, msg) {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	c := NewConn(newChanConn())
+	defer c.Close()
+	calls := make(chan bool, 10)
+	c.SetThrottleFunc(func(throttled bool) {
+		calls <- throttled
+	})
+
+	// A stream that becomes bulk does not throttle itself.
+	for i := 0; i < BulkThreshold/MaxFrameSize+2; i++ {
+		_, err := c.Write(makeFrame(cmdPSH, 3, make([]byte, MaxFrameSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case throttled := <-calls:
+		t.Fatalf("throttle(%v) with only one stream", throttled)
+	default:
+	}
+
+	// Interactive data while bulk data is being written throttles.
+	_, err := c.Write(makeFrame(cmdPSH, 5, []byte("keystroke")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case throttled := <-calls:
+		if !throttled {
+			t.Errorf("throttle(%v)", throttled)
+		}
+	default:
+		t.Errorf("no call to throttle")
+	}
+}
+
+// classOf returns the class that c has for stream sid.
+func classOf(c *Conn, sid uint32) Class {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, ok := c.streams[sid]; ok {
+		return s.class
+	}
+	return Auto
+}
+
+// Classes sent with SendClass are applied by the peer's Conn, and ignored by a
+// peer that runs smux without a Conn.
+func TestSendClass(t *testing.T) {
+	for _, withConn := range []bool{true, false} {
+		clientPipe, serverPipe := net.Pipe()
+		client := NewConn(clientPipe)
+		var server *Conn
+		var serverRWC io.ReadWriteCloser = serverPipe
+		if withConn {
+			server = NewConn(serverPipe)
+			serverRWC = server
+		}
+		config := smux.DefaultConfig()
+		config.Version = 2
+		clientSess, err := smux.Client(client, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverSess, err := smux.Server(serverRWC, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				stream, err := serverSess.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}()
+
+		stream, err := clientSess.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SendClass(stream.ID(), Bulk); err != nil {
+			t.Fatal(err)
+		}
+		// The stream still works.
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		var buf [5]byte
+		if _, err := io.ReadFull(stream, buf[:]); err != nil || string(buf[:]) != "hello" {
+			t.Errorf("with Conn %v: echo %+q, %v", withConn, buf, err)
+		}
+		if withConn {
+			if class := classOf(server, stream.ID()); class != Bulk {
+				t.Errorf("server has class %v, expected %v", class, Bulk)
+			}
+		}
+		clientSess.Close()
+		serverSess.Close()
+	}
+}
+
+// Read finds the classes sent by the peer however the frames are split among
+// reads, and is not fooled by data that looks like a NOP frame.
+func TestReadClass(t *testing.T) {
+	var stream []byte
+	stream = append(stream, makeFrame(cmdPSH, 3, makeFrame(cmdNOP, 5, nil))...)
+	stream = append(stream, makeFrame(cmdUPD, 3, make([]byte, updSize))...)
+	stream = append(stream, makeFrame(cmdNOP, 0, nil)...)
+	class := makeFrame(cmdNOP, 7, nil)
+	binary.LittleEndian.PutUint16(class[2:4], uint16(Interactive))
+	stream = append(stream, class...)
+
+	for _, size := range []int{1, 3, 8, len(stream)} {
+		r := bytes.NewReader(stream)
+		c := NewConn(struct {
+			io.Reader
+			io.WriteCloser
+		}{r, newChanConn()})
+		buf := make([]byte, size)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				break
+			}
+		}
+		if classOf(c, 5) != Auto || classOf(c, 7) != Interactive {
+			t.Errorf("reads of %d: classes %v and %v", size, classOf(c, 5), classOf(c, 7))
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,260 @@
+// Package rules implements split tunneling: deciding, by the destination of a
+// connection, whether it goes through the tunnel, directly to its
+// destination, or nowhere. Sending local or domestic traffic through a tunnel
+// of a few kilobytes per second wastes its capacity.
+//
+// Rules are read from a text file with one rule per line. A rule is an action
+// (tunnel, direct, or block) followed by one or more patterns. Text from a '#'
+// to the end of a line is a comment.
+//
+//	# Local networks and domestic sites go direct.
+//	direct 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16 fc00::/7
+//	direct .ir lan
+//	# No mail or BitTorrent.
+//	block :25 :6881-6889
+//	tunnel *
+//
+// A pattern is one of:
+//   - "*", which matches every destination;
+//   - a CIDR prefix like 192.0.2.0/24, or a single IP address;
+//   - a destination port like :25, or a range of ports like :6881-6889;
+//   - a domain name like example.com, which also matches all its subdomains.
+//     A leading "." or "*." is allowed and means the same.
+//
+// Rules are checked in order, and the first rule with a matching pattern
+// decides. A destination that matches no rule goes through the tunnel.
+//
+// Domain patterns match only destinations given as names, and address
+// patterns only destinations given as IP addresses: names are not resolved,
+// because a local lookup would reveal the destination outside the tunnel. When
+// only the address of a destination is known, as with a TUN device, only
+// address and port patterns apply.
+package rules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Action is what to do with a connection.
+type Action int
+
+const (
+	// Tunnel sends the connection through the tunnel.
+	Tunnel Action = iota
+	// Direct connects to the destination directly, outside the tunnel.
+	Direct
+	// Block refuses the connection.
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Tunnel:
+		return "tunnel"
+	case Direct:
+		return "direct"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// ParseAction returns the Action named by s.
+func ParseAction(s string) (Action, error) {
+	for _, a := range []Action{Tunnel, Direct, Block} {
+		if s == a.String() {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %+q", s)
+}
+
+// ErrBlocked is returned by the dial functions of Dialer for destinations that
+// a rule blocks.
+var ErrBlocked = errors.New("blocked by rule")
+
+// pattern is one parsed pattern of a rule. Exactly one of its kinds is set,
+// unless all is set.
+type pattern struct {
+	all bool
+	// prefix is valid for an address pattern.
+	prefix netip.Prefix
+	// portLow and portHigh are nonzero for a port pattern.
+	portLow, portHigh uint16
+	// domain is nonempty for a domain pattern. It is lowercase, without
+	// leading or trailing dots.
+	domain string
+}
+
+func parsePattern(s string) (pattern, error) {
+	if s == "*" {
+		return pattern{all: true}, nil
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return pattern{prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+	if ports, ok := strings.CutPrefix(s, ":"); ok {
+		lowString, highString, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			highString = lowString
+		}
+		low, err := strconv.ParseUint(lowString, 10, 16)
+		if err != nil || low == 0 {
+			return pattern{}, fmt.Errorf("bad port %+q", lowString)
+		}
+		high, err := strconv.ParseUint(highString, 10, 16)
+		if err != nil || high < low {
+			return pattern{}, fmt.Errorf("bad port %+q", highString)
+		}
+		return pattern{portLow: uint16(low), portHigh: uint16(high)}, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return pattern{}, err
+		}
+		return pattern{prefix: prefix.Masked()}, nil
+	}
+	domain := strings.TrimPrefix(s, "*")
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" || strings.ContainsAny(domain, "*:[] ") {
+		return pattern{}, fmt.Errorf("bad pattern %+q", s)
+	}
+	return pattern{domain: domain}, nil
+}
+
+// match reports whether the pattern matches a destination. addr is valid if
+// the destination is an IP address, and host is the lowercase name otherwise.
+func (p *pattern) match(host string, addr netip.Addr, port uint16) bool {
+	switch {
+	case p.all:
+		return true
+	case p.portLow != 0:
+		return p.portLow <= port && port <= p.portHigh
+	case p.domain != "":
+		return host == p.domain || strings.HasSuffix(host, "."+p.domain)
+	default:
+		return addr.IsValid() && p.prefix.Contains(addr)
+	}
+}
+
+type rule struct {
+	action   Action
+	patterns []pattern
+}
+
+// Rules is a parsed list of rules. A nil *Rules sends everything through the
+// tunnel.
+type Rules struct {
+	rules []rule
+}
+
+// Parse reads rules from r.
+func Parse(r io.Reader) (*Rules, error) {
+	var rs Rules
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		action, err := ParseAction(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: no patterns", lineNum)
+		}
+		rl := rule{action: action}
+		for _, field := range fields[1:] {
+			p, err := parsePattern(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			rl.patterns = append(rl.patterns, p)
+		}
+		rs.rules = append(rs.rules, rl)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// ParseFile reads rules from the named file.
+func ParseFile(filename string) (*Rules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Len returns the number of rules.
+func (rs *Rules) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
+
+// Match returns the action for a connection to addr, a "host:port" string. A
+// missing port matches no port pattern.
+func (rs *Rules) Match(addr string) Action {
+	if rs == nil {
+		return Tunnel
+	}
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, portString = addr, ""
+	}
+	var port uint16
+	if p, err := strconv.ParseUint(portString, 10, 16); err == nil {
+		port = uint16(p)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err == nil {
+		ip = ip.Unmap()
+		host = ""
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	for _, rl := range rs.rules {
+		for i := range rl.patterns {
+			if rl.patterns[i].match(host, ip, port) {
+				return rl.action
+			}
+		}
+	}
+	return Tunnel
+}
+
+// DialFunc connects to addr, a "host:port" string.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Dialer returns a DialFunc that connects to each destination using tunnel or
+// direct, according to the rules, or fails with ErrBlocked.
+func (rs *Rules) Dialer(tunnel, direct DialFunc) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		switch rs.Match(addr) {
+		case Direct:
+			return direct(network, addr)
+		case Block:
+			return nil, ErrBlocked
+		default:
+			return tunnel(network, addr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAction(t *testing.T) {
+	for _, a := range []Action{Tunnel, Direct, Block} {
+		parsed, err := ParseAction(a.String())
+		if err != nil || parsed != a {
+			t.Errorf("%v → %v %v", a, parsed, err)
+		}
+	}
+	if _, err := ParseAction("drop"); err == nil {
+		t.Errorf("unknown action accepted")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"drop example.com",
+		"direct",
+		"direct # comment",
+		"block :0",
+		"block :65536",
+		"block :100-10",
+		"block :ssh",
+		"direct 10.0.0.0/33",
+		"direct .",
+		"direct exa*mple.com",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Errorf("%+q: no error", text)
+		}
+	}
+	_, err := Parse(strings.NewReader("direct lan\n\nblock :x\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("error %v does not name line 3", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rs, err := Parse(strings.NewReader(`
+# Local networks and domestic sites go direct.
+direct 10.0.0.0/8 192.168.0.0/16 fc00::/7 ::1
+direct .IR lan. *.example.org
+block :25 :6881-6889 # mail and BitTorrent
+tunnel 10.9.9.9
+block *
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 5 {
+		t.Errorf("Len() = %d", rs.Len())
+	}
+	for _, test := range []struct {
+		addr   string
+		action Action
+	}{
+		{"10.1.2.3:443", Direct},
+		{"[::ffff:192.168.1.1]:80", Direct},
+		{"[fd00::1]:22", Direct},
+		{"[::1]:22", Direct},
+		{"www.example.ir:443", Direct},
+		{"IR:80", Direct},
+		{"printer.lan.:631", Direct},
+		{"example.org:80", Direct},
+		{"a.b.example.org:80", Direct},
+		{"notexample.org:80", Block},
+		{"fair:80", Block},
+		{"mail.example.com:25", Block},
+		{"192.0.2.1:6885", Block},
+		// An earlier rule takes precedence.
+		{"10.9.9.9:80", Direct},
+		{"10.9.9.9:25", Direct},
+		// Address patterns do not match names.
+		{"localhost:80", Block},
+		// No port.
+		{"example.ir", Direct},
+		{"192.0.2.1", Block},
+	} {
+		if action := rs.Match(test.addr); action != test.action {
+			t.Errorf("%s: got %v, expected %v", test.addr, action, test.action)
+		}
+	}
+
+	var nilRules *Rules
+	if action := nilRules.Match("10.1.2.3:443"); action != Tunnel {
+		t.Errorf("nil rules: got %v", action)
+	}
+	empty, err := Parse(strings.NewReader("# nothing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action := empty.Match("example.com:80"); action != Tunnel {
+		t.Errorf("empty rules: got %v", action)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	rs, err := Parse(strings.NewReader("direct lan\nblock :25\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed []string
+	dialFunc := func(name string) DialFunc {
+		return func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, name+" "+addr)
+			return nil, nil
+		}
+	}
+	dial := rs.Dialer(dialFunc("tunnel"), dialFunc("direct"))
+	for _, addr := range []string{"nas.lan:80", "example.com:80"} {
+		if _, err := dial("tcp", addr); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+	if _, err := dial("tcp", "example.com:25"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("blocked: got %v", err)
+	}
+	if strings.Join(dialed, ",") != "direct nas.lan:80,tunnel example.com:80" {
+		t.Errorf("dialed %v", dialed)
+	}
+}
@@ -0,0 +1,255 @@
+// Package socksproxy implements the server side of a SOCKS5 proxy (RFC 1928),
+// for clients whose connections are to be handled locally rather than passed
+// through the tunnel as they are: it is how the client learns the destination
+// of each connection, so that split tunneling rules can apply to it, and
+// how clients of a shared proxy can be made to authenticate. Only the CONNECT
+// command is supported, with no authentication or with username/password
+// authentication (RFC 1929).
+//
+// The connection to each target is made by a caller-supplied dial function.
+package socksproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/relay"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+)
+
+// How long to wait for a client to send its request.
+const requestTimeout = 30 * time.Second
+
+const (
+	socksVersion = 5
+
+	methodNoAuth       = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+
+	passwordVersion = 1
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+// DialFunc connects to addr, a "host:port" string.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Server is a SOCKS5 proxy server.
+type Server struct {
+	// Dial connects to targets.
+	Dial DialFunc
+	// Authenticate, if not nil, makes clients authenticate with a username
+	// and password, and reports whether those sent on conn are valid.
+	Authenticate func(conn net.Conn, username, password string) bool
+}
+
+// Serve accepts connections from ln and handles each as a SOCKS5 client,
+// connecting to targets using dial. It returns when ln.Accept returns a
+// non-temporary error.
+func Serve(ln net.Listener, dial DialFunc) error {
+	return (&Server{Dial: dial}).Serve(ln)
+}
+
+// Handle handles a SOCKS5 client on conn, connecting to its target using dial,
+// as Server.Handle does.
+func Handle(conn net.Conn, dial DialFunc) error {
+	return (&Server{Dial: dial}).Handle(conn)
+}
+
+// Serve accepts connections from ln and handles each as a SOCKS5 client. It
+// returns when ln.Accept returns a non-temporary error.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := s.Handle(conn)
+			if err != nil {
+				logging.Proxy.Warnf("SOCKS proxy: %v", err)
+			}
+		}()
+	}
+}
+
+// Handle reads a SOCKS5 greeting, authentication if required, and CONNECT
+// request from conn, connects to the target using s.Dial, and then copies data
+// between conn and the target until both directions are done. If s.Dial fails
+// with rules.ErrBlocked, the client gets a "connection not allowed by ruleset"
+// reply. Handle does not close conn.
+func (s *Server) Handle(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	br := bufio.NewReader(conn)
+
+	// Greeting: VER NMETHODS METHODS.
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return fmt.Errorf("reading greeting: %v", err)
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unknown version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return fmt.Errorf("reading greeting: %v", err)
+	}
+	wanted := byte(methodNoAuth)
+	if s.Authenticate != nil {
+		wanted = methodPassword
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == wanted {
+			method = wanted
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	switch method {
+	case methodNoAcceptable:
+		return fmt.Errorf("no acceptable authentication method from %v", conn.RemoteAddr())
+	case methodPassword:
+		if err := s.authenticate(conn, br); err != nil {
+			return err
+		}
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT.
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return fmt.Errorf("reading request: %v", err)
+	}
+	if req[0] != socksVersion {
+		return fmt.Errorf("unknown version %d", req[0])
+	}
+	host, err := readAddr(br, req[3])
+	if err != nil {
+		writeReply(conn, replyAddressNotSupported)
+		return err
+	}
+	var portBuf [2]byte
+	if _, err := io.ReadFull(br, portBuf[:]); err != nil {
+		return fmt.Errorf("reading request: %v", err)
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBuf[:]))))
+	if req[1] != cmdConnect {
+		writeReply(conn, replyCommandNotSupported)
+		return fmt.Errorf("%s: unsupported command %d", target, req[1])
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	remote, err := s.Dial("tcp", target)
+	if err != nil {
+		if errors.Is(err, rules.ErrBlocked) {
+			writeReply(conn, replyNotAllowed)
+		} else {
+			writeReply(conn, replyGeneralFailure)
+		}
+		return fmt.Errorf("CONNECT %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	if err := writeReply(conn, replySucceeded); err != nil {
+		return err
+	}
+	// The client may already have sent data following the request.
+	if n := br.Buffered(); n > 0 {
+		p, _ := br.Peek(n)
+		_, err := remote.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+	relay.Copy(conn, remote)
+	return nil
+}
+
+// authenticate does username/password authentication.
+// https://tools.ietf.org/html/rfc1929
+func (s *Server) authenticate(conn net.Conn, br *bufio.Reader) error {
+	// VER ULEN UNAME PLEN PASSWD.
+	var ver [1]byte
+	if _, err := io.ReadFull(br, ver[:]); err != nil {
+		return fmt.Errorf("reading authentication: %v", err)
+	}
+	if ver[0] != passwordVersion {
+		return fmt.Errorf("unknown authentication version %d", ver[0])
+	}
+	var fields [2][]byte
+	for i := range fields {
+		var n [1]byte
+		if _, err := io.ReadFull(br, n[:]); err != nil {
+			return fmt.Errorf("reading authentication: %v", err)
+		}
+		fields[i] = make([]byte, n[0])
+		if _, err := io.ReadFull(br, fields[i]); err != nil {
+			return fmt.Errorf("reading authentication: %v", err)
+		}
+	}
+	username := string(fields[0])
+	if !s.Authenticate(conn, username, string(fields[1])) {
+		conn.Write([]byte{passwordVersion, 0x01})
+		return fmt.Errorf("authentication failed for user %+q from %v", username, conn.RemoteAddr())
+	}
+	_, err := conn.Write([]byte{passwordVersion, 0x00})
+	return err
+}
+
+// readAddr reads a DST.ADDR of the given address type, and returns it as a
+// host string.
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", fmt.Errorf("reading request: %v", err)
+		}
+		return ip.String(), nil
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", fmt.Errorf("reading request: %v", err)
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", fmt.Errorf("reading request: %v", err)
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp)
+	}
+}
+
+// writeReply writes a reply with the given code. The bound address is always
+// reported as 0.0.0.0:0; clients have no use for it.
+func writeReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,122 @@
+package socksproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+	"www.bamsoftware.com/git/dnstt.git/rules"
+)
+
+// connDialer is a proxy.Dialer that returns an already open connection.
+type connDialer struct {
+	conn net.Conn
+}
+
+func (d connDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// handlePipe runs Handle on one end of a net.Pipe, and returns a SOCKS5 client
+// dialer for the other end.
+func handlePipe(t *testing.T, dial DialFunc) proxy.Dialer {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		Handle(server, dial)
+	}()
+	t.Cleanup(func() { client.Close() })
+	dialer, err := proxy.SOCKS5("tcp", "proxy", nil, connDialer{client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer
+}
+
+func TestConnect(t *testing.T) {
+	for _, target := range []string{"example.com:443", "192.0.2.1:80", "[2001:db8::1]:22"} {
+		dialed := make(chan string, 1)
+		dialer := handlePipe(t, func(network, addr string) (net.Conn, error) {
+			dialed <- addr
+			c, s := net.Pipe()
+			go func() {
+				defer s.Close()
+				io.Copy(s, s)
+			}()
+			return c, nil
+		})
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if addr := <-dialed; addr != target {
+			t.Errorf("dialed %+q, expected %+q", addr, target)
+		}
+		go io.WriteString(conn, "hello")
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || !bytes.Equal(buf, []byte("hello")) {
+			t.Errorf("%s: read %+q %v", target, buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialError(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		{fmt.Errorf("example.com:25: %w", rules.ErrBlocked), "connection not allowed by ruleset"},
+		{io.ErrUnexpectedEOF, "general SOCKS server failure"},
+	} {
+		dialer := handlePipe(t, func(network, addr string) (net.Conn, error) {
+			return nil, test.err
+		})
+		_, err := dialer.Dial("tcp", "example.com:25")
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: got %v, expected %+q", test.err, err, test.expected)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	dial := func(network, addr string) (net.Conn, error) {
+		c, s := net.Pipe()
+		go s.Close()
+		return c, nil
+	}
+	s := &Server{
+		Dial: dial,
+		Authenticate: func(conn net.Conn, username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+	}
+	for _, test := range []struct {
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{&proxy.Auth{User: "alice", Password: "secret"}, true},
+		{&proxy.Auth{User: "alice", Password: "wrong"}, false},
+		{nil, false},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			s.Handle(server)
+		}()
+		dialer, err := proxy.SOCKS5("tcp", "proxy", test.auth, connDialer{client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dialer.Dial("tcp", "example.com:80")
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: got %v", test.auth, err)
+		}
+		client.Close()
+	}
+}
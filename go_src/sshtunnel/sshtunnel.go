@@ -0,0 +1,343 @@
+// Package sshtunnel carries TCP connections over SSH, as "ssh -D" does, on an
+// SSH connection that is itself carried over a connection supplied by the
+// caller, such as a stream of a dnstt tunnel whose server forwards to an SSH
+// server. Each connection is a direct-tcpip channel of the SSH connection.
+//
+// The SSH connection is made when first needed, and made again when it is
+// lost, as when the tunnel session under it is replaced.
+package sshtunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+// How long the SSH handshake and authentication may take, when not set.
+const defaultTimeout = 30 * time.Second
+
+// Config is how to connect and authenticate to an SSH server.
+type Config struct {
+	// User is the username to log in as.
+	User string
+	// Password, if not empty, is tried with the password and
+	// keyboard-interactive methods.
+	Password string
+	// PrivateKey, if not nil, is a private key in OpenSSH or PEM format,
+	// tried with the publickey method, before any password. Passphrase
+	// decrypts it, if it is encrypted.
+	PrivateKey []byte
+	Passphrase []byte
+	// HostKey is the server's host key, either as in a known_hosts or
+	// authorized_keys file, like "ssh-ed25519 AAAAC3Nz...", or as its
+	// SHA256 fingerprint, like "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s".
+	// A server with any other key is refused with a *HostKeyError, which
+	// tells its fingerprint, so that an app can ask the user to confirm it.
+	HostKey string
+	// Timeout is how long the SSH handshake and authentication may take.
+	// If zero, it is 30 seconds.
+	Timeout time.Duration
+}
+
+// HostKeyError is the error when the server's host key is not the one in the
+// Config.
+type HostKeyError struct {
+	// Fingerprint is the SHA256 fingerprint of the server's key, and Key
+	// the key itself in authorized_keys format; either may be used as
+	// Config.HostKey.
+	Fingerprint string
+	Key         string
+	// Unset is true if Config.HostKey was empty.
+	Unset bool
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Unset {
+		return fmt.Sprintf("no host key is configured; the server's is %s (%s)", e.Fingerprint, e.Key)
+	}
+	return fmt.Sprintf("host key mismatch: the server's is %s (%s)", e.Fingerprint, e.Key)
+}
+
+// hostKeyCallback returns a callback that accepts only the key described by
+// hostKey, as in Config.HostKey.
+func hostKeyCallback(hostKey string) (ssh.HostKeyCallback, error) {
+	hostKey = strings.TrimSpace(hostKey)
+	var match func(ssh.PublicKey) bool
+	switch {
+	case hostKey == "":
+		match = func(ssh.PublicKey) bool { return false }
+	case strings.HasPrefix(hostKey, "SHA256:"):
+		match = func(key ssh.PublicKey) bool { return ssh.FingerprintSHA256(key) == hostKey }
+	default:
+		// Allow a known_hosts line, with host names before the key.
+		fields := strings.Fields(hostKey)
+		var want ssh.PublicKey
+		for i := range fields {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+			if err == nil {
+				want = key
+				break
+			}
+		}
+		if want == nil {
+			return nil, fmt.Errorf("invalid host key %+q", hostKey)
+		}
+		match = func(key ssh.PublicKey) bool { return bytes.Equal(key.Marshal(), want.Marshal()) }
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if match(key) {
+			return nil
+		}
+		return &HostKeyError{
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			Unset:       hostKey == "",
+		}
+	}, nil
+}
+
+// clientConfig returns the ssh.ClientConfig for cfg, or an error if cfg is not
+// valid.
+func (cfg *Config) clientConfig() (*ssh.ClientConfig, error) {
+	if cfg.User == "" {
+		return nil, errors.New("no username")
+	}
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != nil {
+		var signer ssh.Signer
+		var err error
+		if len(cfg.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(cfg.PrivateKey, cfg.Passphrase)
+		} else {
+			signer, err = ssh.ParsePrivateKey(cfg.PrivateKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		password := cfg.Password
+		auth = append(auth, ssh.Password(password),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if auth == nil {
+		return nil, errors.New("no password or private key")
+	}
+	callback, err := hostKeyCallback(cfg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: callback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// Client makes TCP connections through an SSH server.
+type Client struct {
+	dial   func() (net.Conn, error)
+	config *ssh.ClientConfig
+	closed chan struct{} // Closed by Close
+
+	// lock controls access to conn, connecting, and pending. It is not held
+	// while connecting, so that Dial and Close are not held up by a
+	// connection in progress.
+	lock       sync.Mutex
+	conn       *ssh.Client  // nil when not connected
+	connecting *connectCall // The connection in progress, if any
+	pending    net.Conn     // What connecting runs over, once dialed
+}
+
+// connectCall is a connection in progress, which every caller of get that
+// finds no SSH connection waits for.
+type connectCall struct {
+	done   chan struct{} // Closed once client and err are set
+	client *ssh.Client
+	err    error
+}
+
+// New returns a Client that connects to the SSH server as cfg says, over the
+// connections returned by dial. It does not connect until Connect or Dial is
+// called. It returns an error if cfg is not valid.
+func New(cfg Config, dial func() (net.Conn, error)) (*Client, error) {
+	config, err := cfg.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{dial: dial, config: config, closed: make(chan struct{})}, nil
+}
+
+// Connect makes the SSH connection, if there is none, and returns an error if
+// it cannot be made, for instance because authentication failed.
+func (c *Client) Connect() error {
+	_, err := c.get()
+	return err
+}
+
+// get returns the SSH connection, first making it if there is none. Only one
+// connection is made at a time; concurrent callers wait for it, unless Close
+// is called meanwhile.
+func (c *Client) get() (*ssh.Client, error) {
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+		c.lock.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	if client := c.conn; client != nil {
+		c.lock.Unlock()
+		return client, nil
+	}
+	call := c.connecting
+	if call == nil {
+		call = &connectCall{done: make(chan struct{})}
+		c.connecting = call
+		go c.connect(call)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.client, call.err
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// connect makes an SSH connection, makes it the Client's connection, unless
+// the Client has been closed meanwhile, and reports it to the callers waiting
+// for call.
+func (c *Client) connect(call *connectCall) {
+	client, err := c.handshake()
+	c.lock.Lock()
+	c.pending = nil
+	select {
+	case <-c.closed:
+		if client != nil {
+			client.Close()
+		}
+		client, err = nil, net.ErrClosed
+	default:
+	}
+	c.conn = client
+	c.connecting = nil
+	call.client, call.err = client, err
+	close(call.done)
+	c.lock.Unlock()
+	if client == nil {
+		return
+	}
+
+	logging.Stream.Infof("SSH connected as %s to %s", c.config.User, client.ServerVersion())
+	go func() {
+		err := client.Wait()
+		logging.Stream.Infof("SSH connection closed: %v", err)
+		c.forget(client)
+	}()
+}
+
+// handshake dials a connection and makes an SSH connection over it. Close
+// cuts the handshake short.
+func (c *Client) handshake() (*ssh.Client, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+		c.lock.Unlock()
+		conn.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	c.pending = conn
+	c.lock.Unlock()
+
+	// The handshake has no timeout of its own over a net.Conn.
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "tunnel", c.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// forget discards client, if it is still the SSH connection.
+func (c *Client) forget(client *ssh.Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == client {
+		c.conn = nil
+	}
+}
+
+// Dial connects to addr, a "host:port" string, from the SSH server. network
+// must be "tcp" or one of its variants.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SSH cannot carry network %+q", network)
+	}
+	// If the SSH connection has been lost without our knowing, as when
+	// the tunnel session under it was closed, try once more on a new one.
+	for try := 0; ; try++ {
+		client, err := c.get()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial("tcp", addr)
+		var openErr *ssh.OpenChannelError
+		if err == nil || try > 0 || errors.As(err, &openErr) {
+			return conn, err
+		}
+		client.Close()
+		c.forget(client)
+	}
+}
+
+// Close closes the SSH connection, if any, and cuts short one in progress.
+// Dial fails after Close.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.pending != nil {
+		c.pending.Close()
+	}
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
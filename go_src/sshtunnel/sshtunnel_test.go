@@ -0,0 +1,329 @@
+package sshtunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SSH server that accepts the user alice with the password
+// "secret" or the private key userKey, and connects direct-tcpip channels to
+// their destinations.
+type testServer struct {
+	ln      net.Listener
+	hostKey ssh.PublicKey
+	userKey []byte // In OpenSSH format
+
+	lock  sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, userPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := ssh.MarshalPrivateKey(userPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshUserPub, err := ssh.NewPublicKey(userPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "alice" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "alice" && string(key.Marshal()) == string(sshUserPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("wrong key")
+		},
+	}
+	config.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, hostKey: signer.PublicKey(), userKey: pem.EncodeToMemory(userKey)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.lock.Lock()
+	s.conns = append(s.conns, sshConn)
+	s.lock.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		// RFC 4254 section 7.2: host, port, originator host, originator port.
+		data := newChannel.ExtraData()
+		n := binary.BigEndian.Uint32(data)
+		host := string(data[4 : 4+n])
+		port := binary.BigEndian.Uint32(data[4+n:])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, chReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer channel.Close()
+			defer target.Close()
+			go io.Copy(target, channel)
+			io.Copy(channel, target)
+		}()
+	}
+}
+
+// dropConns closes every SSH connection the server has accepted.
+func (s *testServer) dropConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) dial() (net.Conn, error) {
+	return net.Dial("tcp", s.ln.Addr().String())
+}
+
+// echoListener returns the address of a TCP echo server.
+func echoListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func roundTrip(t *testing.T, c *Client, addr string) {
+	t.Helper()
+	conn, err := c.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "hello" {
+		t.Fatalf("read %+q %v", buf[:], err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Password: "secret"},
+		{User: "alice"},
+		{User: "alice", PrivateKey: []byte("not a key")},
+		{User: "alice", Password: "secret", HostKey: "ssh-ed25519 garbage"},
+	} {
+		if _, err := New(cfg, nil); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+// Connections go through the SSH server, which is accepted by its key or its
+// fingerprint, and the SSH connection is made again when it is lost.
+func TestDial(t *testing.T) {
+	s := newTestServer(t)
+	echo := echoListener(t)
+	key := string(ssh.MarshalAuthorizedKey(s.hostKey))
+
+	for _, cfg := range []Config{
+		{User: "alice", Password: "secret", HostKey: key},
+		{User: "alice", Password: "secret", HostKey: "[127.0.0.1]:22 " + key},
+		{User: "alice", PrivateKey: s.userKey, HostKey: ssh.FingerprintSHA256(s.hostKey)},
+	} {
+		c, err := New(cfg, s.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, c, echo)
+		s.dropConns()
+		roundTrip(t, c, echo)
+		c.Close()
+		if _, err := c.Dial("tcp", echo); err == nil {
+			t.Error("Dial after Close succeeded")
+		}
+	}
+}
+
+// A wrong host key or password is refused, and the host key error tells the
+// server's key.
+func TestRefused(t *testing.T) {
+	s := newTestServer(t)
+	for _, hostKey := range []string{"", "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"} {
+		c, err := New(Config{User: "alice", Password: "secret", HostKey: hostKey}, s.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Connect()
+		var hostKeyErr *HostKeyError
+		if !errors.As(err, &hostKeyErr) || hostKeyErr.Fingerprint != ssh.FingerprintSHA256(s.hostKey) || hostKeyErr.Unset != (hostKey == "") {
+			t.Errorf("%+q: got %v", hostKey, err)
+		}
+	}
+
+	c, err := New(Config{User: "alice", Password: "wrong", HostKey: ssh.FingerprintSHA256(s.hostKey)}, s.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// Concurrent Dials share one SSH connection.
+func TestConcurrentDial(t *testing.T) {
+	s := newTestServer(t)
+	echo := echoListener(t)
+	var lock sync.Mutex
+	dials := 0
+	c, err := New(Config{User: "alice", Password: "secret", HostKey: ssh.FingerprintSHA256(s.hostKey)}, func() (net.Conn, error) {
+		lock.Lock()
+		dials++
+		lock.Unlock()
+		return s.dial()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			roundTrip(t, c, echo)
+		}()
+	}
+	wg.Wait()
+	if dials != 1 {
+		t.Errorf("dialed %d times", dials)
+	}
+}
+
+// Close does not wait for a connection in progress, whether it is still being
+// dialed or in its handshake, and the connection is closed.
+func TestCloseDuringConnect(t *testing.T) {
+	// The server never answers the handshake; connections wait unaccepted.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, handshaking := range []bool{false, true} {
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		dialed := make(chan net.Conn, 1)
+		c, err := New(Config{User: "alice", Password: "secret", HostKey: "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"}, func() (net.Conn, error) {
+			close(entered)
+			<-release
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				dialed <- conn
+			}
+			return conn, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			errs <- c.Connect()
+		}()
+		<-entered
+		var conn net.Conn
+		if handshaking {
+			close(release)
+			conn = <-dialed
+		}
+
+		c.Close()
+		select {
+		case err := <-errs:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("handshaking %v: got %v", handshaking, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handshaking %v: Connect not cut short by Close", handshaking)
+		}
+		if !handshaking {
+			close(release)
+			conn = <-dialed
+		}
+
+		// The connection in progress is closed.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("handshaking %v: connection not closed: %v", handshaking, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package tproxy accepts TCP connections that have been diverted to a local
+// listener by a Linux firewall, and recovers their original destinations.
+//
+// Two kinds of firewall rule are supported. With an iptables REDIRECT (or nft
+// redirect) rule, the kernel rewrites the destination of each connection to
+// the listener, and the original destination is available from the
+// SO_ORIGINAL_DST socket option. With a TPROXY rule, the connection is
+// delivered to the listener without rewriting, and its local address is the
+// original destination; this requires the listening socket to have the
+// IP_TRANSPARENT option, which in turn requires CAP_NET_ADMIN.
+//
+// Example rules for REDIRECT, which send all TCP from a LAN on eth1 to a
+// listener on port 7001:
+//
+//	iptables -t nat -A PREROUTING -i eth1 -p tcp -j REDIRECT --to-ports 7001
+//
+// And for TPROXY:
+//
+//	iptables -t mangle -A PREROUTING -i eth1 -p tcp -j TPROXY --on-port 7001 --tproxy-mark 1
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+package tproxy
+
+import (
+	"errors"
+)
+
+// ErrNotSupported is returned on platforms other than Linux.
+var ErrNotSupported = errors.New("transparent proxying is supported only on Linux")
@@ -0,0 +1,106 @@
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and
+// linux/netfilter_ipv6/ip6_tables.h, and IPV6_TRANSPARENT from linux/in6.h.
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+	ipv6Transparent   = 75
+)
+
+// Listen opens a TCP listener at addr for diverted connections. It tries to
+// set IP_TRANSPARENT, so that TPROXY rules work as well as REDIRECT rules; if
+// that fails, for example for lack of CAP_NET_ADMIN, it logs the error and
+// continues, and only REDIRECT rules will work.
+func Listen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				log.Printf("tproxy: cannot set IP_TRANSPARENT, TPROXY rules will not work: %v", err)
+			}
+			return nil
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// OriginalDst returns the destination that conn had before it was diverted.
+// For a connection diverted by REDIRECT, that is the value of
+// SO_ORIGINAL_DST. Otherwise, as with TPROXY or a direct connection, it is the
+// local address of conn. It is up to the caller to detect a direct connection
+// to the listener itself.
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		addr, sockErr = getOriginalDst(int(fd), local.IP.To4() == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(sockErr, syscall.ENOENT) || errors.Is(sockErr, syscall.ENOPROTOOPT) {
+		// No NAT entry, so the connection was not redirected.
+		return local, nil
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %v", sockErr)
+	}
+	return addr, nil
+}
+
+// getOriginalDst gets the SO_ORIGINAL_DST socket option of fd, or
+// IP6T_SO_ORIGINAL_DST if ipv6 is true.
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		// The struct sockaddr_in6 is returned inside the larger struct
+		// ip6_mtuinfo.
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		// Port is in network byte order.
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, info.Addr.Addr[:]...)),
+			Port: int(port),
+		}, nil
+	}
+	// The struct sockaddr_in is returned inside the larger struct
+	// ipv6_mreq: family (2 bytes), port (2 bytes), address (4 bytes).
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	b := mreq.Multiaddr[:]
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(binary.BigEndian.Uint16(b[2:4])),
+	}, nil
+}
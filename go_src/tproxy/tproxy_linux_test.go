@@ -0,0 +1,42 @@
+package tproxy
+
+import (
+	"net"
+	"testing"
+)
+
+// A connection that was not diverted has its own local address as its
+// original destination.
+func TestOriginalDstDirect(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := Listen(tcpAddr)
+		if err != nil {
+			t.Logf("%s: %v", addr, err)
+			continue
+		}
+		defer ln.Close()
+
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		dst, err := OriginalDst(conn)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if dst.String() != ln.Addr().String() {
+			t.Errorf("%s: original destination %v, expected %v", addr, dst, ln.Addr())
+		}
+	}
+}
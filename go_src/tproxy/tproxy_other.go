@@ -0,0 +1,17 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"net"
+)
+
+// Listen returns ErrNotSupported.
+func Listen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, ErrNotSupported
+}
+
+// OriginalDst returns ErrNotSupported.
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrNotSupported
+}
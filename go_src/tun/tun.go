@@ -0,0 +1,191 @@
+// Package tun runs a userspace TCP/IP stack on a TUN device, and terminates
+// the connections it finds there into connections made by a caller-supplied
+// dial function, which is how they are carried through the tunnel.
+//
+// TCP connections are terminated and dialed to their original destinations.
+// UDP cannot be carried through a SOCKS5 proxy over a stream, so the only UDP
+// that is supported is DNS: each query to port 53 is sent as DNS over TCP
+// (RFC 7766) to the same destination, or to a fixed resolver if one is
+// configured, and the response is returned over UDP.
+// Other UDP packets are dropped, which, for example, makes QUIC fall back to
+// TCP.
+//
+// The stack is gVisor's netstack, set up by tun2socks. It accepts packets for
+// any destination address.
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/core"
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/core/device"
+	"github.com/xjasonlyu/tun2socks/v2/core/device/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"www.bamsoftware.com/git/dnstt.git/dnsproxy"
+	"www.bamsoftware.com/git/dnstt.git/logging"
+)
+
+const (
+	// DefaultMTU is the MTU used when none is given.
+	DefaultMTU = 1500
+
+	// A UDP flow is forgotten after this much time without a packet from
+	// the TUN device.
+	udpIdleTimeout = 1 * time.Minute
+	// The port number of DNS.
+	dnsPort = 53
+)
+
+// DialFunc connects to addr, a "host:port" string.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Stack is a TCP/IP stack running on a TUN device.
+type Stack struct {
+	dev   device.Device
+	stack *stack.Stack
+}
+
+// New starts a TCP/IP stack on the TUN device with file descriptor fd, and
+// dials the destination of every TCP connection and DNS query it receives
+// using dial. If dnsResolver is not empty, DNS queries are sent to it rather
+// than to their own destinations; this lets the system be configured with a
+// DNS server address inside the TUN network that does not exist. Every read
+// of fd must return exactly one IP packet, without any header, as with a
+// Linux TUN device opened with IFF_NO_PI or an Android VpnService interface.
+// If mtu is 0, DefaultMTU is used. The Stack takes ownership of fd, and closes
+// it when the Stack is closed, or right away if New returns an error.
+func New(fd int, mtu uint32, dial DialFunc, dnsResolver string) (*Stack, error) {
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	dev, err := fdbased.Open(strconv.Itoa(fd), mtu, 0)
+	if err != nil {
+		os.NewFile(uintptr(fd), "tun").Close()
+		return nil, err
+	}
+	s, err := core.CreateStack(&core.Config{
+		LinkEndpoint:     dev,
+		TransportHandler: &handler{dial: dial, dnsResolver: dnsResolver},
+	})
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &Stack{dev: dev, stack: s}, nil
+}
+
+// Close stops the stack, closes all its connections, and closes the TUN
+// device.
+func (s *Stack) Close() {
+	s.stack.Close()
+	s.dev.Close()
+	s.stack.Wait()
+}
+
+// handler implements adapter.TransportHandler.
+type handler struct {
+	dial        DialFunc
+	dnsResolver string
+	// dropOnce limits logging of dropped UDP.
+	dropOnce sync.Once
+}
+
+// HandleTCP is called by the stack with every new TCP connection. It must not
+// block.
+func (h *handler) HandleTCP(conn adapter.TCPConn) {
+	go func() {
+		defer conn.Close()
+		err := h.handleTCP(conn)
+		if err != nil {
+			logging.Proxy.Warnf("tun: TCP: %v", err)
+		}
+	}()
+}
+
+func (h *handler) handleTCP(conn adapter.TCPConn) error {
+	id := conn.ID()
+	target := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+	remote, err := h.dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, remote)
+		conn.Close()
+	}()
+	wg.Wait()
+	return nil
+}
+
+// HandleUDP is called by the stack with every new UDP flow. It must not
+// block.
+func (h *handler) HandleUDP(conn adapter.UDPConn) {
+	id := conn.ID()
+	if id.LocalPort != dnsPort {
+		h.dropOnce.Do(func() {
+			logging.Proxy.Debugf("tun: dropping UDP that is not DNS, like %s:%d", id.LocalAddress, id.LocalPort)
+		})
+		conn.Close()
+		return
+	}
+	go func() {
+		defer conn.Close()
+		err := h.handleDNS(conn)
+		if err != nil {
+			logging.Proxy.Warnf("tun: DNS: %v", err)
+		}
+	}()
+}
+
+// handleDNS answers the DNS queries in a UDP flow, until the flow has been idle
+// for udpIdleTimeout.
+func (h *handler) handleDNS(conn adapter.UDPConn) error {
+	id := conn.ID()
+	target := h.dnsResolver
+	if target == "" {
+		target = net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+	}
+	var buf [65535]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, addr, err := conn.ReadFrom(buf[:])
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		} else if err == io.EOF {
+			// The stack was closed.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		query := append([]byte{}, buf[:n]...)
+		// Queries are answered concurrently, each over its own
+		// connection.
+		go func() {
+			resp, err := dnsproxy.Exchange(dnsproxy.DialFunc(h.dial), target, query)
+			if err != nil {
+				logging.Proxy.Warnf("tun: DNS query to %s: %v", target, err)
+				return
+			}
+			conn.WriteTo(resp, addr)
+		}()
+	}
+}
@@ -0,0 +1,132 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var (
+	deviceAddr = tcpip.AddrFrom4([4]byte{10, 0, 0, 2})
+	targetAddr = tcpip.AddrFrom4([4]byte{192, 0, 2, 1})
+)
+
+// newDeviceStack returns a TCP/IP stack on fd that plays the part of the
+// operating system on the other side of a TUN device.
+func newDeviceStack(t *testing.T, fd int) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: DefaultMTU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateNIC(1, ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: deviceAddr.WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	return s
+}
+
+// A socketpair stands in for the TUN device. One end goes to a Stack, and the
+// other to a second netstack that makes connections through it.
+func TestStack(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+
+	dialed := make(chan string, 10)
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			if _, port, _ := net.SplitHostPort(addr); port == "53" {
+				// A DNS over TCP server that echoes queries.
+				var length uint16
+				binary.Read(s, binary.BigEndian, &length)
+				query := make([]byte, length)
+				io.ReadFull(s, query)
+				binary.Write(s, binary.BigEndian, length)
+				s.Write(query)
+			} else {
+				io.Copy(s, s)
+			}
+		}()
+		return c, nil
+	}
+	st, err := New(fds[0], 0, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	device := newDeviceStack(t, fds[1])
+	defer device.Close()
+
+	// TCP.
+	conn, err := gonet.DialTCP(device, tcpip.FullAddress{NIC: 1, Addr: targetAddr, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-dialed; addr != "192.0.2.1:80" {
+		t.Errorf("dialed %+q", addr)
+	}
+	msg := bytes.Repeat([]byte("hello"), 10000)
+	go conn.Write(msg)
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("TCP echo mismatch")
+	}
+	conn.Close()
+
+	// DNS over UDP.
+	udpConn, err := gonet.DialUDP(device, nil, &tcpip.FullAddress{NIC: 1, Addr: targetAddr, Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	query := []byte("\x12\x34\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	_, err = udpConn.Write(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], query) {
+		t.Errorf("DNS response %x, expected %x", buf[:n], query)
+	}
+	if addr := <-dialed; addr != "192.0.2.1:53" {
+		t.Errorf("dialed %+q", addr)
+	}
+}